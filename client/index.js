@@ -37,6 +37,10 @@ const accumulateRoomData = (r, isUpdate) => {
             if (r.notification_count !== undefined) {
                 existingRoom.notification_count = r.notification_count;
             }
+            if (r.limited) {
+                // there is a gap, so the events we have are no longer contiguous with the new ones
+                existingRoom.timeline = [];
+            }
             if (r.timeline) {
                 r.timeline.forEach((e) => {
                     existingRoom.timeline.push(e);
@@ -360,7 +364,13 @@ const doSyncLoop = async(accessToken, sessionId) => {
             if (resp.count) {
                 rooms.joinedCount = resp.count;
             }
+            document.getElementById("errorMsg").textContent = resp.degraded ? "Homeserver is unavailable, updates may be delayed" : "";
         } catch (err) {
+            if (err.errcode === "M_UNKNOWN_POS") {
+                // the server has forgotten about this connection, start a new one
+                currentPos = undefined;
+                currentSub = "";
+            }
             if (err.name !== "AbortError") {
                 console.error("/sync failed:",err);
                 console.log("current", currentError, "last", lastError);
@@ -469,7 +479,9 @@ const doSyncRequest = async (accessToken, pos, reqBody) => {
         if (respBody.error) {
             lastError = respBody.error;
         }
-        throw new Error("/sync returned HTTP " + resp.status + " " + respBody.error);
+        let err = new Error("/sync returned HTTP " + resp.status + " " + respBody.errcode + " " + respBody.error);
+        err.errcode = respBody.errcode;
+        throw err;
     }
     lastError = null;
     return respBody;
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
@@ -16,6 +18,14 @@ var (
 	flagDestinationServer = flag.String("server", "", "The destination v2 matrix server")
 	flagBindAddr          = flag.String("port", ":8008", "Bind address")
 	flagPostgres          = flag.String("db", "user=postgres dbname=syncv3 sslmode=disable", "Postgres DB connection string (see lib/pq docs)")
+	flagDefaultTimeout    = flag.Duration("timeout", sync3.DefaultTimeout, "The long-poll timeout to use when clients don't specify ?timeout=")
+	flagMinTimeout        = flag.Duration("timeout-min", sync3.MinTimeout, "The minimum non-zero ?timeout= clients can request")
+	flagMaxTimeout        = flag.Duration("timeout-max", sync3.MaxTimeout, "The maximum ?timeout= clients can request")
+	flagBatchDebounce     = flag.Duration("batch-debounce", sync3.BatchDebounceDuration, "How long to wait for more updates after the first update wakes up a request, so bursts of events are returned in one response")
+	flagTokenSecret       = flag.String("token-secret", os.Getenv("SYNCV3_TOKEN_SECRET"), "If set, access tokens are stored in the database encrypted with this secret so pollers can be resumed on startup. Must be a high-entropy random value, e.g from `openssl rand -hex 32`. Defaults to $SYNCV3_TOKEN_SECRET")
+	flagPollerIdleTimeout = flag.Duration("poller-idle-timeout", sync2.PollerIdleTimeout, "How long a device can have no connections before its v2 poller is stopped, 0 to never stop pollers")
+	flagInitialSyncWorker = flag.Int("initial-sync-workers", sync2.InitialSyncWorkers, "How many rooms in an initial v2 sync are stored concurrently")
+	flagPollerFilter      = flag.String("v2-filter", string(sync2.PollerFilter), "The JSON filter used for v2 sync requests, empty to use the server defaults. The timeline limit should be large to avoid gaps")
 )
 
 func main() {
@@ -24,6 +34,17 @@ func main() {
 		flag.Usage()
 		os.Exit(1)
 	}
+	sync3.DefaultTimeout = *flagDefaultTimeout
+	sync3.MinTimeout = *flagMinTimeout
+	sync3.MaxTimeout = *flagMaxTimeout
+	sync3.BatchDebounceDuration = *flagBatchDebounce
+	sync2.PollerIdleTimeout = *flagPollerIdleTimeout
+	sync2.InitialSyncWorkers = *flagInitialSyncWorker
+	if *flagPollerFilter != "" && !json.Valid([]byte(*flagPollerFilter)) {
+		fmt.Fprintf(os.Stderr, "-v2-filter is not valid JSON: %s\n", *flagPollerFilter)
+		os.Exit(1)
+	}
+	sync2.PollerFilter = json.RawMessage(*flagPollerFilter)
 	// pprof
 	go func() {
 		if err := http.ListenAndServe(":6060", nil); err != nil {
@@ -35,9 +56,9 @@ func main() {
 			Timeout: 5 * time.Minute,
 		},
 		DestinationServer: *flagDestinationServer,
-	}, *flagPostgres)
+	}, *flagPostgres, *flagTokenSecret)
 	if err != nil {
 		panic(err)
 	}
-	syncv3.RunSyncV3Server(h, *flagBindAddr)
+	syncv3.RunSyncV3Server(h, h.WebSocketHandler(), *flagBindAddr)
 }
@@ -4,7 +4,10 @@ go 1.14
 
 require (
 	github.com/ReneKroon/ttlcache/v2 v2.8.1
+	github.com/andybalholm/brotli v1.0.3
+	github.com/fxamacker/cbor/v2 v2.3.0
 	github.com/gorilla/mux v1.8.0
+	github.com/gorilla/websocket v1.4.2
 	github.com/jmoiron/sqlx v1.3.3
 	github.com/lib/pq v1.10.1
 	github.com/matrix-org/gomatrixserverlib v0.0.0-20210510192107-124228cb9548
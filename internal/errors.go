@@ -5,21 +5,53 @@ import (
 	"fmt"
 )
 
+// Matrix error codes returned to clients
+const (
+	// The connection or position is unknown, the client should start a new connection
+	ErrCodeUnknownPos = "M_UNKNOWN_POS"
+	// The access token is not recognised by the upstream server
+	ErrCodeUnknownToken = "M_UNKNOWN_TOKEN"
+	// No access token was supplied
+	ErrCodeMissingToken = "M_MISSING_TOKEN"
+	// The request body could not be decoded
+	ErrCodeBadJSON = "M_BAD_JSON"
+	// A query parameter was invalid
+	ErrCodeInvalidParam = "M_INVALID_PARAM"
+	// The client, or the proxy on behalf of the client, is being rate limited
+	ErrCodeLimitExceeded = "M_LIMIT_EXCEEDED"
+	// Anything else
+	ErrCodeUnknown = "M_UNKNOWN"
+)
+
 type HandlerError struct {
 	StatusCode int
-	Err        error
+	// The Matrix error code, defaults to M_UNKNOWN
+	ErrCode string
+	Err     error
 }
 
 func (e *HandlerError) Error() string {
-	return fmt.Sprintf("HTTP %d : %s", e.StatusCode, e.Err.Error())
+	return fmt.Sprintf("HTTP %d %s : %s", e.StatusCode, e.errCode(), e.Err.Error())
+}
+
+func (e *HandlerError) errCode() string {
+	if e.ErrCode == "" {
+		return ErrCodeUnknown
+	}
+	return e.ErrCode
 }
 
 type jsonError struct {
-	Err string `json:"error"`
+	ErrCode string `json:"errcode"`
+	Err     string `json:"error"`
 }
 
-func (e HandlerError) JSON() []byte {
-	je := jsonError{e.Error()}
+// JSON returns the standard Matrix error response body for this error.
+func (e *HandlerError) JSON() []byte {
+	je := jsonError{
+		ErrCode: e.errCode(),
+		Err:     e.Err.Error(),
+	}
 	b, _ := json.Marshal(je)
 	return b
 }
@@ -0,0 +1,35 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHandlerErrorJSON(t *testing.T) {
+	testCases := []struct {
+		herr HandlerError
+		want string
+	}{
+		{
+			herr: HandlerError{
+				StatusCode: 400,
+				ErrCode:    ErrCodeUnknownPos,
+				Err:        fmt.Errorf("unknown position: 5"),
+			},
+			want: `{"errcode":"M_UNKNOWN_POS","error":"unknown position: 5"}`,
+		},
+		{
+			herr: HandlerError{
+				StatusCode: 500,
+				Err:        fmt.Errorf("database is down"),
+			},
+			want: `{"errcode":"M_UNKNOWN","error":"database is down"}`,
+		},
+	}
+	for _, tc := range testCases {
+		got := string(tc.herr.JSON())
+		if got != tc.want {
+			t.Errorf("JSON(): got %s want %s", got, tc.want)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
+	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/sync-v3/sqlutil"
 	"github.com/rs/zerolog"
 	"github.com/tidwall/gjson"
@@ -19,10 +20,10 @@ var log = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.Cons
 
 // Accumulator tracks room state and timelines.
 //
-// In order for it to remain simple(ish), the accumulator DOES NOT SUPPORT arbitrary timeline gaps.
 // There is an Initialise function for new rooms (with some pre-determined state) and then a constant
-// Accumulate function for timeline events. v2 sync must be called with a large enough timeline.limit
-// for this to work!
+// Accumulate function for timeline events. Timeline gaps (limited v2 timelines) are handled by calling
+// Initialise with the v2 state block, which rolls the current state forward to the start of the timeline,
+// then calling Accumulate with the prev_batch token, which marks the first event after the gap.
 type Accumulator struct {
 	db            *sqlx.DB
 	roomsTable    *RoomsTable
@@ -94,82 +95,122 @@ func (a *Accumulator) calculateNewSnapshot(old StrippedEvents, new Event) (Strip
 	return result, replacedNID
 }
 
+// InitialiseResult is the outcome of Initialise.
+type InitialiseResult struct {
+	// True if this was the first time the room was seen, so a snapshot was created from the state given.
+	AddedEvents bool
+	// The state events which replaced events in the existing current state, if the room has been seen before.
+	ReplacedState []json.RawMessage
+}
+
+// Changed returns true if the current state of the room was changed.
+func (r InitialiseResult) Changed() bool {
+	return r.AddedEvents || len(r.ReplacedState) > 0
+}
+
 // Initialise starts a new sync accumulator for the given room using the given state as a baseline.
-// This will only take effect if this is the first time the v3 server has seen this room, and it wasn't
+// This is used if this is the first time the v3 server has seen this room, and it wasn't
 // possible to get all events up to the create event (e.g Matrix HQ). Returns true if this call actually
-// added new events
+// changed the current state.
 //
 // This function:
 // - Stores these events
 // - Sets up the current snapshot based on the state list given.
+//
+// If the room already has a current snapshot, the state list is diffed against it and any events which
+// differ replace those in the current state. This happens after a gap in the timeline, on a rejoin, or
+// when state resolution on the server changes the state of the room.
 func (a *Accumulator) Initialise(roomID string, state []json.RawMessage) (bool, error) {
+	var res InitialiseResult
+	err := sqlutil.WithTransaction(a.db, func(txn *sqlx.Tx) (err error) {
+		res, err = a.initialise(txn, roomID, state, nil)
+		return err
+	})
+	return res.Changed(), err
+}
+
+// initialise is Initialise in the caller's transaction. `timeline` is the timeline which follows the
+// state, if any. If any of the timeline has been seen before, the state is older than the current
+// snapshot, so only state events which have never been seen before replace the current state.
+func (a *Accumulator) initialise(txn *sqlx.Tx, roomID string, state, timeline []json.RawMessage) (InitialiseResult, error) {
+	var res InitialiseResult
 	if len(state) == 0 {
-		return false, nil
+		return res, nil
 	}
-	addedEvents := false
-	err := sqlutil.WithTransaction(a.db, func(txn *sqlx.Tx) error {
-		// Attempt to short-circuit. This has to be done inside a transaction to make sure
-		// we don't race with multiple calls to Initialise with the same room ID.
-		snapshotID, err := a.roomsTable.CurrentAfterSnapshotID(txn, roomID)
-		if err != nil {
-			return fmt.Errorf("error fetching snapshot id for room %s: %s", roomID, err)
-		}
-		if snapshotID > 0 {
-			// we only initialise rooms once
-			log.Info().Str("room_id", roomID).Int64("snapshot_id", snapshotID).Msg("Accumulator.Initialise called but current snapshot already exists, bailing early")
-			return nil
-		}
-
-		// Insert the events
-		events := make([]Event, len(state))
-		for i := range events {
-			events[i] = Event{
-				JSON:   state[i],
-				RoomID: roomID,
+	// Attempt to short-circuit. This has to be done inside a transaction to make sure
+	// we don't race with multiple calls to Initialise with the same room ID.
+	snapshotID, err := a.roomsTable.CurrentAfterSnapshotID(txn, roomID)
+	if err != nil {
+		return res, fmt.Errorf("error fetching snapshot id for room %s: %s", roomID, err)
+	}
+	if snapshotID > 0 {
+		// we only initialise rooms once, after which we can only replace state
+		// The state is stale if any of the timeline has been seen before, even if the start of the
+		// timeline is new: another user's poller may have seen the rest of it after a gap.
+		stale := false
+		if len(timeline) > 0 {
+			eventIDs := make([]string, len(timeline))
+			for i := range timeline {
+				eventIDs[i] = gjson.GetBytes(timeline[i], "event_id").Str
 			}
+			nids, err := a.eventsTable.SelectNIDsByIDs(txn, eventIDs)
+			if err != nil {
+				return res, fmt.Errorf("failed to check if the timeline is new: %w", err)
+			}
+			stale = len(nids) > 0
 		}
-		numNew, err := a.eventsTable.Insert(txn, events)
-		if err != nil {
-			return fmt.Errorf("failed to insert events: %w", err)
-		}
-		if numNew == 0 {
-			// we don't have a current snapshot for this room but yet no events are new,
-			// no idea how this should be handled.
-			log.Error().Str("room_id", roomID).Msg(
-				"Accumulator.Initialise: room has no current snapshot but also no new inserted events, doing nothing. This is probably a bug.",
-			)
-			return nil
-		}
-
-		// pull out the event NIDs we just inserted
-		eventIDs := make([]string, len(events))
-		for i := range eventIDs {
-			eventIDs[i] = events[i].ID
-		}
-		nids, err := a.eventsTable.SelectNIDsByIDs(txn, eventIDs)
-		if err != nil {
-			return fmt.Errorf("failed to select NIDs for inserted events: %w", err)
-		}
+		res.ReplacedState, err = a.reconcileState(txn, roomID, snapshotID, state, stale)
+		return res, err
+	}
 
-		// Make a current snapshot
-		snapshot := &SnapshotRow{
+	// Insert the events
+	events := make([]Event, len(state))
+	for i := range events {
+		events[i] = Event{
+			JSON:   state[i],
 			RoomID: roomID,
-			Events: pq.Int64Array(nids),
 		}
-		err = a.snapshotTable.Insert(txn, snapshot)
-		if err != nil {
-			return fmt.Errorf("failed to insert snapshot: %w", err)
-		}
-		addedEvents = true
+	}
+	numNew, err := a.eventsTable.Insert(txn, events)
+	if err != nil {
+		return res, fmt.Errorf("failed to insert events: %w", err)
+	}
+	if numNew == 0 {
+		// we don't have a current snapshot for this room but yet no events are new,
+		// no idea how this should be handled.
+		log.Error().Str("room_id", roomID).Msg(
+			"Accumulator.Initialise: room has no current snapshot but also no new inserted events, doing nothing. This is probably a bug.",
+		)
+		return res, nil
+	}
 
-		// these events do not have a state snapshot ID associated with them as we don't know what
-		// order the state events came down in, it's only a snapshot. This means only timeline events
-		// will have an associated state snapshot ID on the event.
+	// pull out the event NIDs we just inserted
+	eventIDs := make([]string, len(events))
+	for i := range eventIDs {
+		eventIDs[i] = events[i].ID
+	}
+	nids, err := a.eventsTable.SelectNIDsByIDs(txn, eventIDs)
+	if err != nil {
+		return res, fmt.Errorf("failed to select NIDs for inserted events: %w", err)
+	}
 
-		// Set the snapshot ID as the current state
-		return a.roomsTable.UpdateCurrentAfterSnapshotID(txn, roomID, snapshot.SnapshotID)
-	})
-	return addedEvents, err
+	// Make a current snapshot
+	snapshot := &SnapshotRow{
+		RoomID: roomID,
+		Events: pq.Int64Array(nids),
+	}
+	err = a.snapshotTable.Insert(txn, snapshot)
+	if err != nil {
+		return res, fmt.Errorf("failed to insert snapshot: %w", err)
+	}
+
+	// these events do not have a state snapshot ID associated with them as we don't know what
+	// order the state events came down in, it's only a snapshot. This means only timeline events
+	// will have an associated state snapshot ID on the event.
+
+	// Set the snapshot ID as the current state
+	res.AddedEvents = true
+	return res, a.roomsTable.UpdateCurrentAfterSnapshotID(txn, roomID, snapshot.SnapshotID)
 }
 
 // Accumulate internal state from a user's sync response. The timeline order MUST be in the order
@@ -182,130 +223,339 @@ func (a *Accumulator) Initialise(roomID string, state []json.RawMessage) (bool,
 //     to exist in the database, and the sync stream is already linearised for us.
 //   - Else it creates a new room state snapshot if the timeline contains state events (as this now represents the current state)
 //   - It adds entries to the membership log for membership events.
-func (a *Accumulator) Accumulate(roomID string, timeline []json.RawMessage) (numNew int, latestNID int64, err error) {
+//   - If `prevBatch` is set (the v2 timeline was limited) and every event is new, there is a gap before
+//     the timeline, so the first event is marked with the prev_batch token. If some events have been seen
+//     before then the timeline overlaps what we already have and there is no gap.
+//   - It redacts the stored events targeted by new redaction events.
+func (a *Accumulator) Accumulate(roomID, prevBatch string, timeline []json.RawMessage) (numNew int, latestNID int64, err error) {
+	err = sqlutil.WithTransaction(a.db, func(txn *sqlx.Tx) error {
+		numNew, latestNID, err = a.accumulate(txn, roomID, prevBatch, timeline)
+		return err
+	})
+	return numNew, latestNID, err
+}
+
+// accumulate is Accumulate in the caller's transaction.
+func (a *Accumulator) accumulate(txn *sqlx.Tx, roomID, prevBatch string, timeline []json.RawMessage) (numNew int, latestNID int64, err error) {
 	if len(timeline) == 0 {
 		return 0, 0, nil
 	}
-	err = sqlutil.WithTransaction(a.db, func(txn *sqlx.Tx) error {
-		// Insert the events
-		events := make([]Event, len(timeline))
-		for i := range events {
-			events[i] = Event{
-				JSON:   timeline[i],
-				RoomID: roomID,
-			}
-		}
-		numNew, err = a.eventsTable.Insert(txn, events)
-		if err != nil {
-			return err
-		}
-		if numNew == 0 {
-			// nothing to do, we already know about these events
-			return nil
+	// Insert the events
+	events := make([]Event, len(timeline))
+	for i := range events {
+		events[i] = Event{
+			JSON:   timeline[i],
+			RoomID: roomID,
 		}
+	}
+	numNew, err = a.eventsTable.Insert(txn, events)
+	if err != nil {
+		return 0, 0, err
+	}
+	if numNew == 0 {
+		// nothing to do, we already know about these events
+		return 0, 0, nil
+	}
 
-		// The last numNew events are new
-		newEvents := timeline[len(timeline)-numNew:]
+	// The last numNew events are new
+	newEvents := timeline[len(timeline)-numNew:]
 
-		// Decorate the new events with useful information
-		var newEventsDec []struct {
+	// Decorate the new events with useful information
+	var newEventsDec []struct {
+		JSON    gjson.Result
+		NID     int64
+		IsState bool
+	}
+	var newEventIDs []string
+	for _, ev := range newEvents {
+		var evDec struct {
 			JSON    gjson.Result
 			NID     int64
 			IsState bool
 		}
-		var newEventIDs []string
-		for _, ev := range newEvents {
-			var evDec struct {
-				JSON    gjson.Result
-				NID     int64
-				IsState bool
-			}
-			eventJSON := gjson.ParseBytes(ev)
-			newEventIDs = append(newEventIDs, eventJSON.Get("event_id").Str) // track the event IDs for mapping to NIDs
-			evDec.JSON = eventJSON
-			if eventJSON.Get("state_key").Exists() {
-				evDec.IsState = true
-			}
-			newEventsDec = append(newEventsDec, evDec)
+		eventJSON := gjson.ParseBytes(ev)
+		newEventIDs = append(newEventIDs, eventJSON.Get("event_id").Str) // track the event IDs for mapping to NIDs
+		evDec.JSON = eventJSON
+		if eventJSON.Get("state_key").Exists() {
+			evDec.IsState = true
 		}
+		newEventsDec = append(newEventsDec, evDec)
+	}
 
-		newEventNIDs, err := a.eventsTable.SelectNIDsByIDs(txn, newEventIDs)
-		if err != nil {
-			return err
-		}
-		if len(newEventNIDs) != len(newEventIDs) {
-			log.Error().Strs("asked", newEventIDs).Ints64("gots", newEventNIDs).Msg("missing events in database!")
-			return fmt.Errorf("failed to extract nids from inserted events, asked for %d got %d", len(newEventIDs), len(newEventNIDs))
-		}
-		for i, nid := range newEventNIDs {
-			newEventsDec[i].NID = nid
-			// assign the highest nid value to the latest nid.
-			// we'll return this to the caller so they can stay in-sync
-			if nid > latestNID {
-				latestNID = nid
-			}
+	newEventNIDs, err := a.eventsTable.SelectNIDsByIDs(txn, newEventIDs)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(newEventNIDs) != len(newEventIDs) {
+		log.Error().Strs("asked", newEventIDs).Ints64("gots", newEventNIDs).Msg("missing events in database!")
+		return 0, 0, fmt.Errorf("failed to extract nids from inserted events, asked for %d got %d", len(newEventIDs), len(newEventNIDs))
+	}
+	for i, nid := range newEventNIDs {
+		newEventsDec[i].NID = nid
+		// assign the highest nid value to the latest nid.
+		// we'll return this to the caller so they can stay in-sync
+		if nid > latestNID {
+			latestNID = nid
 		}
+	}
 
-		// Given a timeline of [E1, E2, S3, E4, S5, S6, E7] (E=message event, S=state event)
-		// And a prior state snapshot of SNAP0 then the BEFORE snapshot IDs are grouped as:
-		// E1,E2,S3 => SNAP0
-		// E4, S5 => (SNAP0 + S3)
-		// S6 => (SNAP0 + S3 + S5)
-		// E7 => (SNAP0 + S3 + S5 + S6)
-		// We can track this by loading the current snapshot ID (after snapshot) then rolling forward
-		// the timeline until we hit a state event, at which point we make a new snapshot but critically
-		// do NOT assign the new state event in the snapshot so as to represent the state before the event.
-		snapID, err := a.roomsTable.CurrentAfterSnapshotID(txn, roomID)
-		if err != nil {
-			return err
+	if prevBatch != "" && numNew == len(timeline) {
+		// NIDs are sorted so the first is the earliest event
+		if err = a.eventsTable.UpdatePrevBatch(txn, newEventNIDs[0], prevBatch); err != nil {
+			return 0, 0, fmt.Errorf("failed to mark timeline gap: %w", err)
 		}
-		for _, ev := range newEventsDec {
-			var replacesNID int64
-			// the snapshot ID we assign to this event is unaffected by whether /this/ event is state or not,
-			// as this is the before snapshot ID.
-			beforeSnapID := snapID
+	}
 
-			if ev.IsState {
-				// make a new snapshot and update the snapshot ID
-				var oldStripped StrippedEvents
-				if snapID != 0 {
-					oldStripped, err = a.strippedEventsForSnapshot(txn, snapID)
-					if err != nil {
-						return fmt.Errorf("failed to load stripped state events for snapshot %d: %s", snapID, err)
-					}
-				}
-				newStripped, replacedNID := a.calculateNewSnapshot(oldStripped, Event{
-					NID:      ev.NID,
-					Type:     ev.JSON.Get("type").Str,
-					StateKey: ev.JSON.Get("state_key").Str,
-					ID:       ev.JSON.Get("event_id").Str,
-					RoomID:   roomID,
-				})
+	// Given a timeline of [E1, E2, S3, E4, S5, S6, E7] (E=message event, S=state event)
+	// And a prior state snapshot of SNAP0 then the BEFORE snapshot IDs are grouped as:
+	// E1,E2,S3 => SNAP0
+	// E4, S5 => (SNAP0 + S3)
+	// S6 => (SNAP0 + S3 + S5)
+	// E7 => (SNAP0 + S3 + S5 + S6)
+	// We can track this by loading the current snapshot ID (after snapshot) then rolling forward
+	// the timeline until we hit a state event, at which point we make a new snapshot but critically
+	// do NOT assign the new state event in the snapshot so as to represent the state before the event.
+	snapID, err := a.roomsTable.CurrentAfterSnapshotID(txn, roomID)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, ev := range newEventsDec {
+		var replacesNID int64
+		// the snapshot ID we assign to this event is unaffected by whether /this/ event is state or not,
+		// as this is the before snapshot ID.
+		beforeSnapID := snapID
+
+		if ev.IsState {
+			// make a new snapshot and update the snapshot ID
+			var oldStripped StrippedEvents
+			if snapID != 0 {
+				oldStripped, err = a.strippedEventsForSnapshot(txn, snapID)
 				if err != nil {
-					return err
-				}
-				replacesNID = replacedNID
-				newSnapshot := &SnapshotRow{
-					RoomID: roomID,
-					Events: newStripped.NIDs(),
-				}
-				if err = a.snapshotTable.Insert(txn, newSnapshot); err != nil {
-					return fmt.Errorf("failed to insert new snapshot: %w", err)
+					return 0, 0, fmt.Errorf("failed to load stripped state events for snapshot %d: %s", snapID, err)
 				}
-				snapID = newSnapshot.SnapshotID
 			}
-			if err := a.eventsTable.UpdateBeforeSnapshotID(txn, ev.NID, beforeSnapID, replacesNID); err != nil {
-				return err
+			newStripped, replacedNID := a.calculateNewSnapshot(oldStripped, Event{
+				NID:      ev.NID,
+				Type:     ev.JSON.Get("type").Str,
+				StateKey: ev.JSON.Get("state_key").Str,
+				ID:       ev.JSON.Get("event_id").Str,
+				RoomID:   roomID,
+			})
+			if err != nil {
+				return 0, 0, err
+			}
+			replacesNID = replacedNID
+			newSnapshot := &SnapshotRow{
+				RoomID: roomID,
+				Events: newStripped.NIDs(),
+			}
+			if err = a.snapshotTable.Insert(txn, newSnapshot); err != nil {
+				return 0, 0, fmt.Errorf("failed to insert new snapshot: %w", err)
 			}
+			snapID = newSnapshot.SnapshotID
+		}
+		if err := a.eventsTable.UpdateBeforeSnapshotID(txn, ev.NID, beforeSnapID, replacesNID); err != nil {
+			return 0, 0, err
 		}
+		if ev.JSON.Get("type").Str == "m.room.redaction" {
+			if err = a.redact(txn, roomID, ev.JSON); err != nil {
+				return 0, 0, fmt.Errorf("failed to apply redaction %s: %w", ev.JSON.Get("event_id").Str, err)
+			}
+		}
+	}
 
-		// the last fetched snapshot ID is the current one
-		if err = a.roomsTable.UpdateCurrentAfterSnapshotID(txn, roomID, snapID); err != nil {
-			return fmt.Errorf("failed to UpdateCurrentSnapshotID to %d: %w", snapID, err)
+	// the last fetched snapshot ID is the current one
+	if err = a.roomsTable.UpdateCurrentAfterSnapshotID(txn, roomID, snapID); err != nil {
+		return 0, 0, fmt.Errorf("failed to UpdateCurrentSnapshotID to %d: %w", snapID, err)
+	}
+	return numNew, latestNID, nil
+}
+
+// redact prunes the stored JSON of the event targeted by this redaction, if we know about it. Snapshots
+// refer to events by NID, so redacting a state event also redacts it in the current state.
+func (a *Accumulator) redact(txn *sqlx.Tx, roomID string, redaction gjson.Result) error {
+	redactsID := redaction.Get("redacts").Str
+	if redactsID == "" {
+		redactsID = redaction.Get("content.redacts").Str
+	}
+	if redactsID == "" {
+		return nil
+	}
+	targets, err := a.eventsTable.SelectByIDs(txn, false, []string{redactsID})
+	if err != nil {
+		return fmt.Errorf("failed to select redacted event: %w", err)
+	}
+	if len(targets) == 0 || targets[0].RoomID != roomID {
+		// we've never seen this event, or the redaction is bogus
+		return nil
+	}
+	target := targets[0]
+	if gjson.GetBytes(target.JSON, "unsigned.redacted_because").Exists() {
+		return nil // already redacted
+	}
+	roomVersion := gomatrixserverlib.RoomVersionV1
+	createEvent, err := a.eventsTable.SelectCreateEvent(txn, roomID)
+	if err != nil {
+		return fmt.Errorf("failed to select create event: %w", err)
+	}
+	if createEvent != nil {
+		if v := gjson.GetBytes(createEvent.JSON, "content.room_version").Str; v != "" {
+			roomVersion = gomatrixserverlib.RoomVersion(v)
 		}
+	}
+	redacted, err := redactEventJSON(target.ID, target.JSON, []byte(redaction.Raw), roomVersion)
+	if err != nil {
+		// e.g an unknown room version: keep the event rather than failing the whole timeline
+		log.Warn().Err(err).Str("room_id", roomID).Str("event_id", target.ID).Str("room_version", string(roomVersion)).Msg(
+			"Accumulator: failed to redact event",
+		)
 		return nil
+	}
+	return a.eventsTable.UpdateEventJSON(txn, target.NID, redacted)
+}
+
+// Room versions whose redaction algorithm isn't known to gomatrixserverlib. These use the v6 algorithm, which
+// is the same apart from extra content keys which are preserved for some event types (event type -> keys).
+var redactionFallbacks = map[gomatrixserverlib.RoomVersion]map[string][]string{
+	"7": {},
+	"8": {
+		"m.room.join_rules": {"allow"},
+	},
+	"9": {
+		"m.room.join_rules": {"allow"},
+		"m.room.member":     {"join_authorised_via_users_server"},
+	},
+	"10": {
+		"m.room.join_rules": {"allow"},
+		"m.room.member":     {"join_authorised_via_users_server"},
+	},
+}
+
+// redactEventJSON returns the client format event JSON with its content pruned according to the
+// redaction algorithm for the room version, and the redaction event in unsigned.redacted_because.
+func redactEventJSON(eventID string, eventJSON, redactionJSON []byte, roomVersion gomatrixserverlib.RoomVersion) ([]byte, error) {
+	extraKeys, isFallback := redactionFallbacks[roomVersion]
+	if isFallback {
+		roomVersion = gomatrixserverlib.RoomVersionV6
+	}
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSONWithEventID(eventID, eventJSON, false, roomVersion)
+	if err != nil {
+		return nil, err
+	}
+	var redacted map[string]json.RawMessage
+	if err = json.Unmarshal(ev.Redact().JSON(), &redacted); err != nil {
+		return nil, err
+	}
+	if keys := extraKeys[ev.Type()]; len(keys) > 0 {
+		content := make(map[string]json.RawMessage)
+		if raw, ok := redacted["content"]; ok {
+			if err = json.Unmarshal(raw, &content); err != nil {
+				return nil, err
+			}
+		}
+		for _, key := range keys {
+			if val := gjson.GetBytes(eventJSON, "content."+key); val.Exists() {
+				content[key] = json.RawMessage(val.Raw)
+			}
+		}
+		redacted["content"], err = json.Marshal(content)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// later room versions remove the event ID, but clients need it
+	redacted["event_id"], err = json.Marshal(eventID)
+	if err != nil {
+		return nil, err
+	}
+	redacted["unsigned"], err = json.Marshal(map[string]json.RawMessage{
+		"redacted_because": redactionJSON,
 	})
-	return numNew, latestNID, err
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(redacted)
+}
+
+// reconcileState diffs the state given against the current snapshot, and makes a new current snapshot
+// with any state events which differ. If `stale` is set, the state is older than the current snapshot so
+// only events which have never been seen before are used. Returns the state events which were replaced.
+func (a *Accumulator) reconcileState(txn *sqlx.Tx, roomID string, snapID int64, state []json.RawMessage, stale bool) ([]json.RawMessage, error) {
+	eventIDs := make([]string, len(state))
+	eventIDToJSON := make(map[string]json.RawMessage, len(state))
+	for i := range state {
+		eventIDs[i] = gjson.GetBytes(state[i], "event_id").Str
+		eventIDToJSON[eventIDs[i]] = state[i]
+	}
+	var known StrippedEvents
+	var err error
+	if stale {
+		// find out which events we've seen before, before inserting them
+		known, err = a.eventsTable.SelectStrippedEventsByIDs(txn, false, eventIDs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to select known state events: %w", err)
+		}
+	}
+	events := make([]Event, len(state))
+	for i := range events {
+		events[i] = Event{
+			JSON:   state[i],
+			RoomID: roomID,
+		}
+	}
+	if _, err = a.eventsTable.Insert(txn, events); err != nil {
+		return nil, fmt.Errorf("failed to insert events: %w", err)
+	}
+	candidateIDs := eventIDs
+	if stale {
+		knownIDs := make(map[string]bool, len(known))
+		for _, ev := range known {
+			knownIDs[ev.ID] = true
+		}
+		candidateIDs = nil
+		for _, eventID := range eventIDs {
+			if !knownIDs[eventID] {
+				candidateIDs = append(candidateIDs, eventID)
+			}
+		}
+		if len(candidateIDs) == 0 {
+			return nil, nil
+		}
+	}
+	candidates, err := a.eventsTable.SelectStrippedEventsByIDs(txn, true, candidateIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select state events: %w", err)
+	}
+	current, err := a.strippedEventsForSnapshot(txn, snapID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load stripped state events for snapshot %d: %s", snapID, err)
+	}
+	currentNIDs := make(map[string]int64, len(current))
+	for _, ev := range current {
+		currentNIDs[ev.Type+"\x1f"+ev.StateKey] = ev.NID
+	}
+	var replaced []json.RawMessage
+	for _, ev := range candidates {
+		if nid, ok := currentNIDs[ev.Type+"\x1f"+ev.StateKey]; ok && nid == ev.NID {
+			continue // already in the current state
+		}
+		current, _ = a.calculateNewSnapshot(current, ev)
+		replaced = append(replaced, eventIDToJSON[ev.ID])
+	}
+	if len(replaced) == 0 {
+		return nil, nil
+	}
+	snapshot := &SnapshotRow{
+		RoomID: roomID,
+		Events: current.NIDs(),
+	}
+	if err = a.snapshotTable.Insert(txn, snapshot); err != nil {
+		return nil, fmt.Errorf("failed to insert snapshot: %w", err)
+	}
+	log.Info().Str("room_id", roomID).Int("num_replaced", len(replaced)).Int64("snapshot_id", snapshot.SnapshotID).Bool("stale", stale).Msg(
+		"Accumulator.Initialise: replaced current state",
+	)
+	return replaced, a.roomsTable.UpdateCurrentAfterSnapshotID(txn, roomID, snapshot.SnapshotID)
 }
 
 // Delta returns a list of events of at most `limit` for the room not including `lastEventNID`.
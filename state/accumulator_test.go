@@ -2,10 +2,14 @@ package state
 
 import (
 	"encoding/json"
+	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/sync-v3/sqlutil"
 	"github.com/matrix-org/sync-v3/sync2"
 	"github.com/tidwall/gjson"
 )
@@ -107,7 +111,7 @@ func TestAccumulatorAccumulate(t *testing.T) {
 	}
 	var numNew int
 	var gotLatestNID int64
-	if numNew, gotLatestNID, err = accumulator.Accumulate(roomID, newEvents); err != nil {
+	if numNew, gotLatestNID, err = accumulator.Accumulate(roomID, "", newEvents); err != nil {
 		t.Fatalf("failed to Accumulate: %s", err)
 	}
 	if numNew != len(newEvents) {
@@ -168,11 +172,218 @@ func TestAccumulatorAccumulate(t *testing.T) {
 	}
 
 	// subsequent calls do nothing and are not an error
-	if _, _, err = accumulator.Accumulate(roomID, newEvents); err != nil {
+	if _, _, err = accumulator.Accumulate(roomID, "", newEvents); err != nil {
 		t.Fatalf("failed to Accumulate: %s", err)
 	}
 }
 
+// Test that limited timelines roll state forward from the v2 state block and mark the gap.
+func TestAccumulatorTimelineGap(t *testing.T) {
+	roomID := "!TestAccumulatorTimelineGap:localhost"
+	roomEvents := []json.RawMessage{
+		[]byte(`{"event_id":"gA", "type":"m.room.create", "state_key":"", "content":{"creator":"@me:localhost"}}`),
+		[]byte(`{"event_id":"gB", "type":"m.room.member", "state_key":"@me:localhost", "content":{"membership":"join"}}`),
+		[]byte(`{"event_id":"gC", "type":"m.room.join_rules", "state_key":"", "content":{"join_rule":"public"}}`),
+	}
+	db, err := sqlx.Open("postgres", postgresConnectionString)
+	if err != nil {
+		t.Fatalf("failed to open SQL db: %s", err)
+	}
+	accumulator := NewAccumulator(db)
+	if _, err = accumulator.Initialise(roomID, roomEvents); err != nil {
+		t.Fatalf("failed to Initialise accumulator: %s", err)
+	}
+	if _, _, err = accumulator.Accumulate(roomID, "", []json.RawMessage{
+		[]byte(`{"event_id":"gD", "type":"m.room.message","content":{"body":"before the gap","msgtype":"m.text"}}`),
+	}); err != nil {
+		t.Fatalf("failed to Accumulate: %s", err)
+	}
+
+	// the state block for a limited timeline contains state changes which happened in the gap, along with
+	// state we already know about.
+	gapState := []json.RawMessage{
+		roomEvents[1],
+		[]byte(`{"event_id":"gE", "type":"m.room.join_rules", "state_key":"", "content":{"join_rule":"invite"}}`),
+		[]byte(`{"event_id":"gF", "type":"m.room.member", "state_key":"@you:localhost", "content":{"membership":"join"}}`),
+	}
+	added, err := accumulator.Initialise(roomID, gapState)
+	if err != nil {
+		t.Fatalf("failed to Initialise accumulator after a gap: %s", err)
+	}
+	if !added {
+		t.Fatalf("Initialise after a gap didn't add events, wanted it to")
+	}
+	timeline := []json.RawMessage{
+		[]byte(`{"event_id":"gG", "type":"m.room.message","content":{"body":"after the gap","msgtype":"m.text"}}`),
+		[]byte(`{"event_id":"gH", "type":"m.room.message","content":{"body":"after the gap 2","msgtype":"m.text"}}`),
+	}
+	if _, _, err = accumulator.Accumulate(roomID, "prev_batch_token", timeline); err != nil {
+		t.Fatalf("failed to Accumulate: %s", err)
+	}
+	// overlapping a limited timeline with what we know already is not a gap
+	if _, _, err = accumulator.Accumulate(roomID, "another_token", []json.RawMessage{
+		timeline[1],
+		[]byte(`{"event_id":"gI", "type":"m.room.message","content":{"body":"no gap","msgtype":"m.text"}}`),
+	}); err != nil {
+		t.Fatalf("failed to Accumulate: %s", err)
+	}
+
+	txn, err := accumulator.db.Beginx()
+	if err != nil {
+		t.Fatalf("failed to start assert txn: %s", err)
+	}
+	defer txn.Rollback()
+
+	snapID, err := accumulator.roomsTable.CurrentAfterSnapshotID(txn, roomID)
+	if err != nil {
+		t.Fatalf("failed to select current snapshot: %s", err)
+	}
+	row, err := accumulator.snapshotTable.Select(txn, snapID)
+	if err != nil {
+		t.Fatalf("failed to select snapshot %d: %s", snapID, err)
+	}
+	events, err := accumulator.eventsTable.SelectByNIDs(txn, true, row.Events)
+	if err != nil {
+		t.Fatalf("failed to extract events in snapshot: %s", err)
+	}
+	var gotIDs []string
+	for _, ev := range events {
+		gotIDs = append(gotIDs, ev.ID)
+	}
+	wantIDs := []string{"gA", "gB", "gE", "gF"}
+	if !reflect.DeepEqual(gotIDs, wantIDs) {
+		t.Errorf("current state after gap: got %v want %v", gotIDs, wantIDs)
+	}
+
+	wantPrevBatches := map[string]string{
+		"gD": "",
+		"gG": "prev_batch_token",
+		"gH": "",
+		"gI": "",
+	}
+	for eventID, want := range wantPrevBatches {
+		nids, err := accumulator.eventsTable.SelectNIDsByIDs(txn, []string{eventID})
+		if err != nil || len(nids) != 1 {
+			t.Fatalf("failed to select NID for %s: %v", eventID, err)
+		}
+		got, err := accumulator.eventsTable.SelectPrevBatch(txn, nids[0])
+		if err != nil {
+			t.Fatalf("failed to select prev_batch for %s: %s", eventID, err)
+		}
+		if got != want {
+			t.Errorf("event %s: got prev_batch '%s' want '%s'", eventID, got, want)
+		}
+		got, err = accumulator.eventsTable.SelectPrevBatchByID(txn, eventID)
+		if err != nil {
+			t.Fatalf("failed to select prev_batch by ID for %s: %s", eventID, err)
+		}
+		if got != want {
+			t.Errorf("event %s: got prev_batch by ID '%s' want '%s'", eventID, got, want)
+		}
+	}
+}
+
+func TestAccumulatorStateReset(t *testing.T) {
+	roomID := "!TestAccumulatorStateReset:localhost"
+	roomEvents := []json.RawMessage{
+		[]byte(`{"event_id":"rA", "type":"m.room.create", "state_key":"", "content":{"creator":"@me:localhost"}}`),
+		[]byte(`{"event_id":"rB", "type":"m.room.member", "state_key":"@me:localhost", "content":{"membership":"join"}}`),
+		[]byte(`{"event_id":"rC", "type":"m.room.join_rules", "state_key":"", "content":{"join_rule":"public"}}`),
+	}
+	db, err := sqlx.Open("postgres", postgresConnectionString)
+	if err != nil {
+		t.Fatalf("failed to open SQL db: %s", err)
+	}
+	accumulator := NewAccumulator(db)
+	if _, err = accumulator.Initialise(roomID, roomEvents); err != nil {
+		t.Fatalf("failed to Initialise accumulator: %s", err)
+	}
+	timeline := []json.RawMessage{
+		[]byte(`{"event_id":"rD", "type":"m.room.join_rules", "state_key":"", "content":{"join_rule":"invite"}}`),
+	}
+	if _, _, err = accumulator.Accumulate(roomID, "", timeline); err != nil {
+		t.Fatalf("failed to Accumulate: %s", err)
+	}
+
+	// a stale state block which accompanies a timeline we've seen before doesn't roll back the state
+	err = sqlutil.WithTransaction(accumulator.db, func(txn *sqlx.Tx) error {
+		res, err := accumulator.initialise(txn, roomID, roomEvents, timeline)
+		if res.Changed() {
+			t.Errorf("initialise with stale state changed the current state, replaced %d events", len(res.ReplacedState))
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to initialise with stale state: %s", err)
+	}
+	assertCurrentState(t, accumulator, roomID, []string{"rA", "rB", "rD"})
+
+	// the same goes for a timeline which starts with a new event but overlaps what we've seen, e.g because
+	// another user's poller saw the end of the timeline after a gap
+	overlappingTimeline := []json.RawMessage{
+		[]byte(`{"event_id":"rE", "type":"m.room.message", "content":{"body":"hello"}}`),
+		timeline[0],
+	}
+	err = sqlutil.WithTransaction(accumulator.db, func(txn *sqlx.Tx) error {
+		res, err := accumulator.initialise(txn, roomID, roomEvents, overlappingTimeline)
+		if res.Changed() {
+			t.Errorf("initialise with stale state and an overlapping timeline changed the current state, replaced %d events", len(res.ReplacedState))
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to initialise with stale state and an overlapping timeline: %s", err)
+	}
+	assertCurrentState(t, accumulator, roomID, []string{"rA", "rB", "rD"})
+
+	// state resolution on the server resets the join rules to an event we've seen before
+	changed, err := accumulator.Initialise(roomID, roomEvents)
+	if err != nil {
+		t.Fatalf("failed to Initialise accumulator with reset state: %s", err)
+	}
+	if !changed {
+		t.Fatalf("Initialise with reset state didn't change the current state, wanted it to")
+	}
+	assertCurrentState(t, accumulator, roomID, []string{"rA", "rB", "rC"})
+
+	// the same state again is a no-op
+	changed, err = accumulator.Initialise(roomID, roomEvents)
+	if err != nil {
+		t.Fatalf("failed to Initialise accumulator with the same state: %s", err)
+	}
+	if changed {
+		t.Fatalf("Initialise with the same state changed the current state")
+	}
+}
+
+func assertCurrentState(t *testing.T, accumulator *Accumulator, roomID string, wantIDs []string) {
+	t.Helper()
+	txn, err := accumulator.db.Beginx()
+	if err != nil {
+		t.Fatalf("failed to start assert txn: %s", err)
+	}
+	defer txn.Rollback()
+	snapID, err := accumulator.roomsTable.CurrentAfterSnapshotID(txn, roomID)
+	if err != nil {
+		t.Fatalf("failed to select current snapshot: %s", err)
+	}
+	row, err := accumulator.snapshotTable.Select(txn, snapID)
+	if err != nil {
+		t.Fatalf("failed to select snapshot %d: %s", snapID, err)
+	}
+	events, err := accumulator.eventsTable.SelectByNIDs(txn, true, row.Events)
+	if err != nil {
+		t.Fatalf("failed to extract events in snapshot: %s", err)
+	}
+	var gotIDs []string
+	for _, ev := range events {
+		gotIDs = append(gotIDs, ev.ID)
+	}
+	if !reflect.DeepEqual(gotIDs, wantIDs) {
+		t.Errorf("current state: got %v want %v", gotIDs, wantIDs)
+	}
+}
+
 func TestAccumulatorDelta(t *testing.T) {
 	roomID := "!TestAccumulatorDelta:localhost"
 	db, err := sqlx.Open("postgres", postgresConnectionString)
@@ -192,7 +403,7 @@ func TestAccumulatorDelta(t *testing.T) {
 		[]byte(`{"event_id":"aH", "type":"m.room.join_rules", "state_key":"", "content":{"join_rule":"public"}}`),
 		[]byte(`{"event_id":"aI", "type":"m.room.history_visibility", "state_key":"", "content":{"visibility":"public"}}`),
 	}
-	if _, _, err = accumulator.Accumulate(roomID, roomEvents); err != nil {
+	if _, _, err = accumulator.Accumulate(roomID, "", roomEvents); err != nil {
 		t.Fatalf("failed to Accumulate: %s", err)
 	}
 
@@ -253,7 +464,7 @@ func TestAccumulatorMembershipLogs(t *testing.T) {
 		// @me leaves the room
 		[]byte(`{"event_id":"` + roomEventIDs[7] + `", "type":"m.room.member", "state_key":"@me:localhost","unsigned":{"prev_content":{"membership":"join", "displayname":"Me"}}, "content":{"membership":"leave"}}`),
 	}
-	if _, _, err = accumulator.Accumulate(roomID, roomEvents); err != nil {
+	if _, _, err = accumulator.Accumulate(roomID, "", roomEvents); err != nil {
 		t.Fatalf("failed to Accumulate: %s", err)
 	}
 	txn, err := accumulator.db.Beginx()
@@ -378,8 +589,145 @@ func TestAccumulatorDupeEvents(t *testing.T) {
 		t.Fatalf("failed to Initialise accumulator: %s", err)
 	}
 
-	_, _, err = accumulator.Accumulate(roomID, joinRoom.Timeline.Events)
+	_, _, err = accumulator.Accumulate(roomID, "", joinRoom.Timeline.Events)
 	if err != nil {
 		t.Fatalf("failed to Accumulate: %s", err)
 	}
 }
+
+func TestAccumulatorRedaction(t *testing.T) {
+	// v10 isn't known to gomatrixserverlib, so uses the fallback redaction rules
+	for _, roomVersion := range []string{"6", "10"} {
+		testAccumulatorRedaction(t, roomVersion)
+	}
+}
+
+func testAccumulatorRedaction(t *testing.T, roomVersion string) {
+	roomID := "!TestAccumulatorRedaction_v" + roomVersion + ":localhost"
+	// event IDs are unique across rooms
+	id := func(eventID string) string {
+		return eventID + "_v" + roomVersion
+	}
+	event := func(eventID, fields string) json.RawMessage {
+		return json.RawMessage(fmt.Sprintf(
+			`{"event_id":"%s","room_id":"%s","sender":"@me:localhost","origin_server_ts":1632131678061,%s}`,
+			id(eventID), roomID, fields,
+		))
+	}
+	redaction := func(eventID, redacts string) json.RawMessage {
+		return event(eventID, fmt.Sprintf(`"type":"m.room.redaction","redacts":"%s","content":{}`, id(redacts)))
+	}
+	roomEvents := []json.RawMessage{
+		event("xA", `"type":"m.room.create","state_key":"","content":{"creator":"@me:localhost","room_version":"`+roomVersion+`"}`),
+		event("xB", `"type":"m.room.member","state_key":"@me:localhost","content":{"membership":"join","displayname":"me"}`),
+		event("xC", `"type":"m.room.name","state_key":"","content":{"name":"secret name"}`),
+	}
+	db, err := sqlx.Open("postgres", postgresConnectionString)
+	if err != nil {
+		t.Fatalf("failed to open SQL db: %s", err)
+	}
+	accumulator := NewAccumulator(db)
+	if _, err = accumulator.Initialise(roomID, roomEvents); err != nil {
+		t.Fatalf("v%s: failed to Initialise accumulator: %s", roomVersion, err)
+	}
+	if _, _, err = accumulator.Accumulate(roomID, "", []json.RawMessage{
+		event("xD", `"type":"m.room.message","content":{"body":"secret message","msgtype":"m.text"}`),
+		redaction("xE", "xD"),
+		redaction("xF", "xC"),
+		redaction("xG", "xB"),
+		redaction("xH", "unknown"),
+	}); err != nil {
+		t.Fatalf("v%s: failed to Accumulate: %s", roomVersion, err)
+	}
+
+	txn, err := accumulator.db.Beginx()
+	if err != nil {
+		t.Fatalf("failed to start assert txn: %s", err)
+	}
+	defer txn.Rollback()
+	events, err := accumulator.eventsTable.SelectByIDs(txn, true, []string{id("xB"), id("xC"), id("xD")})
+	if err != nil {
+		t.Fatalf("failed to select redacted events: %s", err)
+	}
+	wantRedactedBy := []string{id("xG"), id("xF"), id("xE")}
+	for i, ev := range events {
+		evJSON := gjson.ParseBytes(ev.JSON)
+		if got := evJSON.Get("unsigned.redacted_because.event_id").Str; got != wantRedactedBy[i] {
+			t.Errorf("v%s: event %s: got redacted_because %s want %s", roomVersion, ev.ID, got, wantRedactedBy[i])
+		}
+		if got := evJSON.Get("event_id").Str; got != ev.ID {
+			t.Errorf("v%s: event %s: redaction changed the event_id to %s", roomVersion, ev.ID, got)
+		}
+	}
+	for _, key := range []string{"content.displayname", "content.name", "content.body"} {
+		for _, ev := range events {
+			if gjson.GetBytes(ev.JSON, key).Exists() {
+				t.Errorf("v%s: event %s: %s wasn't redacted", roomVersion, ev.ID, key)
+			}
+		}
+	}
+	if gjson.GetBytes(events[0].JSON, "content.membership").Str != "join" {
+		t.Errorf("v%s: redacting a member event removed the membership: %s", roomVersion, string(events[0].JSON))
+	}
+}
+
+// Tests that room versions unknown to gomatrixserverlib are redacted with the closest known algorithm,
+// preserving the content keys added in later room versions.
+func TestRedactEventJSON(t *testing.T) {
+	redactionJSON := []byte(`{"event_id":"$redaction","type":"m.room.redaction","redacts":"$event","content":{}}`)
+	testCases := []struct {
+		roomVersion string
+		eventJSON   string
+		wantContent string
+	}{
+		{
+			roomVersion: "6",
+			eventJSON:   `{"type":"m.room.message","content":{"body":"secret","msgtype":"m.text"}}`,
+			wantContent: `{}`,
+		},
+		{
+			roomVersion: "10",
+			eventJSON:   `{"type":"m.room.message","content":{"body":"secret","msgtype":"m.text"}}`,
+			wantContent: `{}`,
+		},
+		{
+			roomVersion: "7",
+			eventJSON:   `{"type":"m.room.join_rules","state_key":"","content":{"join_rule":"knock","allow":[],"foo":"bar"}}`,
+			wantContent: `{"join_rule":"knock"}`,
+		},
+		{
+			roomVersion: "10",
+			eventJSON:   `{"type":"m.room.join_rules","state_key":"","content":{"join_rule":"restricted","allow":[{"type":"m.room_membership","room_id":"!space:localhost"}],"foo":"bar"}}`,
+			wantContent: `{"allow":[{"type":"m.room_membership","room_id":"!space:localhost"}],"join_rule":"restricted"}`,
+		},
+		{
+			roomVersion: "8",
+			eventJSON:   `{"type":"m.room.member","state_key":"@me:localhost","content":{"membership":"join","displayname":"me","join_authorised_via_users_server":"@admin:localhost"}}`,
+			wantContent: `{"membership":"join"}`,
+		},
+		{
+			roomVersion: "10",
+			eventJSON:   `{"type":"m.room.member","state_key":"@me:localhost","content":{"membership":"join","displayname":"me","join_authorised_via_users_server":"@admin:localhost"}}`,
+			wantContent: `{"join_authorised_via_users_server":"@admin:localhost","membership":"join"}`,
+		},
+	}
+	for _, tc := range testCases {
+		eventJSON := strings.Replace(
+			tc.eventJSON, "{", `{"event_id":"$event","room_id":"!foo:localhost","sender":"@me:localhost","origin_server_ts":1632131678061,`, 1,
+		)
+		redacted, err := redactEventJSON("$event", []byte(eventJSON), redactionJSON, gomatrixserverlib.RoomVersion(tc.roomVersion))
+		if err != nil {
+			t.Errorf("v%s: redactEventJSON(%s) returned error: %s", tc.roomVersion, tc.eventJSON, err)
+			continue
+		}
+		if got := gjson.GetBytes(redacted, "content").Raw; got != tc.wantContent {
+			t.Errorf("v%s: redactEventJSON(%s): got content %s want %s", tc.roomVersion, tc.eventJSON, got, tc.wantContent)
+		}
+		if got := gjson.GetBytes(redacted, "event_id").Str; got != "$event" {
+			t.Errorf("v%s: redactEventJSON(%s): got event_id %s", tc.roomVersion, tc.eventJSON, got)
+		}
+		if got := gjson.GetBytes(redacted, "unsigned.redacted_because.event_id").Str; got != "$redaction" {
+			t.Errorf("v%s: redactEventJSON(%s): got redacted_because %s", tc.roomVersion, tc.eventJSON, got)
+		}
+	}
+}
@@ -23,6 +23,11 @@ type Event struct {
 	BeforeStateSnapshotID int    `db:"before_state_snapshot_id"`
 	ID                    string `db:"event_id"`
 	RoomID                string `db:"room_id"`
+	// the event this event relates to via content.m.relates_to, along with the rel_type and key (for
+	// annotations). Empty if this event isn't a relation.
+	RelatesTo string `db:"relates_to"`
+	RelType   string `db:"rel_type"`
+	RelKey    string `db:"rel_key"`
 	// stripped events will be missing this field
 	JSON []byte `db:"event"`
 }
@@ -61,8 +66,16 @@ func NewEventTable(db *sqlx.DB) *EventTable {
 		room_id TEXT NOT NULL,
 		event_type TEXT NOT NULL,
 		state_key TEXT NOT NULL,
-		event BYTEA NOT NULL
+		event BYTEA NOT NULL,
+		-- set on the first event after a timeline gap: the v2 prev_batch token to paginate into the gap
+		prev_batch TEXT
 	);
+	ALTER TABLE syncv3_events ADD COLUMN IF NOT EXISTS prev_batch TEXT;
+	-- the event this event relates to via m.relates_to, used to bundle aggregations
+	ALTER TABLE syncv3_events ADD COLUMN IF NOT EXISTS relates_to TEXT NOT NULL DEFAULT '';
+	ALTER TABLE syncv3_events ADD COLUMN IF NOT EXISTS rel_type TEXT NOT NULL DEFAULT '';
+	ALTER TABLE syncv3_events ADD COLUMN IF NOT EXISTS rel_key TEXT NOT NULL DEFAULT '';
+	CREATE INDEX IF NOT EXISTS syncv3_events_relates_to_idx ON syncv3_events(relates_to, rel_type) WHERE relates_to != '';
 	-- index for querying all joined rooms for a given user
 	CREATE INDEX IF NOT EXISTS syncv3_events_type_sk_idx ON syncv3_events(event_type, state_key);
 	-- index for querying membership deltas in particular rooms
@@ -114,15 +127,16 @@ func (t *EventTable) Insert(txn *sqlx.Tx, events []Event) (int, error) {
 			// valid for this to be "" on message events
 			ev.StateKey = evJSON.Get("state_key").Str
 		}
+		ev.RelatesTo, ev.RelType, ev.RelKey = relationFromJSON(evJSON)
 
 		events[i] = ev
 	}
-	chunks := sqlutil.Chunkify(6, 65535, EventChunker(events))
+	chunks := sqlutil.Chunkify(8, 65535, EventChunker(events))
 	var rowsAffected int64
 	for _, chunk := range chunks {
 		result, err := txn.NamedExec(`
-		INSERT INTO syncv3_events (event_id, event, event_type, state_key, room_id)
-        VALUES (:event_id, :event, :event_type, :state_key, :room_id) ON CONFLICT (event_id) DO NOTHING`, chunk)
+		INSERT INTO syncv3_events (event_id, event, event_type, state_key, room_id, relates_to, rel_type, rel_key)
+        VALUES (:event_id, :event, :event_type, :state_key, :room_id, :relates_to, :rel_type, :rel_key) ON CONFLICT (event_id) DO NOTHING`, chunk)
 		if err != nil {
 			return 0, err
 		}
@@ -223,6 +237,130 @@ func (t *EventTable) UpdateBeforeSnapshotID(txn *sqlx.Tx, eventNID, snapID, repl
 	return err
 }
 
+// UpdatePrevBatch marks the event as the first event after a gap in the timeline, which can be filled
+// by paginating from `prevBatch`.
+func (t *EventTable) UpdatePrevBatch(txn *sqlx.Tx, eventNID int64, prevBatch string) error {
+	_, err := txn.Exec(`UPDATE syncv3_events SET prev_batch=$1 WHERE event_nid = $2`, prevBatch, eventNID)
+	return err
+}
+
+// SelectPrevBatch returns the prev_batch token for this event, or "" if the event does not follow a gap.
+func (t *EventTable) SelectPrevBatch(txn *sqlx.Tx, eventNID int64) (prevBatch string, err error) {
+	var result sql.NullString
+	err = txn.QueryRow(`SELECT prev_batch FROM syncv3_events WHERE event_nid = $1`, eventNID).Scan(&result)
+	return result.String, err
+}
+
+// SelectPrevBatchByID returns the prev_batch token for the event with this ID, or "" if the event does not
+// follow a gap or is unknown. If txn is nil, the query is not made in a transaction.
+func (t *EventTable) SelectPrevBatchByID(txn *sqlx.Tx, eventID string) (prevBatch string, err error) {
+	var db sqlx.Queryer = t.db
+	if txn != nil {
+		db = txn
+	}
+	var result sql.NullString
+	err = db.QueryRowx(`SELECT prev_batch FROM syncv3_events WHERE event_id = $1`, eventID).Scan(&result)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return result.String, err
+}
+
+// SelectCreateEvent returns the m.room.create event for this room, or nil if it isn't known.
+func (t *EventTable) SelectCreateEvent(txn *sqlx.Tx, roomID string) (*Event, error) {
+	var event Event
+	err := txn.Get(&event, `SELECT event_nid, event, event_type, state_key, event_id, room_id FROM syncv3_events
+	WHERE event_type = 'm.room.create' AND room_id = $1 AND state_key = '' ORDER BY event_nid ASC LIMIT 1`, roomID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return &event, err
+}
+
+// UpdateEventJSON replaces the stored JSON for this event, e.g after it has been redacted.
+func (t *EventTable) UpdateEventJSON(txn *sqlx.Tx, eventNID int64, eventJSON []byte) error {
+	// the relation may have been redacted
+	relatesTo, relType, relKey := relationFromJSON(gjson.ParseBytes(eventJSON))
+	_, err := txn.Exec(
+		`UPDATE syncv3_events SET event=$1, relates_to=$2, rel_type=$3, rel_key=$4 WHERE event_nid = $5`,
+		eventJSON, relatesTo, relType, relKey, eventNID,
+	)
+	return err
+}
+
+// SelectAnnotations returns the number of annotations with each key and event type for these events.
+func (t *EventTable) SelectAnnotations(txn *sqlx.Tx, eventIDs []string) (map[string][]Annotation, error) {
+	query, args, err := sqlx.In(`SELECT relates_to, event_type, rel_key, COUNT(*) FROM syncv3_events
+	WHERE relates_to IN (?) AND rel_type = 'm.annotation'
+	GROUP BY relates_to, event_type, rel_key ORDER BY relates_to, COUNT(*) DESC, rel_key`, eventIDs)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := txn.Query(txn.Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[string][]Annotation)
+	for rows.Next() {
+		var relatesTo string
+		var a Annotation
+		if err := rows.Scan(&relatesTo, &a.Type, &a.Key, &a.Count); err != nil {
+			return nil, err
+		}
+		result[relatesTo] = append(result[relatesTo], a)
+	}
+	return result, rows.Err()
+}
+
+// SelectThreadSummaries returns the number of replies and the latest reply for the threads with these roots.
+func (t *EventTable) SelectThreadSummaries(txn *sqlx.Tx, rootIDs []string) (map[string]*ThreadSummary, error) {
+	query, args, err := sqlx.In(`SELECT latest.relates_to, latest.event, counts.count FROM (
+		SELECT DISTINCT ON (relates_to) relates_to, event FROM syncv3_events
+		WHERE relates_to IN (?) AND rel_type = ? ORDER BY relates_to, event_nid DESC
+	) AS latest JOIN (
+		SELECT relates_to, COUNT(*) AS count FROM syncv3_events
+		WHERE relates_to IN (?) AND rel_type = ? GROUP BY relates_to
+	) AS counts ON latest.relates_to = counts.relates_to`, rootIDs, RelThread, rootIDs, RelThread)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := txn.Query(txn.Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[string]*ThreadSummary)
+	for rows.Next() {
+		var rootID string
+		var summary ThreadSummary
+		if err := rows.Scan(&rootID, &summary.LatestEvent, &summary.Count); err != nil {
+			return nil, err
+		}
+		result[rootID] = &summary
+	}
+	return result, rows.Err()
+}
+
+// SelectThreadEvents returns the thread root and the latest replies in the thread, up to `limit` events
+// in total, in the order they were received.
+func (t *EventTable) SelectThreadEvents(txn *sqlx.Tx, roomID, rootID string, limit int) ([]Event, error) {
+	var events []Event
+	err := txn.Select(&events, `SELECT * FROM (
+		SELECT event_nid, event_id, event FROM syncv3_events
+		WHERE room_id = $1 AND (event_id = $2 OR (relates_to = $2 AND rel_type = $3))
+		ORDER BY event_nid DESC LIMIT $4
+	) AS thread ORDER BY event_nid ASC`, roomID, rootID, RelThread, limit)
+	return events, err
+}
+
+// SelectReplacements returns the edits of these events, in the order they were received.
+func (t *EventTable) SelectReplacements(txn *sqlx.Tx, eventIDs []string) ([]Event, error) {
+	return t.selectIn(txn, 0, `
+	SELECT event_nid, event_id, event, event_type, state_key, room_id, relates_to FROM syncv3_events
+	WHERE relates_to IN (?) AND rel_type = 'm.replace' ORDER BY event_nid ASC;`, eventIDs)
+}
+
 func (t *EventTable) BeforeStateSnapshotIDForEventNID(txn *sqlx.Tx, roomID string, eventNID int64) (lastEventNID, replacesNID, snapID int64, err error) {
 	// the position (event nid) may be for a random different room, so we need to find the highest nid <= this position for this room
 	err = txn.QueryRow(
@@ -249,10 +387,14 @@ func (t *EventTable) SelectLatestEventInRoom(txn *sqlx.Tx, roomID string, upperI
 	return &event, err
 }
 
+// SelectLatestEventInAllRooms returns the latest event in each room. Edits and reactions are aggregated
+// onto the events they relate to, so they are never the latest event.
 func (t *EventTable) SelectLatestEventInAllRooms() ([]Event, error) {
 	result := []Event{}
 	rows, err := t.db.Query(
-		`SELECT room_id, event FROM syncv3_events WHERE event_nid in (SELECT MAX(event_nid) FROM syncv3_events GROUP BY room_id)`,
+		`SELECT event_nid, room_id, event FROM syncv3_events WHERE event_nid in (
+			SELECT MAX(event_nid) FROM syncv3_events WHERE rel_type NOT IN ('m.annotation', 'm.replace') GROUP BY room_id
+		)`,
 	)
 	if err != nil {
 		return nil, err
@@ -260,7 +402,7 @@ func (t *EventTable) SelectLatestEventInAllRooms() ([]Event, error) {
 	defer rows.Close()
 	for rows.Next() {
 		var ev Event
-		if err := rows.Scan(&ev.RoomID, &ev.JSON); err != nil {
+		if err := rows.Scan(&ev.NID, &ev.RoomID, &ev.JSON); err != nil {
 			return nil, err
 		}
 		result = append(result, ev)
@@ -268,6 +410,18 @@ func (t *EventTable) SelectLatestEventInAllRooms() ([]Event, error) {
 	return result, nil
 }
 
+// SelectLatestMainTimelineEventInRoom returns the latest event in the room at this position which isn't a
+// thread reply, edit or reaction.
+func (t *EventTable) SelectLatestMainTimelineEventInRoom(txn *sqlx.Tx, roomID string, upperInclusive int64) (*Event, error) {
+	var event Event
+	err := txn.Get(&event, `SELECT event_nid, event, event_type, state_key, event_id, room_id FROM syncv3_events
+	WHERE event_nid <= $1 AND room_id = $2 AND rel_type NOT IN ('m.annotation', 'm.replace', $3)
+	ORDER BY event_nid DESC LIMIT 1`,
+		upperInclusive, roomID, RelThread,
+	)
+	return &event, err
+}
+
 // Select all events between the bounds matching the type, state_key given.
 // Used to work out which rooms the user was joined to at a given point in time.
 func (t *EventTable) SelectEventsWithTypeStateKey(eventType, stateKey string, lowerExclusive, upperInclusive int64) ([]Event, error) {
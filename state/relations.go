@@ -0,0 +1,108 @@
+package state
+
+import (
+	"encoding/json"
+
+	"github.com/tidwall/gjson"
+)
+
+// Annotation is the number of annotations (e.g reactions) with the same event type and key on an event.
+type Annotation struct {
+	Type  string `json:"type"`
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+// RelThread is the rel_type of thread replies. Replies using the unstable rel_type are stored with this one.
+const RelThread = "m.thread"
+
+// relThreadUnstable is the rel_type of thread replies from clients implementing the unstable MSC.
+const relThreadUnstable = "io.element.thread"
+
+// ThreadSummary is the number of replies in a thread along with the latest reply.
+type ThreadSummary struct {
+	LatestEvent json.RawMessage `json:"latest_event"`
+	Count       int             `json:"count"`
+}
+
+// ThreadRootID returns the event ID of the thread root if this event is a thread reply, else "".
+func ThreadRootID(ev gjson.Result) string {
+	relatesTo, relType, _ := relationFromJSON(ev)
+	if relType != RelThread {
+		return ""
+	}
+	return relatesTo
+}
+
+// relationFromJSON returns the event ID this event relates to, along with the rel_type and key, from
+// content.m.relates_to. Returns empty strings if this event isn't a relation.
+func relationFromJSON(ev gjson.Result) (relatesTo, relType, key string) {
+	relation := ev.Get(`content.m\.relates_to`)
+	relatesTo = relation.Get("event_id").Str
+	if relatesTo == "" {
+		return "", "", ""
+	}
+	relType = relation.Get("rel_type").Str
+	if relType == relThreadUnstable {
+		relType = RelThread
+	}
+	return relatesTo, relType, relation.Get("key").Str
+}
+
+// bundleRelations returns the event with the aggregations of its relations in unsigned.m.relations.
+// If the event has been edited, the content is replaced with the content of the edit. If the event is a
+// thread root, the thread summary is included.
+func bundleRelations(eventJSON json.RawMessage, annotations []Annotation, edit *Event, thread *ThreadSummary) (json.RawMessage, error) {
+	var event map[string]json.RawMessage
+	if err := json.Unmarshal(eventJSON, &event); err != nil {
+		return nil, err
+	}
+	unsigned := make(map[string]json.RawMessage)
+	if event["unsigned"] != nil {
+		if err := json.Unmarshal(event["unsigned"], &unsigned); err != nil {
+			return nil, err
+		}
+	}
+	// replace any aggregations from the server as they were calculated when the event was sent
+	relations := make(map[string]interface{})
+	if len(annotations) > 0 {
+		relations["m.annotation"] = map[string]interface{}{
+			"chunk": annotations,
+		}
+	}
+	if thread != nil {
+		relations[RelThread] = thread
+	}
+	if edit != nil {
+		editJSON := gjson.ParseBytes(edit.JSON)
+		relations["m.replace"] = map[string]interface{}{
+			"event_id":         edit.ID,
+			"origin_server_ts": editJSON.Get("origin_server_ts").Int(),
+			"sender":           editJSON.Get("sender").Str,
+		}
+		if newContent := editJSON.Get(`content.m\.new_content`); newContent.IsObject() {
+			var content map[string]json.RawMessage
+			if err := json.Unmarshal([]byte(newContent.Raw), &content); err != nil {
+				return nil, err
+			}
+			// the original relation is kept, edits can't change it
+			if relatesTo := gjson.GetBytes(eventJSON, `content.m\.relates_to`); relatesTo.Exists() {
+				content["m.relates_to"] = json.RawMessage(relatesTo.Raw)
+			} else {
+				delete(content, "m.relates_to")
+			}
+			var err error
+			if event["content"], err = json.Marshal(content); err != nil {
+				return nil, err
+			}
+		}
+	}
+	var err error
+	if unsigned["m.relations"], err = json.Marshal(relations); err != nil {
+		return nil, err
+	}
+	if event["unsigned"], err = json.Marshal(unsigned); err != nil {
+		return nil, err
+	}
+	return json.Marshal(event)
+}
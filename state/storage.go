@@ -79,14 +79,129 @@ func (s *Storage) CurrentStateEventsInAllRooms(eventTypes []string) (map[string]
 	return result, nil
 }
 
-func (s *Storage) Accumulate(roomID string, timeline []json.RawMessage) (numNew int, latestNID int64, err error) {
-	return s.accumulator.Accumulate(roomID, timeline)
+func (s *Storage) Accumulate(roomID, prevBatch string, timeline []json.RawMessage) (numNew int, latestNID int64, err error) {
+	return s.accumulator.Accumulate(roomID, prevBatch, timeline)
 }
 
 func (s *Storage) Initialise(roomID string, state []json.RawMessage) (bool, error) {
 	return s.accumulator.Initialise(roomID, state)
 }
 
+// Begin starts a transaction which can be passed to the *Txn functions and table functions which accept
+// a transaction, so multiple updates can be applied atomically.
+func (s *Storage) Begin() (*sqlx.Tx, error) {
+	return s.accumulator.db.Beginx()
+}
+
+// AccumulateTxn is Accumulate in the caller's transaction.
+func (s *Storage) AccumulateTxn(txn *sqlx.Tx, roomID, prevBatch string, timeline []json.RawMessage) (numNew int, latestNID int64, err error) {
+	return s.accumulator.accumulate(txn, roomID, prevBatch, timeline)
+}
+
+// InitialiseTxn is Initialise in the caller's transaction. `timeline` is the timeline which follows the
+// state, used to work out if the state is older than the current state.
+func (s *Storage) InitialiseTxn(txn *sqlx.Tx, roomID string, state, timeline []json.RawMessage) (InitialiseResult, error) {
+	return s.accumulator.initialise(txn, roomID, state, timeline)
+}
+
+// EventsByIDs returns the events with these event IDs, ordered by position. Unknown events are ignored.
+func (s *Storage) EventsByIDs(eventIDs []string) ([]Event, error) {
+	return s.accumulator.eventsTable.SelectByIDs(nil, false, eventIDs)
+}
+
+// PrevBatch returns the prev_batch token to paginate into the timeline gap before this event, or "" if there
+// is no gap before it.
+func (s *Storage) PrevBatch(eventID string) (string, error) {
+	return s.accumulator.eventsTable.SelectPrevBatchByID(nil, eventID)
+}
+
+// BundleRelations returns these events with the aggregations of their edits, annotations and threads in
+// unsigned.m.relations. Edited events have the content of the latest edit. Events without any
+// relations are returned as they are.
+func (s *Storage) BundleRelations(events []json.RawMessage) ([]json.RawMessage, error) {
+	eventIDs := make([]string, len(events))
+	for i := range events {
+		eventIDs[i] = gjson.GetBytes(events[i], "event_id").Str
+	}
+	var annotations map[string][]Annotation
+	var edits []Event
+	var threads map[string]*ThreadSummary
+	err := sqlutil.WithTransaction(s.accumulator.db, func(txn *sqlx.Tx) (err error) {
+		annotations, err = s.accumulator.eventsTable.SelectAnnotations(txn, eventIDs)
+		if err != nil {
+			return fmt.Errorf("failed to select annotations: %w", err)
+		}
+		edits, err = s.accumulator.eventsTable.SelectReplacements(txn, eventIDs)
+		if err != nil {
+			return fmt.Errorf("failed to select edits: %w", err)
+		}
+		threads, err = s.accumulator.eventsTable.SelectThreadSummaries(txn, eventIDs)
+		if err != nil {
+			return fmt.Errorf("failed to select thread summaries: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := make([]json.RawMessage, len(events))
+	for i := range events {
+		result[i] = events[i]
+		// edits are only valid if they are from the sender of the original event
+		sender := gjson.GetBytes(events[i], "sender").Str
+		var latestEdit *Event
+		for j := range edits {
+			if edits[j].RelatesTo == eventIDs[i] && gjson.GetBytes(edits[j].JSON, "sender").Str == sender {
+				latestEdit = &edits[j]
+			}
+		}
+		if latestEdit == nil && len(annotations[eventIDs[i]]) == 0 && threads[eventIDs[i]] == nil {
+			continue
+		}
+		result[i], err = bundleRelations(events[i], annotations[eventIDs[i]], latestEdit, threads[eventIDs[i]])
+		if err != nil {
+			return nil, fmt.Errorf("failed to bundle relations for event %s: %w", eventIDs[i], err)
+		}
+	}
+	return result, nil
+}
+
+// LatestMainTimelineEventInRoom returns the latest event in the room at this position which isn't a thread
+// reply, edit or reaction, with its relations bundled.
+func (s *Storage) LatestMainTimelineEventInRoom(roomID string, pos int64) (json.RawMessage, error) {
+	var ev *Event
+	err := sqlutil.WithTransaction(s.accumulator.db, func(txn *sqlx.Tx) (err error) {
+		ev, err = s.accumulator.eventsTable.SelectLatestMainTimelineEventInRoom(txn, roomID, pos)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	bundled, err := s.BundleRelations([]json.RawMessage{ev.JSON})
+	if err != nil {
+		return nil, err
+	}
+	return bundled[0], nil
+}
+
+// ThreadTimeline returns the thread root and the latest replies in the thread, up to `limit` events in
+// total, with their relations bundled.
+func (s *Storage) ThreadTimeline(roomID, rootID string, limit int) ([]json.RawMessage, error) {
+	var events []Event
+	err := sqlutil.WithTransaction(s.accumulator.db, func(txn *sqlx.Tx) (err error) {
+		events, err = s.accumulator.eventsTable.SelectThreadEvents(txn, roomID, rootID, limit)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	timeline := make([]json.RawMessage, len(events))
+	for i := range events {
+		timeline[i] = events[i].JSON
+	}
+	return s.BundleRelations(timeline)
+}
+
 func (s *Storage) LatestEventInRoom(roomID string, pos int64) (*Event, error) {
 	var err error
 	var ev *Event
@@ -7,6 +7,7 @@ import (
 	"testing"
 
 	"github.com/matrix-org/sync-v3/testutils"
+	"github.com/tidwall/gjson"
 )
 
 func TestStorageRoomStateBeforeAndAfterEventPosition(t *testing.T) {
@@ -20,7 +21,7 @@ func TestStorageRoomStateBeforeAndAfterEventPosition(t *testing.T) {
 		testutils.NewStateEvent(t, "m.room.join_rules", "", alice, map[string]interface{}{"join_rule": "invite"}),
 		testutils.NewStateEvent(t, "m.room.member", bob, alice, map[string]interface{}{"membership": "invite"}),
 	}
-	_, latest, err := store.Accumulate(roomID, events)
+	_, latest, err := store.Accumulate(roomID, "", events)
 	if err != nil {
 		t.Fatalf("Accumulate returned error: %s", err)
 	}
@@ -132,7 +133,7 @@ func TestStorageJoinedRoomsAfterPosition(t *testing.T) {
 	var latestPos int64
 	var err error
 	for roomID, eventMap := range roomIDToEventMap {
-		_, latestPos, err = store.Accumulate(roomID, eventMap)
+		_, latestPos, err = store.Accumulate(roomID, "", eventMap)
 		if err != nil {
 			t.Fatalf("Accumulate on %s failed: %s", roomID, err)
 		}
@@ -264,7 +265,7 @@ func TestVisibleEventNIDsBetween(t *testing.T) {
 		},
 	}
 	for _, tl := range timelineInjections {
-		numNew, _, err := store.Accumulate(tl.RoomID, tl.Events)
+		numNew, _, err := store.Accumulate(tl.RoomID, "", tl.Events)
 		if err != nil {
 			t.Fatalf("Accumulate on %s failed: %s", tl.RoomID, err)
 		}
@@ -358,7 +359,7 @@ func TestVisibleEventNIDsBetween(t *testing.T) {
 		t.Fatalf("LatestEventNID: %s", err)
 	}
 	for _, tl := range timelineInjections {
-		numNew, _, err := store.Accumulate(tl.RoomID, tl.Events)
+		numNew, _, err := store.Accumulate(tl.RoomID, "", tl.Events)
 		if err != nil {
 			t.Fatalf("Accumulate on %s failed: %s", tl.RoomID, err)
 		}
@@ -411,3 +412,141 @@ func verifyRange(t *testing.T, result map[string][][2]int64, roomID string, want
 		}
 	}
 }
+
+func TestStorageBundleRelations(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	roomID := "!TestStorageBundleRelations:localhost"
+	alice := "@alice:localhost"
+	bob := "@bob:localhost"
+	original := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"msgtype": "m.text", "body": "helo"})
+	plain := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"msgtype": "m.text", "body": "no relations"})
+	originalID := gjson.GetBytes(original, "event_id").Str
+	relatesTo := func(relType, key string) map[string]interface{} {
+		rel := map[string]interface{}{
+			"rel_type": relType,
+			"event_id": originalID,
+		}
+		if key != "" {
+			rel["key"] = key
+		}
+		return rel
+	}
+	edit := func(sender, body string) json.RawMessage {
+		return testutils.NewEvent(t, "m.room.message", sender, map[string]interface{}{
+			"msgtype":       "m.text",
+			"body":          "* " + body,
+			"m.new_content": map[string]interface{}{"msgtype": "m.text", "body": body},
+			"m.relates_to":  relatesTo("m.replace", ""),
+		})
+	}
+	reaction := func(sender, key string) json.RawMessage {
+		return testutils.NewEvent(t, "m.reaction", sender, map[string]interface{}{
+			"m.relates_to": relatesTo("m.annotation", key),
+		})
+	}
+	latestEdit := edit(alice, "hello again")
+	events := []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		original,
+		plain,
+		edit(alice, "hello"),
+		reaction(alice, "👍"),
+		reaction(bob, "👍"),
+		reaction(bob, "🎉"),
+		latestEdit,
+		edit(bob, "not allowed"), // only the sender can edit
+	}
+	if _, _, err := store.Accumulate(roomID, "", events); err != nil {
+		t.Fatalf("Accumulate returned error: %s", err)
+	}
+	bundled, err := store.BundleRelations([]json.RawMessage{original, plain})
+	if err != nil {
+		t.Fatalf("BundleRelations returned error: %s", err)
+	}
+	if !bytes.Equal(bundled[1], plain) {
+		t.Errorf("BundleRelations modified an event without relations: %s", string(bundled[1]))
+	}
+	got := gjson.ParseBytes(bundled[0])
+	if body := got.Get("content.body").Str; body != "hello again" {
+		t.Errorf("edited content: got body %q want %q", body, "hello again")
+	}
+	if editID := got.Get(`unsigned.m\.relations.m\.replace.event_id`).Str; editID != gjson.GetBytes(latestEdit, "event_id").Str {
+		t.Errorf("bundled m.replace: got %s want latest edit", editID)
+	}
+	var gotAnnotations []Annotation
+	if err = json.Unmarshal([]byte(got.Get(`unsigned.m\.relations.m\.annotation.chunk`).Raw), &gotAnnotations); err != nil {
+		t.Fatalf("failed to unmarshal annotations: %s", err)
+	}
+	wantAnnotations := []Annotation{
+		{Type: "m.reaction", Key: "👍", Count: 2},
+		{Type: "m.reaction", Key: "🎉", Count: 1},
+	}
+	if !reflect.DeepEqual(gotAnnotations, wantAnnotations) {
+		t.Errorf("bundled annotations: got %+v want %+v", gotAnnotations, wantAnnotations)
+	}
+}
+
+func TestStorageThreads(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	roomID := "!TestStorageThreads:localhost"
+	alice := "@alice:localhost"
+	root := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"msgtype": "m.text", "body": "root"})
+	rootID := gjson.GetBytes(root, "event_id").Str
+	reply := func(relType, body string) json.RawMessage {
+		return testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    body,
+			"m.relates_to": map[string]interface{}{
+				"rel_type": relType,
+				"event_id": rootID,
+			},
+		})
+	}
+	replies := []json.RawMessage{
+		reply(RelThread, "first"),
+		reply("io.element.thread", "second"), // the unstable rel_type is treated the same
+		reply(RelThread, "third"),
+	}
+	events := []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		root,
+	}
+	events = append(events, replies...)
+	_, latest, err := store.Accumulate(roomID, "", events)
+	if err != nil {
+		t.Fatalf("Accumulate returned error: %s", err)
+	}
+
+	// the latest event in the main timeline is the root, with a thread summary
+	mainEvent, err := store.LatestMainTimelineEventInRoom(roomID, latest)
+	if err != nil {
+		t.Fatalf("LatestMainTimelineEventInRoom returned error: %s", err)
+	}
+	if gotID := gjson.GetBytes(mainEvent, "event_id").Str; gotID != rootID {
+		t.Fatalf("LatestMainTimelineEventInRoom: got %s want thread root %s", gotID, rootID)
+	}
+	summary := gjson.GetBytes(mainEvent, `unsigned.m\.relations.m\.thread`)
+	if count := summary.Get("count").Int(); count != 3 {
+		t.Errorf("thread summary: got count %d want 3", count)
+	}
+	if latestID := summary.Get("latest_event.event_id").Str; latestID != gjson.GetBytes(replies[2], "event_id").Str {
+		t.Errorf("thread summary: got latest event %s want the third reply", latestID)
+	}
+
+	// the thread timeline is the root and replies, limited to the latest events
+	timeline, err := store.ThreadTimeline(roomID, rootID, 3)
+	if err != nil {
+		t.Fatalf("ThreadTimeline returned error: %s", err)
+	}
+	var gotIDs []string
+	for _, ev := range timeline {
+		gotIDs = append(gotIDs, gjson.GetBytes(ev, "event_id").Str)
+	}
+	var wantIDs []string
+	for _, ev := range replies {
+		wantIDs = append(wantIDs, gjson.GetBytes(ev, "event_id").Str)
+	}
+	if !reflect.DeepEqual(gotIDs, wantIDs) {
+		t.Errorf("ThreadTimeline: got %v want %v", gotIDs, wantIDs)
+	}
+}
@@ -5,10 +5,16 @@ import (
 	"fmt"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/sync-v3/sqlutil"
+	"github.com/tidwall/gjson"
 )
 
+// RoomKeyEventTypes are the to-device event types which carry room keys. Clients need these before they
+// can decrypt anything, so they can be fetched ahead of the rest of the queue.
+var RoomKeyEventTypes = []string{"m.room_key", "m.forwarded_room_key"}
+
 // ToDeviceTable stores to_device messages for devices.
 type ToDeviceTable struct {
 	db *sqlx.DB
@@ -18,6 +24,8 @@ type ToDeviceRow struct {
 	Position int64  `db:"position"`
 	DeviceID string `db:"device_id"`
 	Message  string `db:"message"`
+	Type     string `db:"event_type"`
+	Sender   string `db:"sender"`
 }
 
 type ToDeviceRowChunker []ToDeviceRow
@@ -40,14 +48,85 @@ func NewToDeviceTable(db *sqlx.DB) *ToDeviceTable {
 	);
 	CREATE INDEX IF NOT EXISTS syncv3_to_device_messages_device_idx ON syncv3_to_device_messages(device_id);
 	`)
+	// the type and sender columns were added later, so messages stored before then are backfilled when the
+	// columns are added. This is done in one transaction so it only ever happens once.
+	err := sqlutil.WithTransaction(db, func(txn *sqlx.Tx) error {
+		var hasTypeColumn bool
+		err := txn.QueryRow(`SELECT EXISTS(
+			SELECT 1 FROM information_schema.columns
+			WHERE table_name = 'syncv3_to_device_messages' AND column_name = 'event_type'
+		)`).Scan(&hasTypeColumn)
+		if err != nil || hasTypeColumn {
+			return err
+		}
+		txn.MustExec(`
+		ALTER TABLE syncv3_to_device_messages ADD COLUMN IF NOT EXISTS event_type TEXT NOT NULL DEFAULT '';
+		ALTER TABLE syncv3_to_device_messages ADD COLUMN IF NOT EXISTS sender TEXT NOT NULL DEFAULT '';
+		CREATE INDEX IF NOT EXISTS syncv3_to_device_messages_type_idx ON syncv3_to_device_messages(device_id, event_type, sender);
+		`)
+		return backfillToDeviceTypes(txn)
+	})
+	if err != nil {
+		log.Panic().Err(err).Msg("failed to add type and sender to to-device messages")
+	}
 	return &ToDeviceTable{db}
 }
 
+// backfillToDeviceTypes sets the type and sender of every stored message from the message JSON. Messages
+// which aren't valid JSON are left with an empty type and sender.
+func backfillToDeviceTypes(txn *sqlx.Tx) error {
+	batchSize := 1000
+	var lastPos int64
+	for {
+		var rows []ToDeviceRow
+		err := txn.Select(&rows, `SELECT position, message FROM syncv3_to_device_messages
+			WHERE position > $1 ORDER BY position ASC LIMIT $2`, lastPos, batchSize)
+		if err != nil {
+			return fmt.Errorf("failed to select to-device messages: %w", err)
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+		positions := make([]int64, len(rows))
+		types := make([]string, len(rows))
+		senders := make([]string, len(rows))
+		for i, row := range rows {
+			positions[i] = row.Position
+			if gjson.Valid(row.Message) {
+				msg := gjson.Parse(row.Message)
+				types[i] = msg.Get("type").Str
+				senders[i] = msg.Get("sender").Str
+			}
+		}
+		_, err = txn.Exec(`UPDATE syncv3_to_device_messages AS m SET event_type = u.event_type, sender = u.sender
+			FROM (SELECT unnest($1::bigint[]) AS position, unnest($2::text[]) AS event_type, unnest($3::text[]) AS sender) AS u
+			WHERE m.position = u.position`, pq.Int64Array(positions), pq.StringArray(types), pq.StringArray(senders))
+		if err != nil {
+			return fmt.Errorf("failed to backfill to-device messages: %w", err)
+		}
+		lastPos = rows[len(rows)-1].Position
+	}
+}
+
 func (t *ToDeviceTable) DeleteMessagesUpToAndIncluding(deviceID string, toIncl int64) error {
 	_, err := t.db.Exec(`DELETE FROM syncv3_to_device_messages WHERE device_id = $1 AND position <= $2`, deviceID, toIncl)
 	return err
 }
 
+// DeleteMessages deletes the messages at these positions for this device. Unlike
+// DeleteMessagesUpToAndIncluding, this doesn't delete earlier messages which haven't been sent yet, so
+// should be used for messages returned by PriorityMessages.
+func (t *ToDeviceTable) DeleteMessages(deviceID string, positions []int64) error {
+	if len(positions) == 0 {
+		return nil
+	}
+	_, err := t.db.Exec(
+		`DELETE FROM syncv3_to_device_messages WHERE device_id = $1 AND position = ANY($2)`,
+		deviceID, pq.Int64Array(positions),
+	)
+	return err
+}
+
 func (t *ToDeviceTable) Messages(deviceID string, from, to, limit int64) (msgs []json.RawMessage, upTo int64, err error) {
 	upTo = to
 	var rows []ToDeviceRow
@@ -67,36 +146,70 @@ func (t *ToDeviceTable) Messages(deviceID string, from, to, limit int64) (msgs [
 	return
 }
 
-func (t *ToDeviceTable) InsertMessages(deviceID string, msgs []gomatrixserverlib.SendToDeviceEvent) (pos int64, err error) {
+// PriorityMessages returns up to `limit` messages for this device between the two positions. Messages with
+// one of the `priorityTypes` come first, followed by all other messages. Each group is in position order.
+// As the messages may not be contiguous, the position of each message is returned so they can be deleted
+// with DeleteMessages once they have been delivered.
+func (t *ToDeviceTable) PriorityMessages(
+	deviceID string, priorityTypes []string, from, to, limit int64,
+) (msgs []json.RawMessage, positions []int64, err error) {
+	var rows []ToDeviceRow
+	err = t.db.Select(&rows,
+		`SELECT position, message FROM syncv3_to_device_messages WHERE device_id = $1 AND position > $2 AND position <= $3
+		ORDER BY event_type = ANY($4) DESC, position ASC LIMIT $5`,
+		deviceID, from, to, pq.StringArray(priorityTypes), limit,
+	)
+	if len(rows) == 0 {
+		return
+	}
+	msgs = make([]json.RawMessage, len(rows))
+	positions = make([]int64, len(rows))
+	for i := range rows {
+		msgs[i] = json.RawMessage(rows[i].Message)
+		positions[i] = rows[i].Position
+	}
+	return
+}
+
+// InsertMessages stores to-device messages for this device, returning the position of the last message.
+// If txn is nil, the messages are inserted in a new transaction.
+func (t *ToDeviceTable) InsertMessages(txn *sqlx.Tx, deviceID string, msgs []gomatrixserverlib.SendToDeviceEvent) (pos int64, err error) {
+	if txn == nil {
+		err = sqlutil.WithTransaction(t.db, func(txn *sqlx.Tx) error {
+			pos, err = t.InsertMessages(txn, deviceID, msgs)
+			return err
+		})
+		return pos, err
+	}
 	var lastPos int64
-	err = sqlutil.WithTransaction(t.db, func(txn *sqlx.Tx) error {
-		rows := make([]ToDeviceRow, len(msgs))
-		for i := range msgs {
-			msgJSON, err := json.Marshal(msgs[i])
-			if err != nil {
-				return fmt.Errorf("InsertMessages: failed to marshal to_device event: %s", err)
-			}
-			rows[i] = ToDeviceRow{
-				DeviceID: deviceID,
-				Message:  string(msgJSON),
-			}
+	rows := make([]ToDeviceRow, len(msgs))
+	for i := range msgs {
+		msgJSON, err := json.Marshal(msgs[i])
+		if err != nil {
+			return 0, fmt.Errorf("InsertMessages: failed to marshal to_device event: %s", err)
 		}
+		rows[i] = ToDeviceRow{
+			DeviceID: deviceID,
+			Message:  string(msgJSON),
+			Type:     msgs[i].Type,
+			Sender:   msgs[i].Sender,
+		}
+	}
 
-		chunks := sqlutil.Chunkify(2, 65535, ToDeviceRowChunker(rows))
-		for _, chunk := range chunks {
-			result, err := t.db.NamedQuery(`INSERT INTO syncv3_to_device_messages (device_id, message)
-        VALUES (:device_id, :message) RETURNING position`, chunk)
-			if err != nil {
-				return err
-			}
-			for result.Next() {
-				if err = result.Scan(&lastPos); err != nil {
-					return err
-				}
+	chunks := sqlutil.Chunkify(4, 65535, ToDeviceRowChunker(rows))
+	for _, chunk := range chunks {
+		result, err := txn.NamedQuery(`INSERT INTO syncv3_to_device_messages (device_id, message, event_type, sender)
+        VALUES (:device_id, :message, :event_type, :sender) RETURNING position`, chunk)
+		if err != nil {
+			return 0, err
+		}
+		for result.Next() {
+			if err = result.Scan(&lastPos); err != nil {
+				result.Close()
+				return 0, err
 			}
-			result.Close()
 		}
-		return nil
-	})
-	return lastPos, err
+		result.Close()
+	}
+	return lastPos, nil
 }
@@ -7,6 +7,7 @@ import (
 
 	"github.com/jmoiron/sqlx"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/sync-v3/sqlutil"
 )
 
 func TestToDeviceTable(t *testing.T) {
@@ -30,7 +31,7 @@ func TestToDeviceTable(t *testing.T) {
 		},
 	}
 	var lastPos int64
-	if lastPos, err = table.InsertMessages(deviceID, msgs); err != nil {
+	if lastPos, err = table.InsertMessages(nil, deviceID, msgs); err != nil {
 		t.Fatalf("InsertMessages: %s", err)
 	}
 	if lastPos != 2 {
@@ -128,3 +129,119 @@ func TestToDeviceTable(t *testing.T) {
 		t.Fatalf("Messages: deleted message but unexpected message left: got %s want %s", string(gotMsgs[0]), string(want))
 	}
 }
+
+// Test that room keys can be fetched before the rest of the queue, and that deleting them leaves the rest
+// of the queue in order.
+func TestToDeviceTablePriorityMessages(t *testing.T) {
+	db, err := sqlx.Open("postgres", postgresConnectionString)
+	if err != nil {
+		t.Fatalf("failed to open SQL db: %s", err)
+	}
+	table := NewToDeviceTable(db)
+	deviceID := "TestToDeviceTablePriorityMessages"
+	msgs := []gomatrixserverlib.SendToDeviceEvent{
+		{
+			Sender:  "alice",
+			Type:    "m.room_key_request",
+			Content: []byte(`{"foo":"a"}`),
+		},
+		{
+			Sender:  "bob",
+			Type:    "m.room_key",
+			Content: []byte(`{"foo":"b"}`),
+		},
+		{
+			Sender:  "alice",
+			Type:    "m.room_key_request",
+			Content: []byte(`{"foo":"c"}`),
+		},
+		{
+			Sender:  "charlie",
+			Type:    "m.forwarded_room_key",
+			Content: []byte(`{"foo":"d"}`),
+		},
+	}
+	lastPos, err := table.InsertMessages(nil, deviceID, msgs)
+	if err != nil {
+		t.Fatalf("InsertMessages: %s", err)
+	}
+
+	// room keys first, then everything else
+	gotMsgs, positions, err := table.PriorityMessages(deviceID, RoomKeyEventTypes, 0, lastPos, 3)
+	if err != nil {
+		t.Fatalf("PriorityMessages: %s", err)
+	}
+	assertToDeviceMessages(t, gotMsgs, []gomatrixserverlib.SendToDeviceEvent{msgs[1], msgs[3], msgs[0]})
+	if len(positions) != 3 || positions[1] != lastPos || positions[0] >= positions[1] || positions[2] >= positions[0] {
+		t.Fatalf("PriorityMessages: got positions %v, want the positions of messages 1, 3 and 0", positions)
+	}
+
+	// deleting the room keys keeps the earlier messages
+	if err = table.DeleteMessages(deviceID, positions[:2]); err != nil {
+		t.Fatalf("DeleteMessages: %s", err)
+	}
+	gotMsgs, _, err = table.Messages(deviceID, 0, lastPos, 999)
+	if err != nil {
+		t.Fatalf("Messages: %s", err)
+	}
+	assertToDeviceMessages(t, gotMsgs, []gomatrixserverlib.SendToDeviceEvent{msgs[0], msgs[2]})
+}
+
+// Test that messages stored before the type and sender columns existed are backfilled from their JSON.
+func TestToDeviceTableBackfill(t *testing.T) {
+	db, err := sqlx.Open("postgres", postgresConnectionString)
+	if err != nil {
+		t.Fatalf("failed to open SQL db: %s", err)
+	}
+	table := NewToDeviceTable(db)
+	deviceID := "TestToDeviceTableBackfill"
+	msgs := []gomatrixserverlib.SendToDeviceEvent{
+		{
+			Sender:  "alice",
+			Type:    "m.room_key",
+			Content: []byte(`{"foo":"a"}`),
+		},
+	}
+	if _, err = table.InsertMessages(nil, deviceID, msgs); err != nil {
+		t.Fatalf("InsertMessages: %s", err)
+	}
+	db.MustExec(`INSERT INTO syncv3_to_device_messages(device_id, message) VALUES($1, 'not json')`, deviceID)
+	db.MustExec(`UPDATE syncv3_to_device_messages SET event_type = '', sender = '' WHERE device_id = $1`, deviceID)
+	err = sqlutil.WithTransaction(db, func(txn *sqlx.Tx) error {
+		return backfillToDeviceTypes(txn)
+	})
+	if err != nil {
+		t.Fatalf("backfillToDeviceTypes: %s", err)
+	}
+	var rows []ToDeviceRow
+	err = db.Select(&rows, `SELECT position, device_id, message, event_type, sender FROM syncv3_to_device_messages
+		WHERE device_id = $1 ORDER BY position ASC`, deviceID)
+	if err != nil {
+		t.Fatalf("failed to select messages: %s", err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("got %d messages, want 2", len(rows))
+	}
+	if rows[0].Type != "m.room_key" || rows[0].Sender != "alice" {
+		t.Errorf("backfilled message: got type %q sender %q want m.room_key alice", rows[0].Type, rows[0].Sender)
+	}
+	if rows[1].Type != "" || rows[1].Sender != "" {
+		t.Errorf("invalid message: got type %q sender %q want them empty", rows[1].Type, rows[1].Sender)
+	}
+}
+
+func assertToDeviceMessages(t *testing.T, gotMsgs []json.RawMessage, wantMsgs []gomatrixserverlib.SendToDeviceEvent) {
+	t.Helper()
+	if len(gotMsgs) != len(wantMsgs) {
+		t.Fatalf("got %d messages, want %d", len(gotMsgs), len(wantMsgs))
+	}
+	for i := range wantMsgs {
+		want, err := json.Marshal(wantMsgs[i])
+		if err != nil {
+			t.Fatalf("failed to marshal msg: %s", err)
+		}
+		if !bytes.Equal(want, gotMsgs[i]) {
+			t.Errorf("message %d: got %s want %s", i, string(gotMsgs[i]), string(want))
+		}
+	}
+}
@@ -7,9 +7,9 @@ import (
 	"github.com/lib/pq"
 )
 
-// TypingTable stores who is currently typing
-// TODO: If 2 users are in the same room and 1 is on a laggy synchotron, we'll flip flop who is
-// typing with live / stale data. Maybe do this per user per room?
+// TypingTable stores who is currently typing in each room, as seen by each user. Typing notifications are
+// stored per observing user because each user's v2 stream may be served by a different homeserver worker,
+// and a laggy worker would otherwise flip flop the typing list between live and stale data.
 type TypingTable struct {
 	db *sqlx.DB
 }
@@ -20,9 +20,16 @@ func NewTypingTable(db *sqlx.DB) *TypingTable {
 	CREATE SEQUENCE IF NOT EXISTS syncv3_typing_seq;
 	CREATE TABLE IF NOT EXISTS syncv3_typing (
 		stream_id BIGINT NOT NULL DEFAULT nextval('syncv3_typing_seq'),
-		room_id TEXT NOT NULL PRIMARY KEY,
+		room_id TEXT NOT NULL,
+		-- the user whose v2 stream these typing users were seen on
+		observer_user_id TEXT NOT NULL DEFAULT '',
 		user_ids TEXT[] NOT NULL
 	);
+	-- typing used to be stored per room: typing is ephemeral so the old rows are left to be replaced
+	ALTER TABLE syncv3_typing ADD COLUMN IF NOT EXISTS observer_user_id TEXT NOT NULL DEFAULT '';
+	ALTER TABLE syncv3_typing DROP CONSTRAINT IF EXISTS syncv3_typing_pkey;
+	CREATE UNIQUE INDEX IF NOT EXISTS syncv3_typing_room_observer_idx ON syncv3_typing(room_id, observer_user_id);
+	CREATE INDEX IF NOT EXISTS syncv3_typing_observer_stream_idx ON syncv3_typing(observer_user_id, stream_id);
 	`)
 	return &TypingTable{db}
 }
@@ -38,26 +45,65 @@ func (t *TypingTable) SelectHighestID() (id int64, err error) {
 	return
 }
 
-func (t *TypingTable) SetTyping(roomID string, userIDs []string) (position int64, err error) {
+// SetTyping replaces the typing users in this room as seen by `observerUserID`, returning the new stream
+// position. If txn is nil, the update is not made in a transaction.
+func (t *TypingTable) SetTyping(txn *sqlx.Tx, roomID, observerUserID string, userIDs []string) (position int64, err error) {
 	if userIDs == nil {
 		userIDs = []string{}
 	}
-	err = t.db.QueryRow(`
-		INSERT INTO syncv3_typing(room_id, user_ids) VALUES($1, $2)
-		ON CONFLICT (room_id) DO UPDATE SET user_ids = $2, stream_id = nextval('syncv3_typing_seq') RETURNING stream_id`,
-		roomID, pq.Array(userIDs),
+	var db sqlx.Queryer = t.db
+	if txn != nil {
+		db = txn
+	}
+	err = db.QueryRowx(`
+		INSERT INTO syncv3_typing(room_id, observer_user_id, user_ids) VALUES($1, $2, $3)
+		ON CONFLICT (room_id, observer_user_id) DO UPDATE SET user_ids = $3, stream_id = nextval('syncv3_typing_seq')
+		RETURNING stream_id`,
+		roomID, observerUserID, pq.Array(userIDs),
 	).Scan(&position)
 	return position, err
 }
 
-func (t *TypingTable) Typing(roomID string, fromStreamIDExcl, toStreamIDIncl int64) (userIDs []string, latest int64, err error) {
+// Typing returns the typing users in this room as seen by `observerUserID`, if they changed between these
+// stream positions.
+func (t *TypingTable) Typing(roomID, observerUserID string, fromStreamIDExcl, toStreamIDIncl int64) (userIDs []string, latest int64, err error) {
 	var userIDsArray pq.StringArray
 	err = t.db.QueryRow(
-		`SELECT stream_id, user_ids FROM syncv3_typing WHERE room_id=$1 AND stream_id > $2 AND stream_id <= $3`,
-		roomID, fromStreamIDExcl, toStreamIDIncl,
+		`SELECT stream_id, user_ids FROM syncv3_typing
+		WHERE room_id=$1 AND observer_user_id=$2 AND stream_id > $3 AND stream_id <= $4`,
+		roomID, observerUserID, fromStreamIDExcl, toStreamIDIncl,
 	).Scan(&latest, &userIDsArray)
 	if err == sql.ErrNoRows {
 		err = nil
 	}
 	return userIDsArray, latest, err
 }
+
+// TypingDelta returns the typing users in each room where they changed between these stream positions, as
+// seen by `observerUserID`. Returns a map of room ID to typing users, along with the latest position.
+func (t *TypingTable) TypingDelta(observerUserID string, fromStreamIDExcl, toStreamIDIncl int64) (map[string][]string, int64, error) {
+	rows, err := t.db.Query(
+		`SELECT stream_id, room_id, user_ids FROM syncv3_typing
+		WHERE observer_user_id=$1 AND stream_id > $2 AND stream_id <= $3`,
+		observerUserID, fromStreamIDExcl, toStreamIDIncl,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	result := make(map[string][]string)
+	var latest int64
+	for rows.Next() {
+		var streamID int64
+		var roomID string
+		var userIDs pq.StringArray
+		if err := rows.Scan(&streamID, &roomID, &userIDs); err != nil {
+			return nil, 0, err
+		}
+		result[roomID] = userIDs
+		if streamID > latest {
+			latest = streamID
+		}
+	}
+	return result, latest, rows.Err()
+}
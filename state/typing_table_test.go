@@ -17,11 +17,12 @@ func TestTypingTable(t *testing.T) {
 		"@bob:localhost",
 	}
 	roomID := "!foo:localhost"
+	observer := "@observer:localhost"
 	table := NewTypingTable(db)
 	lastStreamID := int64(-1)
 
 	setAndCheck := func() {
-		streamID, err := table.SetTyping(roomID, userIDs)
+		streamID, err := table.SetTyping(nil, roomID, observer, userIDs)
 		if err != nil {
 			t.Fatalf("failed to SetTyping: %s", err)
 		}
@@ -32,7 +33,7 @@ func TestTypingTable(t *testing.T) {
 			t.Errorf("SetTyping: streamID returned should always be increasing but it wasn't, got %d, last %d", streamID, lastStreamID)
 		}
 		lastStreamID = streamID
-		gotUserIDs, _, err := table.Typing(roomID, streamID-1, lastStreamID)
+		gotUserIDs, _, err := table.Typing(roomID, observer, streamID-1, lastStreamID)
 		if err != nil {
 			t.Fatalf("failed to Typing: %s", err)
 		}
@@ -53,4 +54,37 @@ func TestTypingTable(t *testing.T) {
 	if highest != lastStreamID {
 		t.Fatalf("SelectHighestID: got %d want %d", highest, lastStreamID)
 	}
+
+	// a stale view from another user doesn't replace this user's view
+	staleStreamID, err := table.SetTyping(nil, roomID, "@laggy:localhost", []string{"@alice:localhost"})
+	if err != nil {
+		t.Fatalf("failed to SetTyping: %s", err)
+	}
+	gotUserIDs, _, err := table.Typing(roomID, observer, 0, staleStreamID)
+	if err != nil {
+		t.Fatalf("failed to Typing: %s", err)
+	}
+	if len(gotUserIDs) != 0 {
+		t.Errorf("got typing users %v from another user's view, want none", gotUserIDs)
+	}
+
+	// deltas only include the rooms which changed for this user
+	otherRoomID := "!bar:localhost"
+	otherStreamID, err := table.SetTyping(nil, otherRoomID, observer, []string{"@bob:localhost"})
+	if err != nil {
+		t.Fatalf("failed to SetTyping: %s", err)
+	}
+	delta, latest, err := table.TypingDelta(observer, lastStreamID, otherStreamID)
+	if err != nil {
+		t.Fatalf("TypingDelta: %s", err)
+	}
+	if latest != otherStreamID {
+		t.Errorf("TypingDelta: got latest %d want %d", latest, otherStreamID)
+	}
+	wantDelta := map[string][]string{
+		otherRoomID: {"@bob:localhost"},
+	}
+	if !reflect.DeepEqual(delta, wantDelta) {
+		t.Errorf("TypingDelta: got %v want %v", delta, wantDelta)
+	}
 }
@@ -19,13 +19,16 @@ func NewUnreadTable(db *sqlx.DB) *UnreadTable {
 		highlight_count BIGINT NOT NULL DEFAULT 0,
 		UNIQUE(user_id, room_id)
 	);
+	-- MSC2654: the number of unread messages, which unlike notification_count ignores push rules
+	ALTER TABLE syncv3_unread ADD COLUMN IF NOT EXISTS unread_count BIGINT NOT NULL DEFAULT 0;
 	`)
 	return &UnreadTable{db}
 }
 
-func (t *UnreadTable) SelectAllNonZeroCounts(callback func(roomID, userID string, highlightCount, notificationCount int)) error {
+func (t *UnreadTable) SelectAllNonZeroCounts(callback func(roomID, userID string, highlightCount, notificationCount, unreadCount int)) error {
 	rows, err := t.db.Query(
-		`SELECT user_id, room_id, notification_count, highlight_count FROM syncv3_unread WHERE notification_count > 0 OR highlight_count > 0`,
+		`SELECT user_id, room_id, notification_count, highlight_count, unread_count FROM syncv3_unread
+		WHERE notification_count > 0 OR highlight_count > 0 OR unread_count > 0`,
 	)
 	if err != nil {
 		return err
@@ -36,41 +39,41 @@ func (t *UnreadTable) SelectAllNonZeroCounts(callback func(roomID, userID string
 		var userID string
 		var highlightCount int
 		var notifCount int
-		if err := rows.Scan(&userID, &roomID, &notifCount, &highlightCount); err != nil {
+		var unreadCount int
+		if err := rows.Scan(&userID, &roomID, &notifCount, &highlightCount, &unreadCount); err != nil {
 			return err
 		}
-		callback(roomID, userID, highlightCount, notifCount)
+		callback(roomID, userID, highlightCount, notifCount, unreadCount)
 	}
 	return nil
 }
 
-func (t *UnreadTable) SelectUnreadCounters(userID, roomID string) (highlightCount, notificationCount int, err error) {
+func (t *UnreadTable) SelectUnreadCounters(userID, roomID string) (highlightCount, notificationCount, unreadCount int, err error) {
 	err = t.db.QueryRow(
-		`SELECT notification_count, highlight_count FROM syncv3_unread WHERE user_id=$1 AND room_id=$2`, userID, roomID,
-	).Scan(&notificationCount, &highlightCount)
+		`SELECT notification_count, highlight_count, unread_count FROM syncv3_unread WHERE user_id=$1 AND room_id=$2`, userID, roomID,
+	).Scan(&notificationCount, &highlightCount, &unreadCount)
 	return
 }
 
-func (t *UnreadTable) UpdateUnreadCounters(userID, roomID string, highlightCount, notificationCount *int) error {
-	var err error
-	if highlightCount != nil && notificationCount != nil {
-		_, err = t.db.Exec(
-			`INSERT INTO syncv3_unread(room_id, user_id, notification_count, highlight_count) VALUES($1, $2, $3, $4)
-		ON CONFLICT (room_id, user_id) DO UPDATE SET notification_count = $3, highlight_count = $4`,
-			roomID, userID, *notificationCount, *highlightCount,
-		)
-	} else if highlightCount != nil {
-		_, err = t.db.Exec(
-			`INSERT INTO syncv3_unread(room_id, user_id, highlight_count) VALUES($1, $2, $3)
-		ON CONFLICT (room_id, user_id) DO UPDATE SET highlight_count = $3`,
-			roomID, userID, *highlightCount,
-		)
-	} else if notificationCount != nil {
-		_, err = t.db.Exec(
-			`INSERT INTO syncv3_unread(room_id, user_id, notification_count) VALUES($1, $2, $3)
-		ON CONFLICT (room_id, user_id) DO UPDATE SET notification_count = $3`,
-			roomID, userID, *notificationCount,
-		)
+// UpdateUnreadCounters sets the counts which are not nil for this user in this room. If txn is nil, the
+// update is not made in a transaction.
+func (t *UnreadTable) UpdateUnreadCounters(txn *sqlx.Tx, userID, roomID string, highlightCount, notificationCount, unreadCount *int) error {
+	if highlightCount == nil && notificationCount == nil && unreadCount == nil {
+		return nil
 	}
+	var db sqlx.Execer = t.db
+	if txn != nil {
+		db = txn
+	}
+	// nil counts are passed as NULL which keeps the existing value, or the default for new rows
+	_, err := db.Exec(
+		`INSERT INTO syncv3_unread(room_id, user_id, notification_count, highlight_count, unread_count)
+		VALUES($1, $2, COALESCE($3::BIGINT, 0), COALESCE($4::BIGINT, 0), COALESCE($5::BIGINT, 0))
+		ON CONFLICT (room_id, user_id) DO UPDATE SET
+			notification_count = COALESCE($3::BIGINT, syncv3_unread.notification_count),
+			highlight_count = COALESCE($4::BIGINT, syncv3_unread.highlight_count),
+			unread_count = COALESCE($5::BIGINT, syncv3_unread.unread_count)`,
+		roomID, userID, notificationCount, highlightCount, unreadCount,
+	)
 	return err
 }
@@ -22,20 +22,27 @@ func TestUnreadTable(t *testing.T) {
 	zero := 0
 
 	// try all kinds of insertions
-	assertNoError(t, table.UpdateUnreadCounters(userID, roomA, &two, &one)) // both
-	assertNoError(t, table.UpdateUnreadCounters(userID, roomB, &two, nil))  // one
-	assertNoError(t, table.UpdateUnreadCounters(userID, roomC, nil, &two))  // one
-	assertUnread(t, table, userID, roomA, 2, 1)
-	assertUnread(t, table, userID, roomB, 2, 0)
-	assertUnread(t, table, userID, roomC, 0, 2)
+	assertNoError(t, table.UpdateUnreadCounters(nil, userID, roomA, &two, &one, nil)) // both
+	assertNoError(t, table.UpdateUnreadCounters(nil, userID, roomB, &two, nil, nil))  // one
+	assertNoError(t, table.UpdateUnreadCounters(nil, userID, roomC, nil, &two, nil))  // one
+	assertUnread(t, table, userID, roomA, 2, 1, 0)
+	assertUnread(t, table, userID, roomB, 2, 0, 0)
+	assertUnread(t, table, userID, roomC, 0, 2, 0)
 
 	// try all kinds of updates
-	assertNoError(t, table.UpdateUnreadCounters(userID, roomA, &zero, nil))   // one
-	assertNoError(t, table.UpdateUnreadCounters(userID, roomB, nil, &two))    // one
-	assertNoError(t, table.UpdateUnreadCounters(userID, roomC, &zero, &zero)) // both
-	assertUnread(t, table, userID, roomA, 0, 1)
-	assertUnread(t, table, userID, roomB, 2, 2)
-	assertUnread(t, table, userID, roomC, 0, 0)
+	assertNoError(t, table.UpdateUnreadCounters(nil, userID, roomA, &zero, nil, nil))   // one
+	assertNoError(t, table.UpdateUnreadCounters(nil, userID, roomB, nil, &two, nil))    // one
+	assertNoError(t, table.UpdateUnreadCounters(nil, userID, roomC, &zero, &zero, nil)) // both
+	assertUnread(t, table, userID, roomA, 0, 1, 0)
+	assertUnread(t, table, userID, roomB, 2, 2, 0)
+	assertUnread(t, table, userID, roomC, 0, 0, 0)
+
+	// unread counts are set independently of the other counts
+	assertNoError(t, table.UpdateUnreadCounters(nil, userID, roomC, nil, nil, &two))
+	assertNoError(t, table.UpdateUnreadCounters(nil, userID, roomA, &one, nil, &one))
+	assertUnread(t, table, userID, roomA, 1, 1, 1)
+	assertUnread(t, table, userID, roomC, 0, 0, 2)
+	assertNoError(t, table.UpdateUnreadCounters(nil, userID, roomA, &zero, nil, nil))
 
 	wantHighlights := map[string]int{
 		roomB: 2,
@@ -44,7 +51,11 @@ func TestUnreadTable(t *testing.T) {
 		roomA: 1,
 		roomB: 2,
 	}
-	assertNoError(t, table.SelectAllNonZeroCounts(func(gotRoomID string, gotUserID string, gotHighlight int, gotNotif int) {
+	wantUnreads := map[string]int{
+		roomA: 1,
+		roomC: 2,
+	}
+	assertNoError(t, table.SelectAllNonZeroCounts(func(gotRoomID string, gotUserID string, gotHighlight, gotNotif, gotUnread int) {
 		if userID != gotUserID {
 			t.Errorf("SelectAllNonZeroCounts: got user %v want %v", gotUserID, userID)
 		}
@@ -56,8 +67,13 @@ func TestUnreadTable(t *testing.T) {
 		if wantNotif != gotNotif {
 			t.Errorf("SelectAllNonZeroCounts for %v got %d notifs, want %d", gotRoomID, gotNotif, wantNotif)
 		}
+		wantUnread := wantUnreads[gotRoomID]
+		if wantUnread != gotUnread {
+			t.Errorf("SelectAllNonZeroCounts for %v got %d unread, want %d", gotRoomID, gotUnread, wantUnread)
+		}
 		delete(wantHighlights, gotRoomID)
 		delete(wantNotifs, gotRoomID)
+		delete(wantUnreads, gotRoomID)
 	}))
 	if len(wantHighlights) != 0 {
 		t.Errorf("SelectAllNonZeroCounts missed highlight rooms: %+v", wantHighlights)
@@ -65,11 +81,14 @@ func TestUnreadTable(t *testing.T) {
 	if len(wantNotifs) != 0 {
 		t.Errorf("SelectAllNonZeroCounts missed notif rooms: %+v", wantNotifs)
 	}
+	if len(wantUnreads) != 0 {
+		t.Errorf("SelectAllNonZeroCounts missed unread rooms: %+v", wantUnreads)
+	}
 }
 
-func assertUnread(t *testing.T, table *UnreadTable, userID, roomID string, wantHighight, wantNotif int) {
+func assertUnread(t *testing.T, table *UnreadTable, userID, roomID string, wantHighight, wantNotif, wantUnread int) {
 	t.Helper()
-	gotHighlight, gotNotif, err := table.SelectUnreadCounters(userID, roomID)
+	gotHighlight, gotNotif, gotUnread, err := table.SelectUnreadCounters(userID, roomID)
 	if err != nil {
 		t.Fatalf("SelectUnreadCounters %s %s: %s", userID, roomID, err)
 	}
@@ -79,6 +98,9 @@ func assertUnread(t *testing.T, table *UnreadTable, userID, roomID string, wantH
 	if gotNotif != wantNotif {
 		t.Errorf("SelectUnreadCounters: got %d notifs, want %d", gotNotif, wantNotif)
 	}
+	if gotUnread != wantUnread {
+		t.Errorf("SelectUnreadCounters: got %d unread, want %d", gotUnread, wantUnread)
+	}
 }
 
 func assertNoError(t *testing.T, err error) {
@@ -0,0 +1,142 @@
+package sync2
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// How many consecutive v2 requests must fail, across all pollers, before the circuit breaker opens.
+var CircuitBreakerThreshold = 10
+
+// How long the circuit breaker stays open before letting a single request through to check if the upstream
+// has recovered. This doubles every time the check fails, up to PollerMaxBackoff.
+var CircuitBreakerCooldown = 10 * time.Second
+
+// alias rand.Int63n so tests can monkey patch out jitter
+var randInt63n = rand.Int63n
+
+// CircuitBreaker pauses all pollers for an upstream whilst it is down, rather than each poller backing off
+// independently. When open, only 1 poller at a time is let through to probe the upstream.
+type CircuitBreaker struct {
+	mu        *sync.Mutex
+	failures  int // consecutive failures across all pollers
+	open      bool
+	openUntil time.Time
+	cooldown  time.Duration
+	probing   bool // true if a poller has been let through to probe the upstream
+}
+
+func NewCircuitBreaker() *CircuitBreaker {
+	return &CircuitBreaker{
+		mu: &sync.Mutex{},
+	}
+}
+
+// IsOpen returns true if the upstream is considered to be down.
+func (b *CircuitBreaker) IsOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.open
+}
+
+// Wait blocks whilst the circuit breaker is open, unless this caller is let through to probe the upstream.
+// Callers which are let through MUST report the result of their request via Success or Failure.
+func (b *CircuitBreaker) Wait() {
+	for {
+		b.mu.Lock()
+		if !b.open {
+			b.mu.Unlock()
+			return
+		}
+		now := time.Now()
+		if !b.probing && !now.Before(b.openUntil) {
+			b.probing = true
+			b.mu.Unlock()
+			return
+		}
+		wait := b.openUntil.Sub(now)
+		if wait <= 0 {
+			// another poller is probing, check back soon
+			wait = time.Second
+		}
+		b.mu.Unlock()
+		// wake up at different times so pollers don't all hit the upstream at once when it recovers
+		timeSleep(withJitter(wait))
+	}
+}
+
+// Success records that a request to the upstream succeeded, closing the circuit breaker.
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.open {
+		log.Info().Msg("CircuitBreaker: upstream has recovered, resuming all pollers")
+	}
+	b.failures = 0
+	b.open = false
+	b.probing = false
+	b.cooldown = 0
+}
+
+// Cancel records that a caller let through by Wait did not make its request after all. If it was let through
+// to probe the upstream, another caller can probe instead.
+func (b *CircuitBreaker) Cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.open {
+		b.probing = false
+	}
+}
+
+// Failure records that a request to the upstream failed because it is unavailable. Opens the circuit
+// breaker if there have been too many consecutive failures, or if a probe failed.
+func (b *CircuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.probing {
+		b.probing = false
+		b.cooldown *= 2
+		if b.cooldown > PollerMaxBackoff {
+			b.cooldown = PollerMaxBackoff
+		}
+		b.openUntil = time.Now().Add(b.cooldown)
+		return
+	}
+	if b.open || b.failures < CircuitBreakerThreshold {
+		return
+	}
+	log.Warn().Int("failures", b.failures).Msg("CircuitBreaker: upstream is down, pausing all pollers")
+	b.open = true
+	b.cooldown = CircuitBreakerCooldown
+	b.openUntil = time.Now().Add(b.cooldown)
+}
+
+// backoffDuration returns how long to wait after this many consecutive failures: exponential backoff capped
+// at PollerMaxBackoff, with jitter so pollers don't retry in lockstep.
+func backoffDuration(failCount int) time.Duration {
+	d := PollerMaxBackoff
+	// avoid overflowing for large fail counts
+	if failCount < 32 {
+		if exp := time.Duration(1<<uint(failCount)) * time.Second; exp < d {
+			d = exp
+		}
+	}
+	return withJitter(d)
+}
+
+// withJitter returns a random duration between d/2 and d.
+func withJitter(d time.Duration) time.Duration {
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + time.Duration(randInt63n(int64(half)+1))
+}
+
+// isUpstreamDown returns true if this response status code means the upstream is unavailable, rather than
+// rejecting this particular request. Status code 0 means there was no response at all.
+func isUpstreamDown(statusCode int) bool {
+	return statusCode == 0 || statusCode >= 500
+}
@@ -0,0 +1,123 @@
+package sync2
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBackoffDuration(t *testing.T) {
+	testCases := []struct {
+		failCount int
+		max       time.Duration
+	}{
+		{failCount: 1, max: 2 * time.Second},
+		{failCount: 3, max: 8 * time.Second},
+		{failCount: 6, max: 64 * time.Second},
+		{failCount: 7, max: PollerMaxBackoff},
+		{failCount: 100, max: PollerMaxBackoff},
+	}
+	for _, tc := range testCases {
+		for i := 0; i < 10; i++ {
+			got := backoffDuration(tc.failCount)
+			if got < tc.max/2 || got > tc.max {
+				t.Errorf("backoffDuration(%d): got %v want between %v and %v", tc.failCount, got, tc.max/2, tc.max)
+			}
+		}
+	}
+}
+
+// Test that the circuit breaker opens after enough failures, only lets 1 poller through to probe the
+// upstream, and closes when the upstream recovers.
+func TestCircuitBreaker(t *testing.T) {
+	oldThreshold := CircuitBreakerThreshold
+	oldCooldown := CircuitBreakerCooldown
+	oldSleep := timeSleep
+	CircuitBreakerThreshold = 3
+	CircuitBreakerCooldown = 20 * time.Millisecond
+	timeSleep = time.Sleep
+	defer func() {
+		CircuitBreakerThreshold = oldThreshold
+		CircuitBreakerCooldown = oldCooldown
+		timeSleep = oldSleep
+	}()
+
+	b := NewCircuitBreaker()
+	for i := 0; i < CircuitBreakerThreshold-1; i++ {
+		b.Failure()
+	}
+	if b.IsOpen() {
+		t.Fatalf("circuit breaker opened before the threshold")
+	}
+	// a success resets the count
+	b.Success()
+	for i := 0; i < CircuitBreakerThreshold-1; i++ {
+		b.Failure()
+	}
+	if b.IsOpen() {
+		t.Fatalf("circuit breaker opened before the threshold after a success")
+	}
+	b.Failure()
+	if !b.IsOpen() {
+		t.Fatalf("circuit breaker did not open at the threshold")
+	}
+
+	// only 1 waiter is let through after the cooldown
+	start := time.Now()
+	b.Wait()
+	if time.Since(start) < CircuitBreakerCooldown/2 {
+		t.Fatalf("Wait returned before the cooldown")
+	}
+	var mu sync.Mutex
+	numWaiting := 3
+	for i := 0; i < numWaiting; i++ {
+		go func() {
+			b.Wait()
+			mu.Lock()
+			numWaiting--
+			mu.Unlock()
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	if numWaiting != 3 {
+		t.Errorf("waiters were let through whilst a probe was in progress: %d still waiting", numWaiting)
+	}
+	mu.Unlock()
+
+	// the probe failing keeps the circuit breaker open
+	b.Failure()
+	if !b.IsOpen() {
+		t.Fatalf("circuit breaker closed after a failed probe")
+	}
+	// after the cooldown, 1 waiter is let through as the next probe
+	waitForWaiting := func(want int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			mu.Lock()
+			n := numWaiting
+			mu.Unlock()
+			if n == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("got %d waiters want %d", n, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitForWaiting(2)
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	if numWaiting != 2 {
+		t.Errorf("waiters were let through whilst a probe was in progress: %d still waiting", numWaiting)
+	}
+	mu.Unlock()
+	// the probe succeeds, which lets everyone through
+	b.Success()
+	if b.IsOpen() {
+		t.Fatalf("circuit breaker is open after a successful probe")
+	}
+	waitForWaiting(0)
+}
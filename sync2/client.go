@@ -1,18 +1,21 @@
 package sync2
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/tidwall/gjson"
 )
 
 type Client interface {
-	WhoAmI(authHeader string) (string, error)
-	DoSyncV2(authHeader, since string) (*SyncResponse, int, error)
+	WhoAmI(authHeader string) (string, int, error)
+	CreateFilter(authHeader, userID string, filter json.RawMessage) (string, error)
+	DoSyncV2(authHeader, since, filter string) (*SyncResponse, int, error)
 }
 
 // HTTPClient represents a Sync v2 Client.
@@ -22,47 +25,83 @@ type HTTPClient struct {
 	DestinationServer string
 }
 
-func (v *HTTPClient) WhoAmI(authHeader string) (string, error) {
+// WhoAmI returns the user ID for this access token. Returns the user ID and the response status code
+// or an error
+func (v *HTTPClient) WhoAmI(authHeader string) (string, int, error) {
 	req, err := http.NewRequest("GET", v.DestinationServer+"/_matrix/client/r0/account/whoami", nil)
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
 	req.Header.Set("User-Agent", "sync-v3-proxy")
 	req.Header.Set("Authorization", authHeader)
 	res, err := v.Client.Do(req)
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
+	defer res.Body.Close()
 	if res.StatusCode != 200 {
-		return "", fmt.Errorf("/whoami returned HTTP %d", res.StatusCode)
+		return "", res.StatusCode, fmt.Errorf("/whoami returned HTTP %d", res.StatusCode)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", res.StatusCode, err
+	}
+	return gjson.GetBytes(body, "user_id").Str, res.StatusCode, nil
+}
+
+// CreateFilter uploads a v2 filter for this user. Returns the filter ID or an error.
+func (v *HTTPClient) CreateFilter(authHeader, userID string, filter json.RawMessage) (string, error) {
+	req, err := http.NewRequest(
+		"POST", v.DestinationServer+"/_matrix/client/r0/user/"+url.PathEscape(userID)+"/filter", bytes.NewReader(filter),
+	)
+	if err != nil {
+		return "", fmt.Errorf("CreateFilter: NewRequest failed: %w", err)
+	}
+	req.Header.Set("User-Agent", "sync-v3-proxy")
+	req.Header.Set("Authorization", authHeader)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := v.Client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("CreateFilter: request failed: %w", err)
 	}
 	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return "", fmt.Errorf("CreateFilter: response returned %s", res.Status)
+	}
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		return "", err
 	}
-	return gjson.GetBytes(body, "user_id").Str, nil
+	filterID := gjson.GetBytes(body, "filter_id").Str
+	if filterID == "" {
+		return "", fmt.Errorf("CreateFilter: response has no filter_id")
+	}
+	return filterID, nil
 }
 
-// DoSyncV2 performs a sync v2 request. Returns the sync response and the response status code
-// or an error
-func (v *HTTPClient) DoSyncV2(authHeader, since string) (*SyncResponse, int, error) {
+// DoSyncV2 performs a sync v2 request. The filter may be a filter ID or an inline JSON filter, or empty
+// to use the server defaults. Returns the sync response and the response status code or an error
+func (v *HTTPClient) DoSyncV2(authHeader, since, filter string) (*SyncResponse, int, error) {
 	qps := "?timeout=30000"
 	if since != "" {
-		qps += "&since=" + since
+		qps += "&since=" + url.QueryEscape(since)
+	}
+	if filter != "" {
+		qps += "&filter=" + url.QueryEscape(filter)
 	}
 	req, err := http.NewRequest(
 		"GET", v.DestinationServer+"/_matrix/client/r0/sync"+qps, nil,
 	)
-	req.Header.Set("User-Agent", "sync-v3-proxy")
-	req.Header.Set("Authorization", authHeader)
 	if err != nil {
 		return nil, 0, fmt.Errorf("DoSyncV2: NewRequest failed: %w", err)
 	}
+	req.Header.Set("User-Agent", "sync-v3-proxy")
+	req.Header.Set("Authorization", authHeader)
 	res, err := v.Client.Do(req)
 	if err != nil {
 		return nil, 0, fmt.Errorf("DoSyncV2: request failed: %w", err)
 	}
+	defer res.Body.Close()
 	switch res.StatusCode {
 	case 200:
 		var svr SyncResponse
@@ -118,6 +157,8 @@ type SyncV2JoinResponse struct {
 		HighlightCount    *int `json:"highlight_count,omitempty"`
 		NotificationCount *int `json:"notification_count,omitempty"`
 	} `json:"unread_notifications"`
+	// MSC2654: the number of unread messages, regardless of push rules
+	UnreadCount *int `json:"org.matrix.msc2654.unread_count,omitempty"`
 }
 
 // InviteResponse represents a /sync response for a room which is under the 'invite' key.
@@ -1,8 +1,11 @@
 package sync2
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
-	"math"
+	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -14,58 +17,315 @@ import (
 // alias time.Sleep so tests can monkey patch it out
 var timeSleep = time.Sleep
 
+// The maximum time a poller waits before retrying a failed v2 sync request.
+var PollerMaxBackoff = 2 * time.Minute
+
+// The maximum number of rooms which are stored concurrently when processing an initial v2 sync. Each room
+// is stored in its own transaction. Set to 1 to store initial syncs in a single transaction.
+var InitialSyncWorkers = 8
+
+// How long a poller lease lasts. Pollers renew their lease immediately before every v2 sync request, so
+// this must be clearly longer than the time between renewals: a v2 sync request, which can take up to the
+// v2 HTTP client timeout (5 minutes in cmd/syncv3) rather than just the 30s long-poll, followed by a
+// backoff or circuit breaker wait of up to PollerMaxBackoff. If the lease expires anyway, e.g during a long
+// outage, the poller terminates before its next request if another instance has taken the lease.
+var PollerLeaseDuration = 10 * time.Minute
+
+// How long a device can have no v3 connections before its poller is stopped. The since token is persisted
+// after every v2 response, so polling resumes from where it left off when the device next makes a v3
+// request. 0 means pollers run forever.
+var PollerIdleTimeout = 30 * time.Minute
+
+// The v2 filter used by pollers. The accumulator needs a large timeline limit to avoid gaps, and needs every
+// state event so lazy-loading members must be off. Presence isn't used. The filter is uploaded once per user
+// and the filter ID is reused.
+var PollerFilter = json.RawMessage(`{"room":{"timeline":{"limit":50},"state":{"lazy_load_members":false}},"presence":{"not_types":["*"]}}`)
+
+// The v2 filter used by pollers which are not processing room data, as another poller for the same user
+// is. These pollers only need device-specific data such as to-device messages.
+var DevicePollerFilter = json.RawMessage(`{"room":{"rooms":[]},"presence":{"not_types":["*"]}}`)
+
+// The v2 filter used by pollers which have just taken over processing room data from another device's
+// poller. This is used without a since token to catch up on rooms, so it includes rooms the user has left.
+var CatchUpPollerFilter = json.RawMessage(`{"room":{"include_leave":true,"timeline":{"limit":50},"state":{"lazy_load_members":false}},"presence":{"not_types":["*"]}}`)
+
+// FilterStore remembers which filters have been uploaded for each user.
+type FilterStore interface {
+	// FilterID returns the ID of the filter with this definition hash for this user, or "" if there isn't one.
+	FilterID(userID, filterHash string) (string, error)
+	StoreFilterID(userID, filterHash, filterID string) error
+}
+
+// PollerLeaser ensures that only 1 poller runs per device, and only 1 poller per user processes room data,
+// across all proxy instances sharing a database.
+type PollerLeaser interface {
+	// AcquireLease takes or renews the lease to poll for this device. Returns false if another instance
+	// holds the lease, along with when the current lease expires.
+	AcquireLease(deviceID string) (acquired bool, expiresAt time.Time, err error)
+	// AcquireRoomLease takes or renews the lease to process room data for this user for this device.
+	// Returns false if another device holds the lease, along with the device which held the lease before,
+	// or "" if no device has.
+	AcquireRoomLease(userID, deviceID string) (acquired bool, prevDeviceID string, err error)
+	// ReleaseLease gives up the lease to poll for this device, along with the lease to process room data
+	// if this device holds it.
+	ReleaseLease(deviceID string) error
+}
+
 // V2DataReceiver is the receiver for all the v2 sync data the poller gets
 type V2DataReceiver interface {
+	// Begin applying a v2 response. Everything in the response is applied via the returned V2DataTxn so
+	// the response is either applied in full or not at all.
+	Begin() (V2DataTxn, error)
+	// Called when the homeserver rejects the access token for this device. The poll loop is terminated.
+	OnInvalidToken(deviceID string)
+}
+
+// V2DataTxn applies the data from a single v2 response. Nothing is visible until Commit is called. If any
+// function returns an error, the poller calls Rollback and retries the response with the same since token.
+type V2DataTxn interface {
 	UpdateDeviceSince(deviceID, since string) error
-	Accumulate(roomID string, timeline []json.RawMessage) error
-	Initialise(roomID string, state []json.RawMessage) error
-	SetTyping(roomID string, userIDs []string) (int64, error)
-	// Add messages for this device. If an error is returned, the poll loop is terminated as continuing
-	// would implicitly acknowledge these messages.
+	// Store new timeline events. `prevBatch` is only set if the timeline was limited, meaning there may
+	// be a gap between the previous events and this timeline.
+	Accumulate(roomID, prevBatch string, timeline []json.RawMessage) error
+	// Store the state of the room at the start of `timeline`. If the room is already known, the current
+	// state is replaced with any state events which differ, e.g after a gap or a state resolution change.
+	Initialise(roomID string, state, timeline []json.RawMessage) error
+	// Replace the typing users in this room as seen by `userID`.
+	SetTyping(roomID, userID string, userIDs []string) (int64, error)
 	AddToDeviceMessages(userID, deviceID string, msgs []gomatrixserverlib.SendToDeviceEvent) error
-
-	UpdateUnreadCounts(roomID, userID string, highlightCount, notifCount *int)
+	// Set the unread counts for `userID` in this room. Counts which are nil are left unchanged.
+	UpdateUnreadCounts(roomID, userID string, highlightCount, notifCount, unreadCount *int) error
+	Commit() error
+	Rollback()
 }
 
 // PollerMap is a map of device ID to Poller
 type PollerMap struct {
 	v2Client  Client
 	callbacks V2DataReceiver
+	leaser    PollerLeaser // may be nil if this is the only instance
+	filters   FilterStore  // may be nil, in which case filters are uploaded every time a poller starts
+	breaker   *CircuitBreaker
 	pollerMu  *sync.Mutex
 	Pollers   map[string]*Poller // device_id -> poller
+	// device_id -> when the lease held by another instance expires
+	remoteLeases map[string]time.Time
+	// device_id -> when the device was first seen with no v3 connections
+	idleSince map[string]time.Time
+	// user_id -> device_id of the poller processing room data for this user. Only used without a leaser.
+	roomPollers map[string]string
+	// user_id -> closed when room data for this user has been stored
+	roomsSynced map[string]chan struct{}
 }
 
-func NewPollerMap(v2Client Client, callbacks V2DataReceiver) *PollerMap {
+func NewPollerMap(v2Client Client, callbacks V2DataReceiver, leaser PollerLeaser, filters FilterStore) *PollerMap {
 	return &PollerMap{
-		v2Client:  v2Client,
-		callbacks: callbacks,
-		pollerMu:  &sync.Mutex{},
-		Pollers:   make(map[string]*Poller),
+		v2Client:     v2Client,
+		callbacks:    callbacks,
+		leaser:       leaser,
+		filters:      filters,
+		breaker:      NewCircuitBreaker(),
+		pollerMu:     &sync.Mutex{},
+		Pollers:      make(map[string]*Poller),
+		remoteLeases: make(map[string]time.Time),
+		idleSince:    make(map[string]time.Time),
+		roomPollers:  make(map[string]string),
+		roomsSynced:  make(map[string]chan struct{}),
 	}
 }
 
+// Degraded returns true if the upstream homeserver is down, meaning pollers are paused.
+func (h *PollerMap) Degraded() bool {
+	return h.breaker.IsOpen()
+}
+
+// NeedsPolling returns true if there is no poller running for this device, either on this instance
+// or on another instance which holds an unexpired lease for it.
+func (h *PollerMap) NeedsPolling(deviceID string) bool {
+	h.pollerMu.Lock()
+	defer h.pollerMu.Unlock()
+	poller, ok := h.Pollers[deviceID]
+	if ok && poller.isRunning() {
+		return false
+	}
+	expiresAt, ok := h.remoteLeases[deviceID]
+	return !ok || time.Now().After(expiresAt)
+}
+
 // EnsurePolling makes sure there is a poller for this device, making one if need be.
-// Blocks until at least 1 sync is done if and only if the poller was just created.
-// This ensures that calls to the database will return data.
-// Guarantees only 1 poller will be running per deviceID.
+// Blocks until at least 1 sync is done and room data for this user has been stored (possibly by another
+// device's poller) if and only if the poller was just created without a since token, or until the poller
+// terminates. This ensures that calls to the database will return data.
+// If there is a since token, the database already has data for this device so this doesn't block.
+// Guarantees only 1 poller will be running per deviceID. If there is a PollerLeaser, this is guaranteed
+// across all instances: if another instance holds the lease for this device this function returns
+// immediately, as that instance is responsible for polling.
 func (h *PollerMap) EnsurePolling(authHeader, userID, deviceID, v2since string, logger zerolog.Logger) {
 	h.pollerMu.Lock()
 	poller, ok := h.Pollers[deviceID]
-	// a poller exists and hasn't been terminated so we don't need to do anything
-	if ok && !poller.Terminated {
+	// a poller exists and hasn't been terminated so we don't need to do anything. If it was stopping
+	// because the device was idle, keep it going.
+	if ok && poller.resume() {
+		delete(h.idleSince, deviceID)
 		h.pollerMu.Unlock()
 		return
 	}
+	if h.leaser != nil {
+		acquired, expiresAt, err := h.leaser.AcquireLease(deviceID)
+		if err != nil {
+			h.pollerMu.Unlock()
+			logger.Err(err).Str("device", deviceID).Msg("EnsurePolling: failed to acquire poller lease")
+			return
+		}
+		if !acquired {
+			h.remoteLeases[deviceID] = expiresAt
+			h.pollerMu.Unlock()
+			logger.Info().Str("device", deviceID).Time("expires_at", expiresAt).Msg(
+				"EnsurePolling: another instance is polling for this device",
+			)
+			return
+		}
+		delete(h.remoteLeases, deviceID)
+	}
 	// replace the poller
 	poller = NewPoller(userID, authHeader, deviceID, h.v2Client, h.callbacks, logger)
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go poller.Poll(v2since, func() {
-		wg.Done()
-	})
+	poller.leaser = h.leaser
+	poller.filters = h.filters
+	poller.breaker = h.breaker
+	poller.electRoomPoller = func() (bool, bool, error) {
+		return h.electRoomPoller(userID, deviceID)
+	}
+	poller.onRoomsSynced = func() {
+		h.markRoomsSynced(userID)
+	}
+	synced := make(chan struct{})
+	done := make(chan struct{})
+	var once sync.Once
+	go func() {
+		poller.Poll(v2since, func() {
+			once.Do(func() { close(synced) })
+		})
+		// the poller terminated, possibly without ever syncing successfully e.g due to an invalid token,
+		// so stop waiting for it.
+		close(done)
+	}()
+	roomsSynced := h.roomsSyncedChan(userID)
 	h.Pollers[deviceID] = poller
+	delete(h.idleSince, deviceID)
 	h.pollerMu.Unlock()
-	wg.Wait()
+	if v2since == "" {
+		select {
+		case <-synced:
+		case <-done:
+		}
+		select {
+		case <-roomsSynced:
+		case <-done:
+		}
+	}
+}
+
+// roomsSyncedChan returns the channel which is closed when room data for this user has been stored.
+// Must be called with pollerMu held.
+func (h *PollerMap) roomsSyncedChan(userID string) chan struct{} {
+	ch, ok := h.roomsSynced[userID]
+	if !ok {
+		ch = make(chan struct{})
+		h.roomsSynced[userID] = ch
+	}
+	return ch
+}
+
+func (h *PollerMap) markRoomsSynced(userID string) {
+	h.pollerMu.Lock()
+	defer h.pollerMu.Unlock()
+	ch := h.roomsSyncedChan(userID)
+	select {
+	case <-ch:
+	default:
+		close(ch)
+	}
+}
+
+// StopIdlePollers stops pollers for devices which have had no v3 connections for PollerIdleTimeout.
+// This should be called periodically. hasConns returns true if the device has v3 connections.
+// Returns the number of pollers stopped.
+func (h *PollerMap) StopIdlePollers(hasConns func(deviceID string) bool) int {
+	if PollerIdleTimeout == 0 {
+		return 0
+	}
+	h.pollerMu.Lock()
+	defer h.pollerMu.Unlock()
+	now := time.Now()
+	numStopped := 0
+	for deviceID, poller := range h.Pollers {
+		if !poller.isRunning() {
+			// already stopped or terminated, forget about it
+			if poller.isTerminated() {
+				delete(h.Pollers, deviceID)
+				delete(h.idleSince, deviceID)
+			}
+			continue
+		}
+		if hasConns(deviceID) {
+			delete(h.idleSince, deviceID)
+			continue
+		}
+		idleSince, ok := h.idleSince[deviceID]
+		if !ok {
+			h.idleSince[deviceID] = now
+			continue
+		}
+		if now.Sub(idleSince) >= PollerIdleTimeout {
+			poller.Stop()
+			delete(h.idleSince, deviceID)
+			numStopped++
+		}
+	}
+	return numStopped
+}
+
+// isPolling returns true if a poller is running for this device on this instance.
+func (h *PollerMap) isPolling(deviceID string) bool {
+	h.pollerMu.Lock()
+	defer h.pollerMu.Unlock()
+	poller := h.Pollers[deviceID]
+	return poller != nil && poller.isRunning()
+}
+
+// electRoomPoller returns true if the poller for this device should process room data for this user.
+// Every device for a user sees the same rooms, so only 1 poller per user processes them. If the elected
+// poller stops running, the next poller to ask is elected instead. `takeover` is true if this device was
+// elected in place of another device, as this device's since token has not included room data so the
+// poller needs to catch up on rooms.
+//
+// If there is a PollerLeaser the election is shared by all instances, and the first election for a user is
+// treated as a takeover as it may be replacing an election made by an older version. Otherwise elections
+// are per instance, and elections made before this instance started are unknown, so a takeover from them
+// can't be detected.
+func (h *PollerMap) electRoomPoller(userID, deviceID string) (elected, takeover bool, err error) {
+	if h.leaser != nil {
+		acquired, prevDeviceID, err := h.leaser.AcquireRoomLease(userID, deviceID)
+		if err != nil {
+			return false, false, err
+		}
+		if !acquired && !h.isPolling(prevDeviceID) {
+			// room data is processed by a poller on another instance, which has already stored it, so
+			// don't make new pollers for this user wait for a poller on this instance to store it.
+			h.markRoomsSynced(userID)
+		}
+		return acquired, acquired && prevDeviceID != deviceID, nil
+	}
+	h.pollerMu.Lock()
+	defer h.pollerMu.Unlock()
+	prevDeviceID, ok := h.roomPollers[userID]
+	if ok && prevDeviceID != deviceID {
+		if poller := h.Pollers[prevDeviceID]; poller != nil && poller.isRunning() {
+			return false, false, nil
+		}
+	}
+	h.roomPollers[userID] = deviceID
+	return true, ok && prevDeviceID != deviceID, nil
 }
 
 // Poller can automatically poll the sync v2 endpoint and accumulate the responses in storage
@@ -76,9 +336,24 @@ type Poller struct {
 	client              Client
 	receiver            V2DataReceiver
 	logger              zerolog.Logger
+	leaser              PollerLeaser    // may be nil
+	filters             FilterStore     // may be nil
+	breaker             *CircuitBreaker // may be nil
+	// returns true if this poller should process room data, and whether it has just taken over from another
+	// poller. May be nil, in which case it always processes room data.
+	electRoomPoller func() (elected, takeover bool, err error)
+	// called when this poller has stored room data, or is processing room data from a since token which
+	// means room data was stored previously. May be nil.
+	onRoomsSynced func()
+	// filter definition -> filter ID, or the definition itself if it should be sent inline
+	filterIDs map[string]string
 
 	// flag set to true when poll() returns due to expired access tokens
 	Terminated bool
+
+	// set when the poller should stop at the start of the next loop. Guarded by mu.
+	stopped bool
+	mu      *sync.Mutex
 }
 
 func NewPoller(userID, authHeader, deviceID string, client Client, receiver V2DataReceiver, logger zerolog.Logger) *Poller {
@@ -90,49 +365,191 @@ func NewPoller(userID, authHeader, deviceID string, client Client, receiver V2Da
 		receiver:            receiver,
 		Terminated:          false,
 		logger:              logger,
+		mu:                  &sync.Mutex{},
+		filterIDs:           make(map[string]string),
 	}
 }
 
+// Stop the poller before it makes its next v2 sync request. The current request, if any, is processed
+// first so its since token is persisted.
+func (p *Poller) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopped = true
+}
+
+// resume a stopped poller if it hasn't terminated yet. Returns false if the poller has terminated.
+func (p *Poller) resume() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.Terminated {
+		return false
+	}
+	p.stopped = false
+	return true
+}
+
+// isRunning returns true if the poller hasn't terminated and hasn't been told to stop.
+func (p *Poller) isRunning() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !p.Terminated && !p.stopped
+}
+
+func (p *Poller) isTerminated() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.Terminated
+}
+
+// terminate marks the poller as terminated. Call this before Poll returns.
+func (p *Poller) terminate() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Terminated = true
+}
+
+// terminateIfStopped terminates the poller if it has been told to stop. Returns true if terminated.
+func (p *Poller) terminateIfStopped() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		p.Terminated = true
+	}
+	return p.stopped
+}
+
 // Poll will block forever, repeatedly calling v2 sync. Do this in a goroutine.
-// Returns if the access token gets invalidated or if there was a fatal error processing v2 resposnes.
+// Returns if the access token gets invalidated, if there was a fatal error processing v2 resposnes or if
+// the poller is stopped.
 // Invokes the callback on first success.
 func (p *Poller) Poll(since string, callback func()) {
 	p.logger.Info().Str("since", since).Msg("Poller: v2 poll loop started")
+	if p.leaser != nil {
+		defer func() {
+			if err := p.leaser.ReleaseLease(p.deviceID); err != nil {
+				p.logger.Warn().Err(err).Msg("Poller: failed to release lease")
+			}
+		}()
+	}
 	failCount := 0
 	firstTime := true
+	isRoomPoller := false
+	// set when this poller has taken over processing room data from another poller
+	needsCatchUp := false
 	for {
 		if failCount > 0 {
-			waitTime := time.Duration(math.Pow(2, float64(failCount))) * time.Second
+			waitTime := backoffDuration(failCount)
 			p.logger.Warn().Str("duration", waitTime.String()).Msg("Poller: waiting before next poll")
 			timeSleep(waitTime)
 		}
-		resp, statusCode, err := p.client.DoSyncV2(p.authorizationHeader, since)
+		if p.terminateIfStopped() {
+			p.logger.Info().Str("since", since).Msg("Poller: device is idle, terminating loop")
+			return
+		}
+		if p.breaker != nil {
+			// This can block for a long time whilst the upstream is down, so leases are renewed afterwards.
+			// If we are let through we must report the result of our request, or cancel if we don't make one.
+			p.breaker.Wait()
+		}
+		// this is done even if the lease was just acquired when the poller was made, as we may have waited
+		if p.leaser != nil {
+			acquired, _, err := p.leaser.AcquireLease(p.deviceID)
+			if err != nil {
+				// non-fatal, we'll try again next time
+				p.logger.Warn().Err(err).Msg("Poller: failed to renew lease")
+			} else if !acquired {
+				p.logger.Warn().Msg("Poller: lease was taken by another instance, terminating loop")
+				if p.breaker != nil {
+					p.breaker.Cancel()
+				}
+				p.terminate()
+				return
+			}
+		}
+		// decide whether to process room data before making the request, as it determines the filter
+		wasRoomPoller := isRoomPoller
+		if p.electRoomPoller == nil {
+			isRoomPoller = true
+		} else if elected, takeover, err := p.electRoomPoller(); err != nil {
+			// non-fatal, keep processing what we were processing and try again next time
+			p.logger.Warn().Err(err).Msg("Poller: failed to renew room data lease")
+		} else {
+			isRoomPoller = elected
+			// a request without a since token already returns the latest events in every room
+			needsCatchUp = elected && (needsCatchUp || (takeover && since != ""))
+		}
+		if isRoomPoller != wasRoomPoller {
+			p.logger.Info().Bool("room_poller", isRoomPoller).Msg("Poller: room data processing changed")
+		}
+		if isRoomPoller && since != "" && p.onRoomsSynced != nil {
+			p.onRoomsSynced()
+		}
+		// Our since token has never included room data if we took over from another poller, so there may be
+		// room events we've never seen. Catch up with a request without a since token, which returns the
+		// latest events in every room: timelines with a gap before them are limited, so the gap is recorded.
+		// There's nothing to catch up on if we don't have a since token either.
+		catchingUp := needsCatchUp && since != ""
+		reqSince := since
+		filterDef := DevicePollerFilter
+		if catchingUp {
+			reqSince = ""
+			filterDef = CatchUpPollerFilter
+		} else if isRoomPoller {
+			filterDef = PollerFilter
+		}
+		filter := p.filter(filterDef)
+		resp, statusCode, err := p.client.DoSyncV2(p.authorizationHeader, reqSince, filter)
+		if p.breaker != nil {
+			if err != nil && isUpstreamDown(statusCode) {
+				p.breaker.Failure()
+			} else {
+				p.breaker.Success()
+			}
+		}
 		if err != nil {
 			// check if temporary
-			if statusCode != 401 {
+			if statusCode == 400 && filter != string(filterDef) {
+				// the filter ID may no longer be valid, so send the filter inline instead
+				p.logger.Warn().Str("filter", filter).Err(err).Msg("Poller: sync v2 poll rejected the filter ID, using an inline filter")
+				p.filterIDs[string(filterDef)] = string(filterDef)
+				failCount += 1
+				continue
+			} else if statusCode != 401 {
 				p.logger.Warn().Int("code", statusCode).Err(err).Msg("Poller: sync v2 poll returned temporary error")
 				failCount += 1
 				continue
 			} else {
 				p.logger.Warn().Msg("Poller: access token has been invalidated, terminating loop")
-				p.Terminated = true
+				p.terminate()
+				p.receiver.OnInvalidToken(p.deviceID)
 				return
 			}
 		}
+		if catchingUp {
+			// only store room data: to-device messages and the since token belong to our own sync stream,
+			// which carries on from our since token.
+			if err = p.applyRooms(resp); err != nil {
+				p.logger.Err(err).Msg("Poller: V2DataReceiver failed to store rooms when catching up, retrying")
+				failCount += 1
+				continue
+			}
+			p.logger.Info().Msg("Poller: caught up on rooms after taking over room data processing")
+			failCount = 0
+			needsCatchUp = false
+			continue
+		}
+		if err = p.applyResponse(resp, isRoomPoller, since == ""); err != nil {
+			// nothing was stored, so retry this response with the same since token
+			p.logger.Err(err).Str("since", since).Msg("Poller: V2DataReceiver failed to store response, retrying")
+			failCount += 1
+			continue
+		}
 		failCount = 0
-		p.parseRoomsResponse(resp)
-		if err = p.parseToDeviceMessages(resp); err != nil {
-			p.logger.Err(err).Str("since", since).Msg("Poller: V2DataReceiver failed to persist to-device messages. Terminating loop.")
-			p.Terminated = true
-			return
+		if isRoomPoller && p.onRoomsSynced != nil {
+			p.onRoomsSynced()
 		}
 		since = resp.NextBatch
-		// persist the since token (TODO: this could get slow if we hammer the DB too much)
-		err = p.receiver.UpdateDeviceSince(p.deviceID, since)
-		if err != nil {
-			// non-fatal
-			p.logger.Warn().Str("since", since).Err(err).Msg("Poller: V2DataReceiver failed to persist new since value")
-		}
 
 		if firstTime {
 			firstTime = false
@@ -141,71 +558,321 @@ func (p *Poller) Poll(since string, callback func()) {
 	}
 }
 
-func (p *Poller) parseToDeviceMessages(res *SyncResponse) error {
+// filter returns the ID of this filter definition for this user, uploading it if it hasn't been uploaded
+// before. If the filter can't be uploaded the definition is returned, to be sent inline.
+func (p *Poller) filter(filterDef json.RawMessage) string {
+	if len(filterDef) == 0 {
+		return ""
+	}
+	if filterID, ok := p.filterIDs[string(filterDef)]; ok {
+		return filterID
+	}
+	filterID := p.loadFilterID(filterDef)
+	p.filterIDs[string(filterDef)] = filterID
+	return filterID
+}
+
+func (p *Poller) loadFilterID(filterDef json.RawMessage) string {
+	if p.userID == "" {
+		// filters are uploaded per user
+		return string(filterDef)
+	}
+	hash := filterHash(filterDef)
+	if p.filters != nil {
+		filterID, err := p.filters.FilterID(p.userID, hash)
+		if err != nil {
+			p.logger.Warn().Err(err).Msg("Poller: failed to load filter ID")
+		} else if filterID != "" {
+			return filterID
+		}
+	}
+	filterID, err := p.client.CreateFilter(p.authorizationHeader, p.userID, filterDef)
+	if err != nil {
+		p.logger.Warn().Err(err).Msg("Poller: failed to upload filter, using an inline filter")
+		return string(filterDef)
+	}
+	if p.filters != nil {
+		if err = p.filters.StoreFilterID(p.userID, hash, filterID); err != nil {
+			// non-fatal, we'll upload it again next time
+			p.logger.Warn().Err(err).Msg("Poller: failed to store filter ID")
+		}
+	}
+	return filterID
+}
+
+// filterHash returns a hash of the filter definition, so filters are re-uploaded when the definition changes.
+func filterHash(filter json.RawMessage) string {
+	hash := sha256.Sum256(filter)
+	return hex.EncodeToString(hash[:])
+}
+
+// applyResponse stores everything in this response, including the next since token, in a single
+// transaction. If an error is returned, the since token was not stored.
+//
+// Initial syncs can contain thousands of rooms, so their rooms are stored concurrently, each in its own
+// transaction, before storing the rest of the response. If any room fails, the whole response is retried.
+// This is safe because storing room data is idempotent: events which have already been stored are ignored.
+func (p *Poller) applyResponse(res *SyncResponse, isRoomPoller, isInitial bool) error {
+	if isRoomPoller && isInitial && InitialSyncWorkers > 1 {
+		if err := p.parseRoomsConcurrently(res); err != nil {
+			return err
+		}
+		isRoomPoller = false // already stored
+	}
+	return p.inTxn(func(txn V2DataTxn) error {
+		return p.parseResponse(txn, res, isRoomPoller)
+	})
+}
+
+// applyRooms stores only the room data in this response, with each room in its own transaction if
+// InitialSyncWorkers allows it.
+func (p *Poller) applyRooms(res *SyncResponse) error {
+	if InitialSyncWorkers > 1 {
+		return p.parseRoomsConcurrently(res)
+	}
+	return p.inTxn(func(txn V2DataTxn) error {
+		return p.parseRoomsResponse(txn, res)
+	})
+}
+
+// inTxn calls fn in a new transaction, committing it if fn succeeds and rolling it back otherwise.
+func (p *Poller) inTxn(fn func(txn V2DataTxn) error) error {
+	txn, err := p.receiver.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	if err = fn(txn); err != nil {
+		txn.Rollback()
+		return err
+	}
+	return txn.Commit()
+}
+
+func (p *Poller) parseResponse(txn V2DataTxn, res *SyncResponse, isRoomPoller bool) error {
+	if isRoomPoller {
+		if err := p.parseRoomsResponse(txn, res); err != nil {
+			return err
+		}
+	}
+	if err := p.parseToDeviceMessages(txn, res); err != nil {
+		return fmt.Errorf("failed to persist to-device messages: %w", err)
+	}
+	// the since token is stored in the same transaction, so we never skip data which failed to be stored.
+	if err := txn.UpdateDeviceSince(p.deviceID, res.NextBatch); err != nil {
+		return fmt.Errorf("failed to persist new since value: %w", err)
+	}
+	return nil
+}
+
+func (p *Poller) parseToDeviceMessages(txn V2DataTxn, res *SyncResponse) error {
 	if len(res.ToDevice.Events) == 0 {
 		return nil
 	}
-	return p.receiver.AddToDeviceMessages(p.userID, p.deviceID, res.ToDevice.Events)
+	return txn.AddToDeviceMessages(p.userID, p.deviceID, res.ToDevice.Events)
+}
+
+func (p *Poller) parseRoomsResponse(txn V2DataTxn, res *SyncResponse) error {
+	// rooms are processed in a consistent order so concurrent pollers take row locks in the same order,
+	// which makes deadlocks between their transactions less likely.
+	for _, parseRoom := range p.roomParsers(res) {
+		if err := parseRoom(txn); err != nil {
+			return err
+		}
+	}
+	p.logAccumulated(res)
+	return nil
+}
+
+// parseRoomsConcurrently stores each room in this response in its own transaction, using a bounded pool
+// of workers. Each room is only processed by 1 worker, so events within a room are stored in order.
+// Returns the first error encountered, after which no more rooms are started.
+func (p *Poller) parseRoomsConcurrently(res *SyncResponse) error {
+	parsers := p.roomParsers(res)
+	numWorkers := InitialSyncWorkers
+	if len(parsers) < numWorkers {
+		numWorkers = len(parsers)
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	ch := make(chan func(txn V2DataTxn) error)
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for parseRoom := range ch {
+				if err := p.inTxn(parseRoom); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, parseRoom := range parsers {
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+		ch <- parseRoom
+	}
+	close(ch)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	p.logAccumulated(res)
+	return nil
+}
+
+// roomParsers returns a function to store each room in this response, sorted by room ID.
+func (p *Poller) roomParsers(res *SyncResponse) []func(txn V2DataTxn) error {
+	joinedRoomIDs := make([]string, 0, len(res.Rooms.Join))
+	for roomID := range res.Rooms.Join {
+		joinedRoomIDs = append(joinedRoomIDs, roomID)
+	}
+	sort.Strings(joinedRoomIDs)
+	leftRoomIDs := make([]string, 0, len(res.Rooms.Leave))
+	for roomID := range res.Rooms.Leave {
+		leftRoomIDs = append(leftRoomIDs, roomID)
+	}
+	sort.Strings(leftRoomIDs)
+
+	parsers := make([]func(txn V2DataTxn) error, 0, len(joinedRoomIDs)+len(leftRoomIDs))
+	for _, roomID := range joinedRoomIDs {
+		roomID := roomID
+		roomData := res.Rooms.Join[roomID]
+		parsers = append(parsers, func(txn V2DataTxn) error {
+			return p.parseJoinedRoom(txn, roomID, roomData)
+		})
+	}
+	for _, roomID := range leftRoomIDs {
+		roomID := roomID
+		roomData := res.Rooms.Leave[roomID]
+		parsers = append(parsers, func(txn V2DataTxn) error {
+			return p.parseLeftRoom(txn, roomID, roomData)
+		})
+	}
+	return parsers
 }
 
-func (p *Poller) parseRoomsResponse(res *SyncResponse) {
+func (p *Poller) parseJoinedRoom(txn V2DataTxn, roomID string, roomData SyncV2JoinResponse) error {
+	// For limited timelines the state block is the state at the start of the timeline, so this must be
+	// stored before the timeline so current state is correct after the gap.
+	if len(roomData.State.Events) > 0 {
+		err := txn.Initialise(roomID, roomData.State.Events, roomData.Timeline.Events)
+		if err != nil {
+			return fmt.Errorf("Initialise failed for room %s with %d state events: %w", roomID, len(roomData.State.Events), err)
+		}
+	}
+	// process unread counts before events else we might push the event without including said event in the count
+	if roomData.UnreadNotifications.HighlightCount != nil || roomData.UnreadNotifications.NotificationCount != nil ||
+		roomData.UnreadCount != nil {
+		err := txn.UpdateUnreadCounts(
+			roomID, p.userID, roomData.UnreadNotifications.HighlightCount, roomData.UnreadNotifications.NotificationCount,
+			roomData.UnreadCount,
+		)
+		if err != nil {
+			return fmt.Errorf("UpdateUnreadCounts failed for room %s: %w", roomID, err)
+		}
+	}
+	if len(roomData.Timeline.Events) > 0 {
+		err := txn.Accumulate(roomID, limitedPrevBatch(roomData.Timeline.Limited, roomData.Timeline.PrevBatch), roomData.Timeline.Events)
+		if err != nil {
+			return fmt.Errorf("Accumulate failed for room %s with %d timeline events: %w", roomID, len(roomData.Timeline.Events), err)
+		}
+	}
+	for _, ephEvent := range roomData.Ephemeral.Events {
+		if gjson.GetBytes(ephEvent, "type").Str == "m.typing" {
+			userIDs, ok := typingUserIDs(ephEvent)
+			if !ok {
+				continue // malformed event
+			}
+			_, err := txn.SetTyping(roomID, p.userID, userIDs)
+			if err != nil {
+				return fmt.Errorf("SetTyping failed for room %s: %w", roomID, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *Poller) parseLeftRoom(txn V2DataTxn, roomID string, roomData SyncV2LeaveResponse) error {
+	// The state block is the state at the start of the timeline, as with joined rooms. If the user left
+	// during a gap, their leave event may only be in here. If this is the first time we've seen this room,
+	// this makes the initial snapshot.
+	if len(roomData.State.Events) > 0 {
+		err := txn.Initialise(roomID, roomData.State.Events, roomData.Timeline.Events)
+		if err != nil {
+			return fmt.Errorf("Initialise failed for left room %s with %d state events: %w", roomID, len(roomData.State.Events), err)
+		}
+	}
+	if len(roomData.Timeline.Events) > 0 {
+		err := txn.Accumulate(roomID, limitedPrevBatch(roomData.Timeline.Limited, roomData.Timeline.PrevBatch), roomData.Timeline.Events)
+		if err != nil {
+			return fmt.Errorf("Accumulate failed for left room %s with %d timeline events: %w", roomID, len(roomData.Timeline.Events), err)
+		}
+	}
+	return nil
+}
+
+func (p *Poller) logAccumulated(res *SyncResponse) {
 	stateCalls := 0
 	timelineCalls := 0
 	typingCalls := 0
-	for roomID, roomData := range res.Rooms.Join {
+	for _, roomData := range res.Rooms.Leave {
 		if len(roomData.State.Events) > 0 {
 			stateCalls++
-			err := p.receiver.Initialise(roomID, roomData.State.Events)
-			if err != nil {
-				p.logger.Err(err).Str("room_id", roomID).Int("num_state_events", len(roomData.State.Events)).Msg("Poller: V2DataReceiver.Initialise failed")
-			}
 		}
-		// process unread counts before events else we might push the event without including said event in the count
-		if roomData.UnreadNotifications.HighlightCount != nil || roomData.UnreadNotifications.NotificationCount != nil {
-			p.receiver.UpdateUnreadCounts(
-				roomID, p.userID, roomData.UnreadNotifications.HighlightCount, roomData.UnreadNotifications.NotificationCount,
-			)
+		if len(roomData.Timeline.Events) > 0 {
+			timelineCalls++
+		}
+	}
+	for _, roomData := range res.Rooms.Join {
+		if len(roomData.State.Events) > 0 {
+			stateCalls++
 		}
 		if len(roomData.Timeline.Events) > 0 {
 			timelineCalls++
-			err := p.receiver.Accumulate(roomID, roomData.Timeline.Events)
-			if err != nil {
-				p.logger.Err(err).Str("room_id", roomID).Int("num_timeline_events", len(roomData.Timeline.Events)).Msg("Poller: V2DataReceiver.Accumulate failed")
-			}
 		}
 		for _, ephEvent := range roomData.Ephemeral.Events {
 			if gjson.GetBytes(ephEvent, "type").Str == "m.typing" {
-				users := gjson.GetBytes(ephEvent, "content.user_ids")
-				if !users.IsArray() {
-					continue // malformed event
-				}
-				var userIDs []string
-				for _, u := range users.Array() {
-					if u.Str != "" {
-						userIDs = append(userIDs, u.Str)
-					}
-				}
-				typingCalls++
-				_, err := p.receiver.SetTyping(roomID, userIDs)
-				if err != nil {
-					p.logger.Err(err).Str("room_id", roomID).Strs("user_ids", userIDs).Msg("Poller: V2DataReceiver failed to SetTyping")
+				if _, ok := typingUserIDs(ephEvent); ok {
+					typingCalls++
 				}
 			}
 		}
 	}
-	for roomID, roomData := range res.Rooms.Leave {
-		// TODO: do we care about state?
-
-		if len(roomData.Timeline.Events) > 0 {
-			err := p.receiver.Accumulate(roomID, roomData.Timeline.Events)
-			if err != nil {
-				p.logger.Err(err).Str("room_id", roomID).Int("num_timeline_events", len(roomData.Timeline.Events)).Msg("Poller: V2DataReceiver.Accumulate left room failed")
-			}
-		}
-	}
 	p.logger.Info().Ints(
 		"rooms [invite,join,leave]", []int{len(res.Rooms.Invite), len(res.Rooms.Join), len(res.Rooms.Leave)},
 	).Ints(
 		"storage [states,timelines,typing]", []int{stateCalls, timelineCalls, typingCalls},
 	).Msg("Poller: accumulated data")
 }
+
+// typingUserIDs returns the users in this m.typing event, or false if the event is malformed.
+func typingUserIDs(ephEvent json.RawMessage) ([]string, bool) {
+	users := gjson.GetBytes(ephEvent, "content.user_ids")
+	if !users.IsArray() {
+		return nil, false
+	}
+	var userIDs []string
+	for _, u := range users.Array() {
+		if u.Str != "" {
+			userIDs = append(userIDs, u.Str)
+		}
+	}
+	return userIDs, true
+}
+
+// limitedPrevBatch returns the prev_batch token if the timeline was limited, else "".
+func limitedPrevBatch(limited bool, prevBatch string) string {
+	if !limited {
+		return ""
+	}
+	return prevBatch
+}
@@ -3,7 +3,9 @@ package sync2
 import (
 	"encoding/json"
 	"fmt"
+	"math/rand"
 	"os"
+	"reflect"
 	"strconv"
 	"sync"
 	"testing"
@@ -64,6 +66,275 @@ func TestPollerPollFromNothing(t *testing.T) {
 	}
 }
 
+// Check that the receiver is told about invalid tokens, and that EnsurePolling doesn't block forever
+// waiting for a successful sync which will never happen.
+func TestPollerMapInvalidToken(t *testing.T) {
+	deviceID := "FOOBAR"
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		return nil, 401, fmt.Errorf("unknown token")
+	})
+	pm := NewPollerMap(client, accumulator, nil, nil)
+	done := make(chan struct{})
+	go func() {
+		pm.EnsurePolling("Authorization: hello world", "@alice:localhost", deviceID, "", zerolog.New(os.Stderr))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("EnsurePolling did not return")
+	}
+	if len(accumulator.invalidTokens) != 1 || accumulator.invalidTokens[0] != deviceID {
+		t.Errorf("OnInvalidToken: got %v want [%s]", accumulator.invalidTokens, deviceID)
+	}
+	if !pm.NeedsPolling(deviceID) {
+		t.Errorf("NeedsPolling returned false for a terminated poller")
+	}
+}
+
+// Check that the prev_batch token is only passed to the receiver for limited timelines.
+func TestPollerLimitedTimeline(t *testing.T) {
+	limitedRoomID := "!limited:bar"
+	roomID := "!foo:bar"
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		if since != "" {
+			return nil, 401, fmt.Errorf("terminated")
+		}
+		var limitedResp, resp SyncV2JoinResponse
+		limitedResp.State.Events = []json.RawMessage{json.RawMessage(`{"event":1}`)}
+		limitedResp.Timeline.Events = []json.RawMessage{json.RawMessage(`{"event":2}`)}
+		limitedResp.Timeline.Limited = true
+		limitedResp.Timeline.PrevBatch = "limited_prev_batch"
+		resp.Timeline.Events = []json.RawMessage{json.RawMessage(`{"event":3}`)}
+		resp.Timeline.PrevBatch = "prev_batch"
+		return &SyncResponse{
+			NextBatch: "next",
+			Rooms: struct {
+				Join   map[string]SyncV2JoinResponse   `json:"join"`
+				Invite map[string]SyncV2InviteResponse `json:"invite"`
+				Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
+			}{
+				Join: map[string]SyncV2JoinResponse{
+					limitedRoomID: limitedResp,
+					roomID:        resp,
+				},
+			},
+		}, 200, nil
+	})
+	poller := NewPoller("@alice:localhost", "Authorization: hello world", "FOOBAR", client, accumulator, zerolog.New(os.Stderr))
+	poller.Poll("", func() {})
+	if len(accumulator.states[limitedRoomID]) != 1 {
+		t.Errorf("did not store state for limited timeline, got %d events want 1", len(accumulator.states[limitedRoomID]))
+	}
+	if got := accumulator.prevBatches[limitedRoomID]; len(got) != 1 || got[0] != "limited_prev_batch" {
+		t.Errorf("limited timeline: got prev_batch %v want [limited_prev_batch]", got)
+	}
+	if got := accumulator.prevBatches[roomID]; len(got) != 1 || got[0] != "" {
+		t.Errorf("non-limited timeline: got prev_batch %v want []", got)
+	}
+}
+
+// Check that the state of left rooms is stored, so a leave during a gap is recorded.
+func TestPollerLeftRoom(t *testing.T) {
+	roomID := "!left:bar"
+	leaveEvent := json.RawMessage(`{"type":"m.room.member","state_key":"@alice:localhost","content":{"membership":"leave"}}`)
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		if since != "" {
+			return nil, 401, fmt.Errorf("terminated")
+		}
+		var resp SyncV2LeaveResponse
+		resp.State.Events = []json.RawMessage{leaveEvent}
+		resp.Timeline.Events = []json.RawMessage{json.RawMessage(`{"event":1}`)}
+		resp.Timeline.Limited = true
+		resp.Timeline.PrevBatch = "prev_batch"
+		return &SyncResponse{
+			NextBatch: "next",
+			Rooms: struct {
+				Join   map[string]SyncV2JoinResponse   `json:"join"`
+				Invite map[string]SyncV2InviteResponse `json:"invite"`
+				Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
+			}{
+				Leave: map[string]SyncV2LeaveResponse{
+					roomID: resp,
+				},
+			},
+		}, 200, nil
+	})
+	poller := NewPoller("@alice:localhost", "Authorization: hello world", "FOOBAR", client, accumulator, zerolog.New(os.Stderr))
+	poller.Poll("", func() {})
+	if got := accumulator.states[roomID]; len(got) != 1 || string(got[0]) != string(leaveEvent) {
+		t.Errorf("left room: got state %v want [%s]", got, leaveEvent)
+	}
+	if got := accumulator.prevBatches[roomID]; len(got) != 1 || got[0] != "prev_batch" {
+		t.Errorf("left room: got prev_batch %v want [prev_batch]", got)
+	}
+}
+
+// Check that if storing any room in a response fails, nothing in the response is stored and the same
+// since token is retried.
+func TestPollerRetriesFailedResponse(t *testing.T) {
+	deviceID := "FOOBAR"
+	roomA := "!a:bar"
+	roomB := "!b:bar"
+	var sinces []string
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		sinces = append(sinces, since)
+		if since == "next" {
+			return nil, 401, fmt.Errorf("terminated")
+		}
+		var respA, respB SyncV2JoinResponse
+		respA.State.Events = []json.RawMessage{json.RawMessage(`{"event":1}`)}
+		respA.Timeline.Events = []json.RawMessage{json.RawMessage(`{"event":2}`)}
+		respB.Timeline.Events = []json.RawMessage{json.RawMessage(`{"event":3}`)}
+		return &SyncResponse{
+			NextBatch: "next",
+			Rooms: struct {
+				Join   map[string]SyncV2JoinResponse   `json:"join"`
+				Invite map[string]SyncV2InviteResponse `json:"invite"`
+				Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
+			}{
+				Join: map[string]SyncV2JoinResponse{
+					roomA: respA,
+					roomB: respB,
+				},
+			},
+		}, 200, nil
+	})
+	// rooms are processed in order, so room A is accumulated before room B fails
+	accumulator.accumulateErrs = map[string]int{roomB: 2}
+	timeSleep = func(d time.Duration) {}
+	defer func() {
+		timeSleep = time.Sleep
+	}()
+	poller := NewPoller("@alice:localhost", "Authorization: hello world", deviceID, client, accumulator, zerolog.New(os.Stderr))
+	poller.Poll("prev", func() {})
+
+	wantSinces := []string{"prev", "prev", "prev", "next"}
+	if !reflect.DeepEqual(sinces, wantSinces) {
+		t.Errorf("DoSyncV2: got since tokens %v want %v", sinces, wantSinces)
+	}
+	if accumulator.numRollbacks != 2 {
+		t.Errorf("got %d rollbacks want 2", accumulator.numRollbacks)
+	}
+	// the response is only stored once
+	if len(accumulator.states[roomA]) != 1 {
+		t.Errorf("room A: got %d state events want 1", len(accumulator.states[roomA]))
+	}
+	for _, roomID := range []string{roomA, roomB} {
+		if len(accumulator.timelines[roomID]) != 1 {
+			t.Errorf("%s: got %d timeline events want 1", roomID, len(accumulator.timelines[roomID]))
+		}
+	}
+	if got := accumulator.deviceIDToSince[deviceID]; got != "next" {
+		t.Errorf("got since %q want next", got)
+	}
+}
+
+// Check that rooms in an initial sync are stored concurrently with a bounded number of workers, and the
+// since token is only stored once every room has been stored.
+func TestPollerInitialSyncWorkers(t *testing.T) {
+	deviceID := "FOOBAR"
+	numRooms := 50
+	failingRoomID := "!room_7:bar"
+	var sinces []string
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		sinces = append(sinces, since)
+		if since != "" {
+			return nil, 401, fmt.Errorf("terminated")
+		}
+		join := make(map[string]SyncV2JoinResponse)
+		for i := 0; i < numRooms; i++ {
+			var resp SyncV2JoinResponse
+			resp.Timeline.Events = []json.RawMessage{
+				json.RawMessage(fmt.Sprintf(`{"event":%d}`, 2*i)),
+				json.RawMessage(fmt.Sprintf(`{"event":%d}`, 2*i+1)),
+			}
+			join[fmt.Sprintf("!room_%d:bar", i)] = resp
+		}
+		return &SyncResponse{
+			NextBatch: "next",
+			Rooms: struct {
+				Join   map[string]SyncV2JoinResponse   `json:"join"`
+				Invite map[string]SyncV2InviteResponse `json:"invite"`
+				Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
+			}{
+				Join: join,
+			},
+		}, 200, nil
+	})
+	accumulator.accumulateErrs = map[string]int{failingRoomID: 1}
+	oldWorkers := InitialSyncWorkers
+	InitialSyncWorkers = 4
+	timeSleep = func(d time.Duration) {}
+	defer func() {
+		InitialSyncWorkers = oldWorkers
+		timeSleep = time.Sleep
+	}()
+	poller := NewPoller("@alice:localhost", "Authorization: hello world", deviceID, client, accumulator, zerolog.New(os.Stderr))
+	poller.Poll("", func() {})
+
+	// the failed room means the initial sync is retried
+	wantSinces := []string{"", "", "next"}
+	if !reflect.DeepEqual(sinces, wantSinces) {
+		t.Errorf("DoSyncV2: got since tokens %v want %v", sinces, wantSinces)
+	}
+	if accumulator.maxTxns > InitialSyncWorkers {
+		t.Errorf("got %d concurrent transactions, want at most %d", accumulator.maxTxns, InitialSyncWorkers)
+	}
+	for i := 0; i < numRooms; i++ {
+		roomID := fmt.Sprintf("!room_%d:bar", i)
+		timeline := accumulator.timelines[roomID]
+		if len(timeline) == 0 {
+			t.Errorf("%s: timeline was not stored", roomID)
+			continue
+		}
+		// events within a room are stored in order
+		if string(timeline[0]) != fmt.Sprintf(`{"event":%d}`, 2*i) || string(timeline[1]) != fmt.Sprintf(`{"event":%d}`, 2*i+1) {
+			t.Errorf("%s: timeline out of order: %s", roomID, timeline)
+		}
+	}
+	if got := accumulator.deviceIDToSince[deviceID]; got != "next" {
+		t.Errorf("got since %q want next", got)
+	}
+}
+
+// Check that the filter is uploaded once per user and reused, and is sent inline if it can't be uploaded.
+func TestPollerFilter(t *testing.T) {
+	_, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		if since != "" {
+			return nil, 401, fmt.Errorf("terminated")
+		}
+		return &SyncResponse{NextBatch: "next"}, 200, nil
+	})
+	filters := &mockFilterStore{
+		filterIDs: make(map[string]string),
+	}
+	for i := 0; i < 2; i++ {
+		accumulator, _ := newMocks(nil)
+		poller := NewPoller("@alice:localhost", "Authorization: hello world", "FOOBAR", client, accumulator, zerolog.New(os.Stderr))
+		poller.filters = filters
+		poller.Poll("", func() {})
+	}
+	if client.numFilters != 1 {
+		t.Errorf("CreateFilter: got %d calls want 1", client.numFilters)
+	}
+	for i, filter := range client.filters {
+		if filter != "filter_1" {
+			t.Errorf("DoSyncV2 call %d: got filter %s want filter_1", i, filter)
+		}
+	}
+
+	client.filters = nil
+	client.createFilterErr = fmt.Errorf("failed to upload filter")
+	accumulator, _ := newMocks(nil)
+	poller := NewPoller("@bob:localhost", "Authorization: hello world", "FOOBAR", client, accumulator, zerolog.New(os.Stderr))
+	poller.filters = filters
+	poller.Poll("", func() {})
+	if len(client.filters) == 0 || client.filters[0] != string(PollerFilter) {
+		t.Errorf("DoSyncV2: got filters %v want inline filter %s", client.filters, string(PollerFilter))
+	}
+}
+
 // Check that a call to Poll starts polling with an existing since token and accumulates timeline entries
 func TestPollerPollFromExisting(t *testing.T) {
 	deviceID := "FOOBAR"
@@ -183,6 +454,13 @@ func TestPollerBackoff(t *testing.T) {
 		wantBackoffDuration = errorResponses[i].backoff
 		return nil, errorResponses[i].code, errorResponses[i].err
 	})
+	// always pick the maximum jitter so backoffs are deterministic
+	randInt63n = func(n int64) int64 {
+		return n - 1
+	}
+	defer func() {
+		randInt63n = rand.Int63n
+	}()
 	timeSleep = func(d time.Duration) {
 		if d != wantBackoffDuration {
 			t.Errorf("time.Sleep called incorrectly: got %v want %v", d, wantBackoffDuration)
@@ -208,43 +486,589 @@ func TestPollerBackoff(t *testing.T) {
 	}
 }
 
+// Tests that pollers are only started if the lease can be acquired, and terminate when the lease is lost.
+func TestPollerMapLeases(t *testing.T) {
+	deviceID := "FOOBAR"
+	leaser := &mockLeaser{
+		holder:    "other",
+		expiresAt: time.Now().Add(50 * time.Millisecond),
+	}
+	numPolls := 0
+	loseLease := make(chan struct{})
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		numPolls++
+		if numPolls == 2 {
+			// we've renewed our lease once, now lose it when the test tells us to
+			<-loseLease
+			leaser.mu.Lock()
+			leaser.holder = "other"
+			leaser.expiresAt = time.Now().Add(time.Hour)
+			leaser.mu.Unlock()
+		}
+		return &SyncResponse{
+			NextBatch: fmt.Sprintf("%d", numPolls),
+		}, 200, nil
+	})
+	pm := NewPollerMap(client, accumulator, leaser, nil)
+	// another instance holds the lease so we shouldn't poll
+	pm.EnsurePolling("Authorization: hello world", "@alice:localhost", deviceID, "", zerolog.New(os.Stderr))
+	if numPolls != 0 {
+		t.Fatalf("polled when another instance held the lease")
+	}
+	if pm.NeedsPolling(deviceID) {
+		t.Fatalf("NeedsPolling returned true when another instance holds an unexpired lease")
+	}
+	// the lease expires, so we should poll
+	time.Sleep(60 * time.Millisecond)
+	if !pm.NeedsPolling(deviceID) {
+		t.Fatalf("NeedsPolling returned false when the other instance's lease has expired")
+	}
+	pm.EnsurePolling("Authorization: hello world", "@alice:localhost", deviceID, "", zerolog.New(os.Stderr))
+	if pm.NeedsPolling(deviceID) {
+		t.Fatalf("NeedsPolling returned true when this instance is polling")
+	}
+	// we should lose the lease and terminate the poller
+	close(loseLease)
+	start := time.Now()
+	for !pm.NeedsPolling(deviceID) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("poller did not terminate after losing its lease")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if numPolls != 2 {
+		t.Errorf("got %d polls, want 2", numPolls)
+	}
+}
+
+// Tests that pollers check their lease after waiting for the circuit breaker, so they don't make a request
+// if another instance took the lease whilst they were waiting.
+func TestPollerLeaseLostWhilstBreakerOpen(t *testing.T) {
+	leaser := &mockLeaser{}
+	numPolls := 0
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		numPolls++
+		return &SyncResponse{NextBatch: "1"}, 200, nil
+	})
+	pm := NewPollerMap(client, accumulator, leaser, nil)
+	// open the circuit breaker
+	for i := 0; i < CircuitBreakerThreshold; i++ {
+		pm.breaker.Failure()
+	}
+	oldSleep := timeSleep
+	defer func() {
+		timeSleep = oldSleep
+	}()
+	// whilst the poller is waiting, the lease expires and is taken by another instance, then the upstream
+	// comes back so the poller is let through to probe it.
+	timeSleep = func(d time.Duration) {
+		leaser.mu.Lock()
+		leaser.holder = "other"
+		leaser.expiresAt = time.Now().Add(time.Hour)
+		leaser.mu.Unlock()
+		pm.breaker.mu.Lock()
+		pm.breaker.openUntil = time.Now()
+		pm.breaker.mu.Unlock()
+	}
+	pm.EnsurePolling("Authorization: hello world", "@alice:localhost", "FOOBAR", "since", zerolog.New(os.Stderr))
+	start := time.Now()
+	for {
+		pm.pollerMu.Lock()
+		terminated := pm.Pollers["FOOBAR"].isTerminated()
+		pm.pollerMu.Unlock()
+		if terminated {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatalf("poller did not terminate after losing its lease")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if numPolls != 0 {
+		t.Errorf("made %d requests after losing the lease", numPolls)
+	}
+	// the poller gave up its probe, so another poller can probe the upstream
+	pm.breaker.mu.Lock()
+	probing := pm.breaker.probing
+	pm.breaker.mu.Unlock()
+	if probing {
+		t.Errorf("circuit breaker is still waiting for the probe of a terminated poller")
+	}
+}
+
+// Tests that only 1 poller per user processes room data, and that another poller takes over when it stops,
+// catching up on the room data it missed.
+func TestPollerMapElectsRoomPoller(t *testing.T) {
+	roomID := "!foo:bar"
+	stopA := make(chan struct{})
+	nextB := make(chan struct{})
+	roomResponse := func(eventID, nextBatch string) *SyncResponse {
+		var joinResp SyncV2JoinResponse
+		joinResp.Timeline.Events = []json.RawMessage{
+			json.RawMessage(fmt.Sprintf(`{"event_id":"%s"}`, eventID)),
+		}
+		if nextBatch == "" {
+			// the catch up request, which has a gap before it
+			joinResp.Timeline.Limited = true
+			joinResp.Timeline.PrevBatch = "catch_up"
+		}
+		return &SyncResponse{
+			NextBatch: nextBatch,
+			Rooms: struct {
+				Join   map[string]SyncV2JoinResponse   `json:"join"`
+				Invite map[string]SyncV2InviteResponse `json:"invite"`
+				Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
+			}{
+				Join: map[string]SyncV2JoinResponse{
+					roomID: joinResp,
+				},
+			},
+		}
+	}
+	numInitialB := 0
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		switch authHeader + since {
+		case "A":
+			return roomResponse("$a1", "a1"), 200, nil
+		case "Aa1":
+			<-stopA
+			return &SyncResponse{NextBatch: "a2"}, 200, nil
+		case "B":
+			numInitialB++
+			if numInitialB > 1 {
+				return roomResponse("$b2", ""), 200, nil
+			}
+			return roomResponse("$b1", "b1"), 200, nil
+		case "Bb1":
+			<-nextB
+			return roomResponse("$b2", "b2"), 200, nil
+		case "Bb2":
+			return roomResponse("$b3", "b3"), 200, nil
+		}
+		return nil, 401, fmt.Errorf("terminated")
+	})
+	pm := NewPollerMap(client, accumulator, nil, nil)
+	waitForTermination := func(deviceID string) {
+		t.Helper()
+		start := time.Now()
+		for {
+			pm.pollerMu.Lock()
+			terminated := pm.Pollers[deviceID].isTerminated()
+			pm.pollerMu.Unlock()
+			if terminated {
+				return
+			}
+			if time.Since(start) > time.Second {
+				t.Fatalf("poller %s did not terminate", deviceID)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	// A is elected as it polls first, so B doesn't process room data
+	pm.EnsurePolling("A", "@alice:localhost", "DEVICE_A", "", zerolog.New(os.Stderr))
+	pm.EnsurePolling("B", "@alice:localhost", "DEVICE_B", "", zerolog.New(os.Stderr))
+	// stop A, so B takes over from its next request. The response to B's in-flight request isn't processed
+	// as B wasn't elected when it was made, so B catches up on rooms before carrying on from its since token.
+	pm.Pollers["DEVICE_A"].Stop()
+	close(stopA)
+	waitForTermination("DEVICE_A")
+	close(nextB)
+	waitForTermination("DEVICE_B")
+
+	var gotEventIDs []string
+	for _, ev := range accumulator.timelines[roomID] {
+		var event struct {
+			EventID string `json:"event_id"`
+		}
+		if err := json.Unmarshal(ev, &event); err != nil {
+			t.Fatalf("failed to unmarshal event: %s", err)
+		}
+		gotEventIDs = append(gotEventIDs, event.EventID)
+	}
+	wantEventIDs := []string{"$a1", "$b2", "$b3"}
+	if !reflect.DeepEqual(gotEventIDs, wantEventIDs) {
+		t.Errorf("accumulated events: got %v want %v", gotEventIDs, wantEventIDs)
+	}
+	wantPrevBatches := []string{"", "catch_up", ""}
+	if !reflect.DeepEqual(accumulator.prevBatches[roomID], wantPrevBatches) {
+		t.Errorf("prev batches: got %v want %v", accumulator.prevBatches[roomID], wantPrevBatches)
+	}
+	// the catch up didn't replace B's since token
+	if got := accumulator.deviceIDToSince["DEVICE_B"]; got != "b3" {
+		t.Errorf("DEVICE_B since: got %s want b3", got)
+	}
+}
+
+// Tests that the room poller election is shared via the PollerLeaser, so pollers on other instances are
+// taken into account, and that taking over from another device catches up on rooms.
+func TestPollerMapElectsRoomPollerWithLeaser(t *testing.T) {
+	leaser := &mockLeaser{
+		roomHolder:    "DEVICE_OTHER_INSTANCE",
+		roomExpiresAt: time.Now().Add(time.Hour),
+	}
+	var mu sync.Mutex
+	var sinces []string
+	releaseLease := make(chan struct{})
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		mu.Lock()
+		sinces = append(sinces, since)
+		numPolls := len(sinces)
+		mu.Unlock()
+		switch numPolls {
+		case 1:
+			return &SyncResponse{NextBatch: "1"}, 200, nil
+		case 2:
+			// the other instance's poller stops
+			<-releaseLease
+			leaser.mu.Lock()
+			leaser.roomExpiresAt = time.Time{}
+			leaser.mu.Unlock()
+			return &SyncResponse{NextBatch: "2"}, 200, nil
+		case 3, 4:
+			return &SyncResponse{NextBatch: fmt.Sprintf("%d", numPolls)}, 200, nil
+		}
+		return nil, 401, fmt.Errorf("terminated")
+	})
+	pm := NewPollerMap(client, accumulator, leaser, nil)
+	pm.EnsurePolling("A", "@alice:localhost", "DEVICE_A", "", zerolog.New(os.Stderr))
+	close(releaseLease)
+	// the room lease is released when the poller terminates
+	start := time.Now()
+	for {
+		leaser.mu.Lock()
+		released := leaser.holder == "" && leaser.roomHolder == ""
+		leaser.mu.Unlock()
+		if released {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatalf("poller did not terminate and release its leases")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	client.mu.Lock()
+	gotFilters := client.filters
+	client.mu.Unlock()
+	// the room lease was held by another device for the first 2 requests, then we caught up from no since
+	// token before carrying on from ours.
+	wantSinces := []string{"", "1", "", "2", "4"}
+	wantFilters := []string{
+		"filter_1", "filter_1", "filter_2", "filter_3", "filter_3",
+	}
+	if !reflect.DeepEqual(sinces, wantSinces) {
+		t.Errorf("sinces: got %v want %v", sinces, wantSinces)
+	}
+	if !reflect.DeepEqual(gotFilters, wantFilters) {
+		t.Errorf("filters: got %v want %v", gotFilters, wantFilters)
+	}
+}
+
+// Tests that a new device which is elected to process room data only does one initial sync, as there is
+// nothing to catch up on without a since token.
+func TestPollerMapNewDeviceWithLeaserSyncsOnce(t *testing.T) {
+	leaser := &mockLeaser{}
+	var mu sync.Mutex
+	var sinces []string
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		mu.Lock()
+		sinces = append(sinces, since)
+		numPolls := len(sinces)
+		mu.Unlock()
+		if numPolls <= 3 {
+			return &SyncResponse{NextBatch: fmt.Sprintf("%d", numPolls)}, 200, nil
+		}
+		return nil, 401, fmt.Errorf("terminated")
+	})
+	pm := NewPollerMap(client, accumulator, leaser, nil)
+	pm.EnsurePolling("A", "@alice:localhost", "DEVICE_A", "", zerolog.New(os.Stderr))
+	start := time.Now()
+	for {
+		leaser.mu.Lock()
+		released := leaser.holder == "" && leaser.roomHolder == ""
+		leaser.mu.Unlock()
+		if released {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatalf("poller did not terminate and release its leases")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	numInitialSyncs := 0
+	for _, since := range sinces {
+		if since == "" {
+			numInitialSyncs++
+		}
+	}
+	if numInitialSyncs != 1 {
+		t.Errorf("got %d requests without a since token, want 1: %v", numInitialSyncs, sinces)
+	}
+}
+
+// Tests that pollers for devices without connections are stopped after PollerIdleTimeout, and resume
+// from the persisted since token.
+func TestPollerMapStopIdlePollers(t *testing.T) {
+	oldTimeout := PollerIdleTimeout
+	PollerIdleTimeout = 20 * time.Millisecond
+	defer func() {
+		PollerIdleTimeout = oldTimeout
+	}()
+	deviceID := "FOOBAR"
+	var mu sync.Mutex
+	numPolls := 0
+	var sinces []string
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		time.Sleep(time.Millisecond) // pretend to long-poll
+		numPolls++
+		sinces = append(sinces, since)
+		return &SyncResponse{
+			NextBatch: fmt.Sprintf("%d", numPolls),
+		}, 200, nil
+	})
+	pm := NewPollerMap(client, accumulator, nil, nil)
+	pm.EnsurePolling("Authorization: hello world", "@alice:localhost", deviceID, "", zerolog.New(os.Stderr))
+
+	hasConns := true
+	isActive := func(string) bool { return hasConns }
+	// devices with connections are never stopped
+	for i := 0; i < 3; i++ {
+		if n := pm.StopIdlePollers(isActive); n != 0 {
+			t.Fatalf("stopped %d pollers for an active device", n)
+		}
+		time.Sleep(15 * time.Millisecond)
+	}
+	// devices without connections are stopped after the idle timeout
+	hasConns = false
+	if n := pm.StopIdlePollers(isActive); n != 0 {
+		t.Fatalf("stopped %d pollers before the idle timeout", n)
+	}
+	time.Sleep(25 * time.Millisecond)
+	if n := pm.StopIdlePollers(isActive); n != 1 {
+		t.Fatalf("stopped %d pollers after the idle timeout, want 1", n)
+	}
+	if !pm.NeedsPolling(deviceID) {
+		t.Fatalf("NeedsPolling returned false for a stopped poller")
+	}
+	start := time.Now()
+	for {
+		pm.pollerMu.Lock()
+		terminated := pm.Pollers[deviceID].isTerminated()
+		pm.pollerMu.Unlock()
+		if terminated {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatalf("poller did not terminate after being stopped")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	mu.Lock()
+	lastSince := fmt.Sprintf("%d", numPolls)
+	numSinces := len(sinces)
+	mu.Unlock()
+	accumulator.mu.Lock()
+	gotSince := accumulator.deviceIDToSince[deviceID]
+	accumulator.mu.Unlock()
+	if gotSince != lastSince {
+		t.Fatalf("stopped poller did not persist since token: got %s want %s", gotSince, lastSince)
+	}
+
+	// resuming polls from the persisted since token, without blocking
+	pm.EnsurePolling("Authorization: hello world", "@alice:localhost", deviceID, gotSince, zerolog.New(os.Stderr))
+	if pm.NeedsPolling(deviceID) {
+		t.Fatalf("NeedsPolling returned true after resuming")
+	}
+	start = time.Now()
+	for {
+		mu.Lock()
+		resumedFrom := ""
+		if len(sinces) > numSinces {
+			resumedFrom = sinces[numSinces]
+		}
+		mu.Unlock()
+		if resumedFrom == gotSince {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatalf("poller did not resume from since token %s", gotSince)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	pm.pollerMu.Lock()
+	pm.Pollers[deviceID].Stop()
+	pm.pollerMu.Unlock()
+}
+
+type mockLeaser struct {
+	mu            sync.Mutex
+	holder        string
+	expiresAt     time.Time
+	roomHolder    string
+	roomExpiresAt time.Time
+}
+
+func (l *mockLeaser) AcquireLease(deviceID string) (bool, time.Time, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.holder != "me" && time.Now().Before(l.expiresAt) {
+		return false, l.expiresAt, nil
+	}
+	l.holder = "me"
+	l.expiresAt = time.Now().Add(PollerLeaseDuration)
+	return true, l.expiresAt, nil
+}
+
+func (l *mockLeaser) AcquireRoomLease(userID, deviceID string) (bool, string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	prevDeviceID := l.roomHolder
+	if l.roomHolder != deviceID && time.Now().Before(l.roomExpiresAt) {
+		return false, prevDeviceID, nil
+	}
+	l.roomHolder = deviceID
+	l.roomExpiresAt = time.Now().Add(PollerLeaseDuration)
+	return true, prevDeviceID, nil
+}
+
+func (l *mockLeaser) ReleaseLease(deviceID string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.holder == "me" {
+		l.holder = ""
+	}
+	if l.roomHolder == deviceID {
+		l.roomHolder = ""
+		l.roomExpiresAt = time.Time{}
+	}
+	return nil
+}
+
 type mockClient struct {
 	fn func(authHeader, since string) (*SyncResponse, int, error)
+	// if set, CreateFilter fails with this error
+	createFilterErr error
+	mu              sync.Mutex // guards fields below
+	numFilters      int
+	filters         []string
 }
 
-func (c *mockClient) DoSyncV2(authHeader, since string) (*SyncResponse, int, error) {
+func (c *mockClient) DoSyncV2(authHeader, since, filter string) (*SyncResponse, int, error) {
+	c.mu.Lock()
+	c.filters = append(c.filters, filter)
+	c.mu.Unlock()
 	return c.fn(authHeader, since)
 }
-func (c *mockClient) WhoAmI(authHeader string) (string, error) {
-	return "@alice:localhost", nil
+func (c *mockClient) CreateFilter(authHeader, userID string, filter json.RawMessage) (string, error) {
+	if c.createFilterErr != nil {
+		return "", c.createFilterErr
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.numFilters++
+	return fmt.Sprintf("filter_%d", c.numFilters), nil
+}
+
+type mockFilterStore struct {
+	filterIDs map[string]string
+}
+
+func (s *mockFilterStore) FilterID(userID, filterHash string) (string, error) {
+	return s.filterIDs[userID+filterHash], nil
+}
+func (s *mockFilterStore) StoreFilterID(userID, filterHash, filterID string) error {
+	s.filterIDs[userID+filterHash] = filterID
+	return nil
+}
+func (c *mockClient) WhoAmI(authHeader string) (string, int, error) {
+	return "@alice:localhost", 200, nil
 }
 
 type mockDataReceiver struct {
 	states          map[string][]json.RawMessage
 	timelines       map[string][]json.RawMessage
+	prevBatches     map[string][]string
 	deviceIDToSince map[string]string
+	invalidTokens   []string
+	accumulateErrs  map[string]int // room ID -> the number of Accumulate calls which fail
+	numRollbacks    int
+	numTxns         int        // the number of open transactions
+	maxTxns         int        // the most transactions which were open at once
+	mu              sync.Mutex // guards all fields
 }
 
-func (a *mockDataReceiver) Accumulate(roomID string, timeline []json.RawMessage) error {
-	a.timelines[roomID] = append(a.timelines[roomID], timeline...)
+func (s *mockDataReceiver) Begin() (V2DataTxn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.numTxns++
+	if s.numTxns > s.maxTxns {
+		s.maxTxns = s.numTxns
+	}
+	return &mockDataTxn{receiver: s}, nil
+}
+func (s *mockDataReceiver) OnInvalidToken(deviceID string) {
+	s.invalidTokens = append(s.invalidTokens, deviceID)
+}
+
+// mockDataTxn buffers updates and applies them to the receiver on Commit.
+type mockDataTxn struct {
+	receiver *mockDataReceiver
+	updates  []func()
+}
+
+func (t *mockDataTxn) Accumulate(roomID, prevBatch string, timeline []json.RawMessage) error {
+	t.receiver.mu.Lock()
+	defer t.receiver.mu.Unlock()
+	if t.receiver.accumulateErrs[roomID] > 0 {
+		t.receiver.accumulateErrs[roomID]--
+		return fmt.Errorf("mock accumulate error")
+	}
+	t.updates = append(t.updates, func() {
+		t.receiver.timelines[roomID] = append(t.receiver.timelines[roomID], timeline...)
+		t.receiver.prevBatches[roomID] = append(t.receiver.prevBatches[roomID], prevBatch)
+	})
 	return nil
 }
-func (a *mockDataReceiver) Initialise(roomID string, state []json.RawMessage) error {
-	a.states[roomID] = state
+func (t *mockDataTxn) Initialise(roomID string, state, timeline []json.RawMessage) error {
+	t.updates = append(t.updates, func() {
+		t.receiver.states[roomID] = state
+	})
 	return nil
 }
-func (a *mockDataReceiver) SetTyping(roomID string, userIDs []string) (int64, error) {
+func (t *mockDataTxn) SetTyping(roomID, userID string, userIDs []string) (int64, error) {
 	return 0, nil
 }
-func (s *mockDataReceiver) UpdateDeviceSince(deviceID, since string) error {
-	s.deviceIDToSince[deviceID] = since
+func (t *mockDataTxn) UpdateDeviceSince(deviceID, since string) error {
+	t.updates = append(t.updates, func() {
+		t.receiver.deviceIDToSince[deviceID] = since
+	})
 	return nil
 }
-func (s *mockDataReceiver) AddToDeviceMessages(userID, deviceID string, msgs []gomatrixserverlib.SendToDeviceEvent) error {
+func (t *mockDataTxn) AddToDeviceMessages(userID, deviceID string, msgs []gomatrixserverlib.SendToDeviceEvent) error {
 	return nil
 }
-
-func (s *mockDataReceiver) UpdateUnreadCounts(roomID, userID string, highlightCount, notifCount *int) {
+func (t *mockDataTxn) UpdateUnreadCounts(roomID, userID string, highlightCount, notifCount, unreadCount *int) error {
+	return nil
+}
+func (t *mockDataTxn) Commit() error {
+	t.receiver.mu.Lock()
+	defer t.receiver.mu.Unlock()
+	t.receiver.numTxns--
+	for _, update := range t.updates {
+		update()
+	}
+	return nil
+}
+func (t *mockDataTxn) Rollback() {
+	t.receiver.mu.Lock()
+	defer t.receiver.mu.Unlock()
+	t.receiver.numTxns--
+	t.receiver.numRollbacks++
 }
 
 func newMocks(doSyncV2 func(authHeader, since string) (*SyncResponse, int, error)) (*mockDataReceiver, *mockClient) {
@@ -254,6 +1078,7 @@ func newMocks(doSyncV2 func(authHeader, since string) (*SyncResponse, int, error
 	accumulator := &mockDataReceiver{
 		states:          make(map[string][]json.RawMessage),
 		timelines:       make(map[string][]json.RawMessage),
+		prevBatches:     make(map[string][]string),
 		deviceIDToSince: make(map[string]string),
 	}
 	return accumulator, client
@@ -1,7 +1,9 @@
 package sync2
 
 import (
+	"database/sql"
 	"os"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
@@ -35,6 +37,33 @@ func NewStore(postgresURI string) *Storage {
 		device_id TEXT PRIMARY KEY,
 		user_id TEXT NOT NULL, -- populated from /whoami
 		since TEXT NOT NULL
+	);
+	-- which proxy instance is polling for this device, so only 1 poller runs per device across all instances
+	CREATE TABLE IF NOT EXISTS syncv3_sync2_poller_leases (
+		device_id TEXT PRIMARY KEY,
+		instance_id TEXT NOT NULL,
+		expires_at BIGINT NOT NULL -- unix millis
+	);
+	-- which device's poller processes room data for this user, so rooms are only processed once per user
+	-- across all instances. Released leases expire immediately but keep the device ID, so the next device
+	-- to take the lease knows it is taking over from another device.
+	CREATE TABLE IF NOT EXISTS syncv3_sync2_room_leases (
+		user_id TEXT PRIMARY KEY,
+		device_id TEXT NOT NULL,
+		expires_at BIGINT NOT NULL -- unix millis
+	);
+	-- devices whose access token has been rejected by the homeserver. Device IDs are derived from the
+	-- access token, so once a device is in here it will never become valid again.
+	CREATE TABLE IF NOT EXISTS syncv3_sync2_invalid_tokens (
+		device_id TEXT PRIMARY KEY
+	);
+	-- v2 filters uploaded for each user. Filters are keyed on a hash of their definition so changing the
+	-- definition uploads a new filter.
+	CREATE TABLE IF NOT EXISTS syncv3_sync2_filters (
+		user_id TEXT NOT NULL,
+		filter_hash TEXT NOT NULL,
+		filter_id TEXT NOT NULL,
+		UNIQUE(user_id, filter_hash)
 	);`)
 
 	return &Storage{
@@ -74,8 +103,14 @@ func (s *Storage) InsertDevice(deviceID string) (*Device, error) {
 	return &device, err
 }
 
-func (s *Storage) UpdateDeviceSince(deviceID, since string) error {
-	_, err := s.db.Exec(`UPDATE syncv3_sync2_devices SET since = $1 WHERE device_id = $2`, since, deviceID)
+// UpdateDeviceSince remembers the since token for this device. If txn is nil, the update is not made in a
+// transaction.
+func (s *Storage) UpdateDeviceSince(txn *sqlx.Tx, deviceID, since string) error {
+	var db sqlx.Execer = s.db
+	if txn != nil {
+		db = txn
+	}
+	_, err := db.Exec(`UPDATE syncv3_sync2_devices SET since = $1 WHERE device_id = $2`, since, deviceID)
 	return err
 }
 
@@ -83,3 +118,151 @@ func (s *Storage) UpdateUserIDForDevice(deviceID, userID string) error {
 	_, err := s.db.Exec(`UPDATE syncv3_sync2_devices SET user_id = $1 WHERE device_id = $2`, userID, deviceID)
 	return err
 }
+
+// InvalidateToken remembers that the access token for this device has been rejected by the homeserver.
+func (s *Storage) InvalidateToken(deviceID string) error {
+	_, err := s.db.Exec(
+		`INSERT INTO syncv3_sync2_invalid_tokens(device_id) VALUES($1) ON CONFLICT (device_id) DO NOTHING`, deviceID,
+	)
+	return err
+}
+
+// IsTokenInvalid returns true if the access token for this device has been rejected by the homeserver.
+func (s *Storage) IsTokenInvalid(deviceID string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRow(
+		`SELECT EXISTS(SELECT 1 FROM syncv3_sync2_invalid_tokens WHERE device_id = $1)`, deviceID,
+	).Scan(&exists)
+	return exists, err
+}
+
+// FilterID returns the ID of the filter with this definition hash which has been uploaded for this user,
+// or "" if one hasn't been uploaded.
+func (s *Storage) FilterID(userID, filterHash string) (string, error) {
+	var filterID string
+	err := s.db.QueryRow(
+		`SELECT filter_id FROM syncv3_sync2_filters WHERE user_id = $1 AND filter_hash = $2`, userID, filterHash,
+	).Scan(&filterID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return filterID, err
+}
+
+// StoreFilterID remembers the ID of the filter with this definition hash which has been uploaded for this user.
+func (s *Storage) StoreFilterID(userID, filterHash, filterID string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO syncv3_sync2_filters(user_id, filter_hash, filter_id) VALUES($1,$2,$3)
+		ON CONFLICT (user_id, filter_hash) DO UPDATE SET filter_id = $3`,
+		userID, filterHash, filterID,
+	)
+	return err
+}
+
+// AcquireLease tries to take or renew the lease to poll for this device for this instance. Leases can
+// only be taken if they are held by this instance already, or the existing lease has expired. Returns
+// whether the lease was acquired, and when the current lease expires (which may be held by another instance).
+func (s *Storage) AcquireLease(deviceID, instanceID string, duration time.Duration) (acquired bool, expiresAt time.Time, err error) {
+	now := time.Now()
+	var holder string
+	var expiresAtMs int64
+	err = sqlutil.WithTransaction(s.db, func(txn *sqlx.Tx) error {
+		_, err := txn.Exec(`
+			INSERT INTO syncv3_sync2_poller_leases(device_id, instance_id, expires_at) VALUES($1,$2,$3)
+			ON CONFLICT (device_id) DO UPDATE SET instance_id = $2, expires_at = $3
+			WHERE syncv3_sync2_poller_leases.instance_id = $2 OR syncv3_sync2_poller_leases.expires_at < $4`,
+			deviceID, instanceID, unixMillis(now.Add(duration)), unixMillis(now),
+		)
+		if err != nil {
+			return err
+		}
+		return txn.QueryRow(
+			`SELECT instance_id, expires_at FROM syncv3_sync2_poller_leases WHERE device_id = $1`, deviceID,
+		).Scan(&holder, &expiresAtMs)
+	})
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	return holder == instanceID, time.Unix(0, expiresAtMs*int64(time.Millisecond)), nil
+}
+
+// ReleaseLease gives up the lease to poll for this device, if it is held by this instance.
+func (s *Storage) ReleaseLease(deviceID, instanceID string) error {
+	_, err := s.db.Exec(
+		`DELETE FROM syncv3_sync2_poller_leases WHERE device_id = $1 AND instance_id = $2`, deviceID, instanceID,
+	)
+	return err
+}
+
+// AcquireRoomLease tries to take or renew the lease to process room data for this user for this device.
+// Leases can only be taken if they are held by this device already, or the existing lease has expired.
+// Returns whether the lease was acquired, and the device which held the lease before this call, or "" if
+// no device has held it.
+func (s *Storage) AcquireRoomLease(userID, deviceID string, duration time.Duration) (acquired bool, prevDeviceID string, err error) {
+	now := time.Now()
+	err = sqlutil.WithTransaction(s.db, func(txn *sqlx.Tx) error {
+		// lock the row so the previous device is the one we take the lease from
+		err := txn.QueryRow(
+			`SELECT device_id FROM syncv3_sync2_room_leases WHERE user_id = $1 FOR UPDATE`, userID,
+		).Scan(&prevDeviceID)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		result, err := txn.Exec(`
+			INSERT INTO syncv3_sync2_room_leases(user_id, device_id, expires_at) VALUES($1,$2,$3)
+			ON CONFLICT (user_id) DO UPDATE SET device_id = $2, expires_at = $3
+			WHERE syncv3_sync2_room_leases.device_id = $2 OR syncv3_sync2_room_leases.expires_at < $4`,
+			userID, deviceID, unixMillis(now.Add(duration)), unixMillis(now),
+		)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		acquired = n == 1
+		return err
+	})
+	if err != nil {
+		return false, "", err
+	}
+	return acquired, prevDeviceID, nil
+}
+
+// ReleaseRoomLease gives up the lease to process room data held by this device, if any.
+func (s *Storage) ReleaseRoomLease(deviceID string) error {
+	_, err := s.db.Exec(
+		`UPDATE syncv3_sync2_room_leases SET expires_at = 0 WHERE device_id = $1`, deviceID,
+	)
+	return err
+}
+
+// Leaser returns a PollerLeaser which takes leases on behalf of this instance.
+func (s *Storage) Leaser(instanceID string) PollerLeaser {
+	return &storageLeaser{
+		store:      s,
+		instanceID: instanceID,
+	}
+}
+
+type storageLeaser struct {
+	store      *Storage
+	instanceID string
+}
+
+func (l *storageLeaser) AcquireLease(deviceID string) (bool, time.Time, error) {
+	return l.store.AcquireLease(deviceID, l.instanceID, PollerLeaseDuration)
+}
+
+func (l *storageLeaser) AcquireRoomLease(userID, deviceID string) (bool, string, error) {
+	return l.store.AcquireRoomLease(userID, deviceID, PollerLeaseDuration)
+}
+
+func (l *storageLeaser) ReleaseLease(deviceID string) error {
+	if err := l.store.ReleaseRoomLease(deviceID); err != nil {
+		return err
+	}
+	return l.store.ReleaseLease(deviceID, l.instanceID)
+}
+
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -3,6 +3,7 @@ package sync2
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/matrix-org/sync-v3/testutils"
 )
@@ -23,7 +24,7 @@ func TestStorage(t *testing.T) {
 		t.Fatalf("Failed to InsertDevice: %s", err)
 	}
 	assertEqual(t, device.DeviceID, deviceID, "Device.DeviceID mismatch")
-	if err = store.UpdateDeviceSince(deviceID, "s1"); err != nil {
+	if err = store.UpdateDeviceSince(nil, deviceID, "s1"); err != nil {
 		t.Fatalf("UpdateDeviceSince returned error: %s", err)
 	}
 	if err = store.UpdateUserIDForDevice(deviceID, "@alice:localhost"); err != nil {
@@ -49,6 +50,157 @@ func TestStorage(t *testing.T) {
 	assertEqual(t, s2.DeviceID, deviceID, "Device.DeviceID mismatch")
 }
 
+func TestStorageLeases(t *testing.T) {
+	deviceID := "TEST_LEASE_DEVICE_ID"
+	store := NewStore(postgresConnectionString)
+	acquired, _, err := store.AcquireLease(deviceID, "A", time.Minute)
+	if err != nil {
+		t.Fatalf("AcquireLease returned error: %s", err)
+	}
+	if !acquired {
+		t.Fatalf("failed to acquire new lease")
+	}
+	// renewing works
+	acquired, expiresAt, err := store.AcquireLease(deviceID, "A", time.Minute)
+	if err != nil {
+		t.Fatalf("AcquireLease returned error: %s", err)
+	}
+	if !acquired {
+		t.Fatalf("failed to renew lease")
+	}
+	// other instances cannot take the lease whilst it is held
+	acquired, gotExpiresAt, err := store.AcquireLease(deviceID, "B", time.Minute)
+	if err != nil {
+		t.Fatalf("AcquireLease returned error: %s", err)
+	}
+	if acquired {
+		t.Fatalf("acquired lease held by another instance")
+	}
+	if gotExpiresAt.Unix() != expiresAt.Unix() {
+		t.Errorf("got expiry %v want %v", gotExpiresAt, expiresAt)
+	}
+	// other instances cannot release the lease
+	if err = store.ReleaseLease(deviceID, "B"); err != nil {
+		t.Fatalf("ReleaseLease returned error: %s", err)
+	}
+	acquired, _, err = store.AcquireLease(deviceID, "B", time.Minute)
+	if err != nil {
+		t.Fatalf("AcquireLease returned error: %s", err)
+	}
+	if acquired {
+		t.Fatalf("acquired lease held by another instance after it was released by the wrong instance")
+	}
+	// releasing the lease allows other instances to take it
+	if err = store.ReleaseLease(deviceID, "A"); err != nil {
+		t.Fatalf("ReleaseLease returned error: %s", err)
+	}
+	acquired, _, err = store.AcquireLease(deviceID, "B", -time.Minute) // immediately expires
+	if err != nil {
+		t.Fatalf("AcquireLease returned error: %s", err)
+	}
+	if !acquired {
+		t.Fatalf("failed to acquire released lease")
+	}
+	// expired leases can be taken
+	acquired, _, err = store.AcquireLease(deviceID, "A", time.Minute)
+	if err != nil {
+		t.Fatalf("AcquireLease returned error: %s", err)
+	}
+	if !acquired {
+		t.Fatalf("failed to acquire expired lease")
+	}
+}
+
+func TestStorageRoomLeases(t *testing.T) {
+	userID := "@TestStorageRoomLeases:localhost"
+	store := NewStore(postgresConnectionString)
+	assertAcquire := func(deviceID string, duration time.Duration, wantAcquired bool, wantPrev string) {
+		t.Helper()
+		acquired, prevDeviceID, err := store.AcquireRoomLease(userID, deviceID, duration)
+		if err != nil {
+			t.Fatalf("AcquireRoomLease returned error: %s", err)
+		}
+		if acquired != wantAcquired {
+			t.Errorf("AcquireRoomLease(%s): got acquired %v want %v", deviceID, acquired, wantAcquired)
+		}
+		if prevDeviceID != wantPrev {
+			t.Errorf("AcquireRoomLease(%s): got previous device %q want %q", deviceID, prevDeviceID, wantPrev)
+		}
+	}
+	assertAcquire("A", time.Minute, true, "")
+	// renewing works
+	assertAcquire("A", time.Minute, true, "A")
+	// other devices cannot take the lease whilst it is held
+	assertAcquire("B", time.Minute, false, "A")
+	// other devices cannot release the lease
+	if err := store.ReleaseRoomLease("B"); err != nil {
+		t.Fatalf("ReleaseRoomLease returned error: %s", err)
+	}
+	assertAcquire("B", time.Minute, false, "A")
+	// releasing the lease allows other devices to take it, and they know who held it before
+	if err := store.ReleaseRoomLease("A"); err != nil {
+		t.Fatalf("ReleaseRoomLease returned error: %s", err)
+	}
+	assertAcquire("B", -time.Minute, true, "A") // immediately expires
+	// expired leases can be taken
+	assertAcquire("A", time.Minute, true, "B")
+}
+
+func TestStorageInvalidTokens(t *testing.T) {
+	deviceID := "TEST_INVALID_TOKEN_DEVICE_ID"
+	store := NewStore(postgresConnectionString)
+	invalid, err := store.IsTokenInvalid(deviceID)
+	if err != nil {
+		t.Fatalf("IsTokenInvalid returned error: %s", err)
+	}
+	if invalid {
+		t.Fatalf("IsTokenInvalid returned true for a new device")
+	}
+	// invalidating is idempotent
+	for i := 0; i < 2; i++ {
+		if err = store.InvalidateToken(deviceID); err != nil {
+			t.Fatalf("InvalidateToken returned error: %s", err)
+		}
+	}
+	invalid, err = store.IsTokenInvalid(deviceID)
+	if err != nil {
+		t.Fatalf("IsTokenInvalid returned error: %s", err)
+	}
+	if !invalid {
+		t.Fatalf("IsTokenInvalid returned false for an invalidated device")
+	}
+}
+
+func TestStorageFilters(t *testing.T) {
+	userID := "@TestStorageFilters:localhost"
+	store := NewStore(postgresConnectionString)
+	filterID, err := store.FilterID(userID, "hash")
+	if err != nil {
+		t.Fatalf("FilterID returned error: %s", err)
+	}
+	assertEqual(t, filterID, "", "FilterID for a new user")
+	if err = store.StoreFilterID(userID, "hash", "1"); err != nil {
+		t.Fatalf("StoreFilterID returned error: %s", err)
+	}
+	if err = store.StoreFilterID(userID, "hash2", "2"); err != nil {
+		t.Fatalf("StoreFilterID returned error: %s", err)
+	}
+	filterID, err = store.FilterID(userID, "hash")
+	if err != nil {
+		t.Fatalf("FilterID returned error: %s", err)
+	}
+	assertEqual(t, filterID, "1", "FilterID after StoreFilterID")
+	// replacing a filter ID is allowed
+	if err = store.StoreFilterID(userID, "hash", "3"); err != nil {
+		t.Fatalf("StoreFilterID returned error: %s", err)
+	}
+	filterID, err = store.FilterID(userID, "hash")
+	if err != nil {
+		t.Fatalf("FilterID returned error: %s", err)
+	}
+	assertEqual(t, filterID, "3", "FilterID after replacing the filter")
+}
+
 func assertEqual(t *testing.T, got, want, msg string) {
 	t.Helper()
 	if got != want {
@@ -0,0 +1,133 @@
+package sync2
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// TokenStorage stores access tokens encrypted at rest, so pollers can be restarted when the proxy restarts
+// without waiting for each client to make a request.
+type TokenStorage struct {
+	db   *sqlx.DB
+	aead cipher.AEAD
+}
+
+// NewTokenStorage makes a new token store. Tokens are encrypted with AES-256-GCM using the SHA-256 of the
+// secret as the key, so the secret must be a high-entropy random value. Changing the secret makes all
+// stored tokens unreadable.
+func NewTokenStorage(postgresURI, secret string) (*TokenStorage, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("NewTokenStorage: a secret is required")
+	}
+	aead, err := newAEAD(secret)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sqlx.Open("postgres", postgresURI)
+	if err != nil {
+		log.Panic().Err(err).Str("uri", postgresURI).Msg("failed to open SQL DB")
+	}
+	db.MustExec(`
+	CREATE TABLE IF NOT EXISTS syncv3_sync2_tokens (
+		device_id TEXT PRIMARY KEY,
+		encrypted_token TEXT NOT NULL -- base64(nonce || AES-GCM ciphertext)
+	);`)
+	return &TokenStorage{
+		db:   db,
+		aead: aead,
+	}, nil
+}
+
+func newAEAD(secret string) (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// UpsertToken stores the access token for this device.
+func (s *TokenStorage) UpsertToken(deviceID, accessToken string) error {
+	encrypted, err := encryptToken(s.aead, deviceID, accessToken)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`
+		INSERT INTO syncv3_sync2_tokens(device_id, encrypted_token) VALUES($1,$2)
+		ON CONFLICT (device_id) DO UPDATE SET encrypted_token = $2`,
+		deviceID, encrypted,
+	)
+	return err
+}
+
+// Tokens returns all stored access tokens, keyed by device ID. Tokens which cannot be decrypted, e.g
+// because the secret has changed, are deleted: they will be stored again on the device's next request.
+func (s *TokenStorage) Tokens() (map[string]string, error) {
+	rows, err := s.db.Query(`SELECT device_id, encrypted_token FROM syncv3_sync2_tokens`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := make(map[string]string)
+	var unreadable []string
+	for rows.Next() {
+		var deviceID, encrypted string
+		if err = rows.Scan(&deviceID, &encrypted); err != nil {
+			return nil, err
+		}
+		token, err := decryptToken(s.aead, deviceID, encrypted)
+		if err != nil {
+			log.Warn().Err(err).Str("device", deviceID).Msg("failed to decrypt stored access token, deleting it")
+			unreadable = append(unreadable, deviceID)
+			continue
+		}
+		tokens[deviceID] = token
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, deviceID := range unreadable {
+		if err = s.DeleteToken(deviceID); err != nil {
+			return nil, err
+		}
+	}
+	return tokens, nil
+}
+
+func (s *TokenStorage) DeleteToken(deviceID string) error {
+	_, err := s.db.Exec(`DELETE FROM syncv3_sync2_tokens WHERE device_id = $1`, deviceID)
+	return err
+}
+
+// encryptToken encrypts the token, binding it to this device so ciphertexts cannot be swapped between rows.
+func encryptToken(aead cipher.AEAD, deviceID, token string) (string, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(token), []byte(deviceID))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptToken(aead cipher.AEAD, deviceID, encrypted string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("encrypted token is too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	token, err := aead.Open(nil, nonce, ciphertext, []byte(deviceID))
+	if err != nil {
+		return "", err
+	}
+	return string(token), nil
+}
@@ -0,0 +1,89 @@
+package sync2
+
+import (
+	"testing"
+)
+
+func TestTokenEncryption(t *testing.T) {
+	aead, err := newAEAD("secret")
+	if err != nil {
+		t.Fatalf("newAEAD returned error: %s", err)
+	}
+	encrypted, err := encryptToken(aead, "DEVICE", "syt_access_token")
+	if err != nil {
+		t.Fatalf("encryptToken returned error: %s", err)
+	}
+	token, err := decryptToken(aead, "DEVICE", encrypted)
+	if err != nil {
+		t.Fatalf("decryptToken returned error: %s", err)
+	}
+	if token != "syt_access_token" {
+		t.Errorf("decryptToken: got %s want syt_access_token", token)
+	}
+	// ciphertexts can't be moved to another device
+	if _, err = decryptToken(aead, "OTHER_DEVICE", encrypted); err == nil {
+		t.Errorf("decryptToken succeeded for the wrong device")
+	}
+	// or decrypted with another secret
+	otherAEAD, err := newAEAD("other secret")
+	if err != nil {
+		t.Fatalf("newAEAD returned error: %s", err)
+	}
+	if _, err = decryptToken(otherAEAD, "DEVICE", encrypted); err == nil {
+		t.Errorf("decryptToken succeeded with the wrong secret")
+	}
+}
+
+func TestTokenStorage(t *testing.T) {
+	deviceID := "TEST_TOKEN_DEVICE_ID"
+	store, err := NewTokenStorage(postgresConnectionString, "secret")
+	if err != nil {
+		t.Fatalf("NewTokenStorage returned error: %s", err)
+	}
+	if err = store.UpsertToken(deviceID, "old_token"); err != nil {
+		t.Fatalf("UpsertToken returned error: %s", err)
+	}
+	if err = store.UpsertToken(deviceID, "new_token"); err != nil {
+		t.Fatalf("UpsertToken returned error: %s", err)
+	}
+	tokens, err := store.Tokens()
+	if err != nil {
+		t.Fatalf("Tokens returned error: %s", err)
+	}
+	assertEqual(t, tokens[deviceID], "new_token", "Tokens mismatch")
+
+	// tokens can't be read with a different secret
+	otherStore, err := NewTokenStorage(postgresConnectionString, "other secret")
+	if err != nil {
+		t.Fatalf("NewTokenStorage returned error: %s", err)
+	}
+	tokens, err = otherStore.Tokens()
+	if err != nil {
+		t.Fatalf("Tokens returned error: %s", err)
+	}
+	if _, ok := tokens[deviceID]; ok {
+		t.Fatalf("Tokens returned a token encrypted with a different secret")
+	}
+	// and are deleted when they can't be read
+	tokens, err = store.Tokens()
+	if err != nil {
+		t.Fatalf("Tokens returned error: %s", err)
+	}
+	if _, ok := tokens[deviceID]; ok {
+		t.Fatalf("Tokens returned a token which couldn't be decrypted with a different secret")
+	}
+
+	if err = store.UpsertToken(deviceID, "new_token"); err != nil {
+		t.Fatalf("UpsertToken returned error: %s", err)
+	}
+	if err = store.DeleteToken(deviceID); err != nil {
+		t.Fatalf("DeleteToken returned error: %s", err)
+	}
+	tokens, err = store.Tokens()
+	if err != nil {
+		t.Fatalf("Tokens returned error: %s", err)
+	}
+	if _, ok := tokens[deviceID]; ok {
+		t.Fatalf("Tokens returned a deleted token")
+	}
+}
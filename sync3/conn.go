@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
 
 	"github.com/matrix-org/sync-v3/internal"
 )
@@ -39,7 +40,29 @@ type Conn struct {
 	// ensure only 1 incoming request is handled per connection
 	mu *sync.Mutex
 
+	// copies of lastClientRequest.pos and lastServerResponse.Pos which can be read without holding
+	// the lock, as the lock is held for the duration of long-poll requests.
+	lastClientPos int64
+	lastServerPos int64
+
 	connState *ConnState
+
+	// Called with the lock held after every new response, so the connection can be persisted.
+	// May be nil.
+	persist func(c *Conn)
+
+	// closed when the connection is closed, after which all requests fail with closeErr
+	closed    chan struct{}
+	closeErr  *internal.HandlerError
+	closeOnce *sync.Once
+}
+
+// connSnapshot is the persisted form of a Conn and its ConnState
+type connSnapshot struct {
+	LastClientRequest    Request            `json:"last_client_request"`
+	LastClientRequestPos int64              `json:"last_client_request_pos"`
+	LastServerResponse   Response           `json:"last_server_response"`
+	State                *connStateSnapshot `json:"state,omitempty"`
 }
 
 func NewConn(connID ConnID, connState *ConnState, fn HandlerIncomingReqFunc) *Conn {
@@ -48,6 +71,27 @@ func NewConn(connID ConnID, connState *ConnState, fn HandlerIncomingReqFunc) *Co
 		HandleIncomingRequest: fn,
 		mu:                    &sync.Mutex{},
 		connState:             connState,
+		closed:                make(chan struct{}),
+		closeOnce:             &sync.Once{},
+	}
+}
+
+// Close the connection, interrupting any request which is waiting for updates. This and all subsequent
+// requests on this connection fail with this error.
+func (c *Conn) Close(herr *internal.HandlerError) {
+	c.closeOnce.Do(func() {
+		c.closeErr = herr
+		close(c.closed)
+	})
+}
+
+// isClosed returns the error the connection was closed with, or nil if it is still open.
+func (c *Conn) isClosed() *internal.HandlerError {
+	select {
+	case <-c.closed:
+		return c.closeErr
+	default:
+		return nil
 	}
 }
 
@@ -63,6 +107,12 @@ func (c *Conn) PushUserRoomData(userID, roomID string, data userRoomData, timest
 	})
 }
 
+// KnowsPosition returns true if this position is one which this connection has been sent or has told
+// the client, meaning a request with this position can be handled by this connection.
+func (c *Conn) KnowsPosition(pos int64) bool {
+	return pos == 0 || pos == atomic.LoadInt64(&c.lastClientPos) || pos == atomic.LoadInt64(&c.lastServerPos)
+}
+
 // OnIncomingRequest advances the clients position in the stream, returning the response position and data.
 func (c *Conn) OnIncomingRequest(ctx context.Context, req *Request) (resp *Response, herr *internal.HandlerError) {
 	c.mu.Lock()
@@ -70,6 +120,9 @@ func (c *Conn) OnIncomingRequest(ctx context.Context, req *Request) (resp *Respo
 	// as it guarantees linearisation of data within a single connection
 	defer c.mu.Unlock()
 
+	if herr := c.isClosed(); herr != nil {
+		return nil, herr
+	}
 	if req.pos != 0 && c.lastClientRequest.pos == req.pos {
 		// if the request bodies match up then this is a retry, else it could be the client modifying
 		// their filter params, so fallthrough
@@ -85,12 +138,28 @@ func (c *Conn) OnIncomingRequest(ctx context.Context, req *Request) (resp *Respo
 		// the client made up a position, reject them
 		return nil, &internal.HandlerError{
 			StatusCode: 400,
+			ErrCode:    internal.ErrCodeUnknownPos,
 			Err:        fmt.Errorf("unknown position: %d", req.pos),
 		}
 	}
 	c.lastClientRequest = *req
+	atomic.StoreInt64(&c.lastClientPos, req.pos)
+
+	// stop waiting for updates if the connection is closed
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-c.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
 
 	resp, err := c.HandleIncomingRequest(ctx, c.ConnID, req)
+	if herr := c.isClosed(); herr != nil {
+		return nil, herr
+	}
 	if err != nil {
 		herr, ok := err.(*internal.HandlerError)
 		if !ok {
@@ -103,6 +172,35 @@ func (c *Conn) OnIncomingRequest(ctx context.Context, req *Request) (resp *Respo
 	}
 	resp.Pos = c.lastServerResponse.Pos + 1
 	c.lastServerResponse = *resp
+	atomic.StoreInt64(&c.lastServerPos, resp.Pos)
+	if c.persist != nil {
+		c.persist(c)
+	}
 
 	return resp, nil
 }
+
+// snapshot returns the current state of this connection. Must be called with the lock held.
+func (c *Conn) snapshot() *connSnapshot {
+	snapshot := &connSnapshot{
+		LastClientRequest:    c.lastClientRequest,
+		LastClientRequestPos: c.lastClientRequest.pos,
+		LastServerResponse:   c.lastServerResponse,
+	}
+	if c.connState != nil {
+		snapshot.State = c.connState.snapshot()
+	}
+	return snapshot
+}
+
+// restore the positions of this connection from a snapshot. Must be called before the connection is used.
+func (c *Conn) restore(snapshot *connSnapshot) {
+	c.lastClientRequest = snapshot.LastClientRequest
+	c.lastClientRequest.pos = snapshot.LastClientRequestPos
+	c.lastServerResponse = snapshot.LastServerResponse
+	atomic.StoreInt64(&c.lastClientPos, c.lastClientRequest.pos)
+	atomic.StoreInt64(&c.lastServerPos, c.lastServerResponse.Pos)
+	if c.connState != nil && snapshot.State != nil {
+		c.connState.restore(snapshot.State)
+	}
+}
@@ -2,6 +2,7 @@ package sync3
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"sync"
 	"testing"
@@ -39,6 +40,9 @@ func TestConn(t *testing.T) {
 	assertInt(t, resp.Pos, 2)
 	assertInt(t, resp.Count, 102)
 	assertNoError(t, err)
+	if !c.KnowsPosition(1) || !c.KnowsPosition(2) || c.KnowsPosition(3) {
+		t.Errorf("KnowsPosition: want positions 1,2 to be known and 3 to be unknown")
+	}
 	// bogus position returns a 400
 	_, err = c.OnIncomingRequest(ctx, &Request{
 		pos: 31415,
@@ -49,6 +53,90 @@ func TestConn(t *testing.T) {
 	if err.StatusCode != 400 {
 		t.Fatalf("expected status 400, got %d", err.StatusCode)
 	}
+	if err.ErrCode != internal.ErrCodeUnknownPos {
+		t.Fatalf("expected errcode %s, got %s", internal.ErrCodeUnknownPos, err.ErrCode)
+	}
+}
+
+// Test that a Conn restored from a snapshot remembers positions and cached responses
+func TestConnRestore(t *testing.T) {
+	ctx := context.Background()
+	connID := ConnID{
+		DeviceID:  "d",
+		SessionID: "s",
+	}
+	count := int64(100)
+	handler := func(ctx context.Context, cid ConnID, req *Request) (*Response, error) {
+		count += 1
+		return &Response{
+			Count: count,
+			Ops: []ResponseOp{
+				&ResponseOpRange{
+					Operation: "SYNC",
+					Range:     []int64{0, 1},
+					Rooms:     []Room{{RoomID: "!a:localhost"}, {RoomID: "!b:localhost"}},
+				},
+				&ResponseOpSingle{
+					Operation: "DELETE",
+					Index:     intPtr(1),
+				},
+			},
+		}, nil
+	}
+	c := NewConn(connID, nil, handler)
+	resp, err := c.OnIncomingRequest(ctx, &Request{
+		pos: 0,
+	})
+	assertNoError(t, err)
+	resp, err = c.OnIncomingRequest(ctx, &Request{
+		pos:   1,
+		Rooms: SliceRanges{{0, 1}},
+	})
+	assertNoError(t, err)
+	assertInt(t, resp.Pos, 2)
+
+	data, jerr := json.Marshal(c.snapshot())
+	if jerr != nil {
+		t.Fatalf("failed to marshal snapshot: %s", jerr)
+	}
+	var snapshot connSnapshot
+	if jerr = json.Unmarshal(data, &snapshot); jerr != nil {
+		t.Fatalf("failed to unmarshal snapshot: %s", jerr)
+	}
+	restored := NewConn(connID, nil, handler)
+	restored.restore(&snapshot)
+
+	// retrying the last request returns the cached response
+	resp, err = restored.OnIncomingRequest(ctx, &Request{
+		pos:   1,
+		Rooms: SliceRanges{{0, 1}},
+	})
+	assertNoError(t, err)
+	assertInt(t, resp.Pos, 2)
+	assertInt(t, resp.Count, 102)
+	if len(resp.Ops) != 2 {
+		t.Fatalf("restored response: got %d ops want 2", len(resp.Ops))
+	}
+	if op, ok := resp.Ops[0].(*ResponseOpRange); !ok || op.Operation != "SYNC" || len(op.Rooms) != 2 {
+		t.Errorf("restored response: bad op[0] %+v", resp.Ops[0])
+	}
+	if op, ok := resp.Ops[1].(*ResponseOpSingle); !ok || op.Operation != "DELETE" || *op.Index != 1 {
+		t.Errorf("restored response: bad op[1] %+v", resp.Ops[1])
+	}
+	// continuing from the restored position works
+	resp, err = restored.OnIncomingRequest(ctx, &Request{
+		pos: 2,
+	})
+	assertNoError(t, err)
+	assertInt(t, resp.Pos, 3)
+	assertInt(t, resp.Count, 103)
+	// made up positions are still rejected
+	_, err = restored.OnIncomingRequest(ctx, &Request{
+		pos: 31415,
+	})
+	if err == nil || err.StatusCode != 400 {
+		t.Fatalf("expected 400 error, got %v", err)
+	}
 }
 
 // Test that Conn is blocking and linearises requests to OnIncomingRequest
@@ -102,6 +190,38 @@ func TestConnBlocking(t *testing.T) {
 
 }
 
+// Test that closing a Conn interrupts waiting requests and fails all further requests
+func TestConnClose(t *testing.T) {
+	ctx := context.Background()
+	connID := ConnID{
+		DeviceID:  "d",
+		SessionID: "s",
+	}
+	waiting := make(chan struct{})
+	c := NewConn(connID, nil, func(ctx context.Context, cid ConnID, req *Request) (*Response, error) {
+		close(waiting)
+		<-ctx.Done() // wait for updates which never come
+		return &Response{}, nil
+	})
+	closeErr := &internal.HandlerError{
+		StatusCode: 401,
+		ErrCode:    internal.ErrCodeUnknownToken,
+		Err:        errors.New("closed"),
+	}
+	go func() {
+		<-waiting
+		c.Close(closeErr)
+	}()
+	_, herr := c.OnIncomingRequest(ctx, &Request{})
+	if herr != closeErr {
+		t.Fatalf("waiting request: got error %v want %v", herr, closeErr)
+	}
+	_, herr = c.OnIncomingRequest(ctx, &Request{})
+	if herr != closeErr {
+		t.Fatalf("subsequent request: got error %v want %v", herr, closeErr)
+	}
+}
+
 func TestConnRetries(t *testing.T) {
 	ctx := context.Background()
 	connID := ConnID{
@@ -1,16 +1,22 @@
 package sync3
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"math"
 	"sync"
 	"time"
 
 	"github.com/ReneKroon/ttlcache/v2"
+	"github.com/matrix-org/sync-v3/internal"
 	"github.com/matrix-org/sync-v3/state"
 	"github.com/tidwall/gjson"
 )
 
+// How long a connection can be idle for before it is removed.
+var ConnTTL = 30 * time.Minute
+
 type EventData struct {
 	event     json.RawMessage
 	roomID    string
@@ -21,8 +27,26 @@ type EventData struct {
 	// the absolute latest position for this event data. The NID for this event is guaranteed to
 	// be <= this value.
 	latestPos int64
+	// set if there is a gap in the timeline before this event, which can be filled by paginating from here
+	prevBatch string
+	// set if the room's current state was replaced rather than changed by this event, in which case
+	// there is no event.
+	stateReset bool
+	// set if this event is aggregated onto the event it relates to (an edit or reaction), in which case
+	// the room isn't bumped.
+	aggregated bool
+	// set if this aggregated event relates to the room's latest event: the latest event with the relation
+	// bundled into it. Only used to update the room's latest event, timelines get `event`.
+	bundledLatestEvent json.RawMessage
+	// set if this event is a thread reply: the event ID of the thread root, along with the thread root with
+	// the thread summary bundled into it.
+	threadRoot      string
+	threadRootEvent json.RawMessage
 
 	userRoomData *userRoomData
+	// set if new to-device messages have been stored for the connection's device, in which case there is
+	// no room or event.
+	toDevice bool
 }
 
 // ConnMap stores a collection of Conns along with other global server-wide state e.g the in-memory
@@ -52,9 +76,14 @@ type ConnMap struct {
 	perUserPerRoomData *sync.Map // map[string]userRoomData
 
 	store *state.Storage
+	// Persists connections so they survive restarts. May be nil, in which case connections only live in memory.
+	connStore *ConnStorage
+
+	// Returns true if the upstream homeserver is down, which is indicated in responses. May be nil.
+	Degraded func() bool
 }
 
-func NewConnMap(store *state.Storage) *ConnMap {
+func NewConnMap(store *state.Storage, connStore *ConnStorage) *ConnMap {
 	cm := &ConnMap{
 		userIDToConn:       make(map[string][]*Conn),
 		connIDToConn:       make(map[string]*Conn),
@@ -62,11 +91,12 @@ func NewConnMap(store *state.Storage) *ConnMap {
 		mu:                 &sync.Mutex{},
 		jrt:                NewJoinedRoomsTracker(),
 		store:              store,
+		connStore:          connStore,
 		globalRoomInfo:     make(map[string]*SortableRoom),
 		perUserPerRoomData: &sync.Map{},
 	}
-	cm.cache.SetTTL(30 * time.Minute) // TODO: customisable
-	cm.cache.SetExpirationCallback(cm.closeConn)
+	cm.cache.SetTTL(ConnTTL)
+	cm.cache.SetExpirationReasonCallback(cm.closeConn)
 	return cm
 }
 
@@ -79,6 +109,12 @@ func (m *ConnMap) Conn(cid ConnID) *Conn {
 	return cint.(*Conn)
 }
 
+// KeepAlive refreshes the TTL of this connection, returning false if it has expired or been replaced.
+// Streaming transports must call this regularly as they don't look up the connection for every request.
+func (m *ConnMap) KeepAlive(conn *Conn) bool {
+	return m.Conn(conn.ConnID) == conn
+}
+
 // Atomically gets or creates a connection with this connection ID.
 func (m *ConnMap) GetOrCreateConn(cid ConnID, userID string) (*Conn, bool) {
 	// atomically check if a conn exists already and return that if so
@@ -88,12 +124,111 @@ func (m *ConnMap) GetOrCreateConn(cid ConnID, userID string) (*Conn, bool) {
 	if conn != nil {
 		return conn, false
 	}
+	conn = m.newConn(cid, userID)
+	m.addConn(conn, userID)
+	return conn, true
+}
+
+func (m *ConnMap) newConn(cid ConnID, userID string) *Conn {
 	state := NewConnState(userID, m)
-	conn = NewConn(cid, state, state.HandleIncomingRequest)
-	m.cache.Set(cid.String(), conn)
-	m.connIDToConn[cid.String()] = conn
+	return NewConn(cid, state, func(ctx context.Context, cid ConnID, req *Request) (*Response, error) {
+		resp, err := state.HandleIncomingRequest(ctx, cid, req)
+		if resp != nil && m.Degraded != nil {
+			resp.Degraded = m.Degraded()
+		}
+		return resp, err
+	})
+}
+
+// RestoreConn atomically gets or restores a connection with this connection ID from the database.
+// If the connection exists in memory but doesn't know about this position, it is assumed that another
+// instance has served this connection since and it is reloaded from the database.
+// Returns nil if the connection doesn't exist in the database either, or it belongs to a different user.
+func (m *ConnMap) RestoreConn(cid ConnID, userID string, pos int64) (*Conn, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	conn := m.Conn(cid)
+	if m.connStore == nil || (conn != nil && conn.KnowsPosition(pos)) {
+		return conn, nil
+	}
+	if conn != nil {
+		// the conn is stale, replace it
+		m.removeConn(conn)
+		m.cache.Remove(cid.String())
+	}
+	storedUserID, data, err := m.connStore.SelectConn(cid, time.Now().Add(-ConnTTL))
+	if err != nil {
+		return nil, fmt.Errorf("failed to select conn: %s", err)
+	}
+	if data == nil || storedUserID != userID {
+		return nil, nil
+	}
+	var snapshot connSnapshot
+	if err = json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal conn: %s", err)
+	}
+	conn = m.newConn(cid, userID)
+	conn.restore(&snapshot)
+	m.addConn(conn, userID)
+	return conn, nil
+}
+
+// CloseConnsForDevice closes and forgets all connections for this device, failing any further requests
+// on them with this error. Returns the number of connections closed.
+func (m *ConnMap) CloseConnsForDevice(deviceID string, herr *internal.HandlerError) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var conns []*Conn
+	for _, conn := range m.connIDToConn {
+		if conn.ConnID.DeviceID == deviceID {
+			conns = append(conns, conn)
+		}
+	}
+	for _, conn := range conns {
+		conn.Close(herr)
+		if m.connStore != nil {
+			if err := m.connStore.DeleteConn(conn.ConnID); err != nil {
+				logger.Err(err).Str("conn", conn.ConnID.String()).Msg("failed to delete closed conn")
+			}
+		}
+		m.removeConn(conn)
+		m.cache.Remove(conn.ConnID.String())
+	}
+	return len(conns)
+}
+
+// HasConnsForDevice returns true if there are any connections for this device.
+func (m *ConnMap) HasConnsForDevice(deviceID string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, conn := range m.connIDToConn {
+		if conn.ConnID.DeviceID == deviceID {
+			return true
+		}
+	}
+	return false
+}
+
+// addConn registers a new connection. Must be called with the lock held.
+func (m *ConnMap) addConn(conn *Conn, userID string) {
+	if m.connStore != nil {
+		conn.persist = m.persistConn
+	}
+	m.cache.Set(conn.ConnID.String(), conn)
+	m.connIDToConn[conn.ConnID.String()] = conn
 	m.userIDToConn[userID] = append(m.userIDToConn[userID], conn)
-	return conn, true
+}
+
+// persistConn stores the connection in the database. Called with the conn lock held after every response.
+func (m *ConnMap) persistConn(conn *Conn) {
+	data, err := json.Marshal(conn.snapshot())
+	if err != nil {
+		logger.Err(err).Str("conn", conn.ConnID.String()).Msg("failed to marshal conn")
+		return
+	}
+	if err = m.connStore.UpsertConn(conn.ConnID, conn.connState.UserID(), data); err != nil {
+		logger.Err(err).Str("conn", conn.ConnID.String()).Msg("failed to persist conn")
+	}
 }
 
 // LoadBaseline must be called before any v2 poll loops are made. Failure to do so can result in
@@ -110,12 +245,21 @@ func (m *ConnMap) LoadBaseline(roomIDToUserIDs map[string][]string) error {
 	if err != nil {
 		return fmt.Errorf("failed to load latest event for all rooms: %s", err)
 	}
+	latestEventsJSON := make([]json.RawMessage, len(latestEvents))
+	for i := range latestEvents {
+		latestEventsJSON[i] = latestEvents[i].JSON
+	}
+	latestEventsJSON, err = m.store.BundleRelations(latestEventsJSON)
+	if err != nil {
+		return fmt.Errorf("failed to bundle relations for latest events: %s", err)
+	}
 	// every room will be present here
-	for _, ev := range latestEvents {
+	for i, ev := range latestEvents {
 		room := &SortableRoom{
 			RoomID: ev.RoomID,
 		}
-		room.LastEventJSON = ev.JSON
+		room.LastEventJSON = latestEventsJSON[i]
+		room.LastEventNID = ev.NID
 		room.LastMessageTimestamp = gjson.ParseBytes(ev.JSON).Get("origin_server_ts").Int()
 		m.globalRoomInfo[room.RoomID] = room
 	}
@@ -131,13 +275,7 @@ func (m *ConnMap) LoadBaseline(roomIDToUserIDs map[string][]string) error {
 		if room == nil {
 			return fmt.Errorf("room %s has no latest event but does have state; this should be impossible", roomID)
 		}
-		for _, ev := range stateEvents {
-			if ev.Type == "m.room.name" && ev.StateKey == "" {
-				room.Name = gjson.ParseBytes(ev.JSON).Get("content.name").Str
-			} else if ev.Type == "m.room.canonical_alias" && ev.StateKey == "" && room.Name == "" {
-				room.Name = gjson.ParseBytes(ev.JSON).Get("content.alias").Str
-			}
-		}
+		room.Name = roomNameFromState(stateEvents)
 		m.globalRoomInfo[roomID] = room
 		fmt.Printf("Room: %s - %s - %s \n", room.RoomID, room.Name, time.Unix(room.LastMessageTimestamp/1000, 0))
 	}
@@ -147,9 +285,9 @@ func (m *ConnMap) LoadBaseline(roomIDToUserIDs map[string][]string) error {
 			m.jrt.UserJoinedRoom(userID, roomID)
 		}
 	}
-	// select all non-zero highlight or notif counts and set them, as this is less costly than looping every room/user pair
-	err = m.store.UnreadTable.SelectAllNonZeroCounts(func(roomID, userID string, highlightCount, notificationCount int) {
-		m.OnUnreadCounts(roomID, userID, &highlightCount, &notificationCount)
+	// select all non-zero highlight, notif or unread counts and set them, as this is less costly than looping every room/user pair
+	err = m.store.UnreadTable.SelectAllNonZeroCounts(func(roomID, userID string, highlightCount, notificationCount, unreadCount int) {
+		m.OnUnreadCounts(roomID, userID, &highlightCount, &notificationCount, &unreadCount)
 	})
 	if err != nil {
 		return fmt.Errorf("failed to load unread counts: %s", err)
@@ -208,6 +346,16 @@ func (m *ConnMap) LoadState(roomID string, loadPosition int64, requiredState [][
 	return result
 }
 
+// LoadPrevBatch returns the prev_batch token for the gap before this event, or "" if there is no gap.
+func (m *ConnMap) LoadPrevBatch(eventID string) string {
+	prevBatch, err := m.store.PrevBatch(eventID)
+	if err != nil {
+		logger.Err(err).Str("event", eventID).Msg("failed to load prev_batch")
+		return ""
+	}
+	return prevBatch
+}
+
 func (m *ConnMap) Load(userID string) (joinedRoomIDs []string, initialLoadPosition int64, err error) {
 	initialLoadPosition, err = m.store.LatestEventNID()
 	if err != nil {
@@ -217,17 +365,32 @@ func (m *ConnMap) Load(userID string) (joinedRoomIDs []string, initialLoadPositi
 	return
 }
 
-func (m *ConnMap) closeConn(connID string, value interface{}) {
+func (m *ConnMap) closeConn(connID string, reason ttlcache.EvictionReason, value interface{}) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	// remove conn from all the maps
 	conn := value.(*Conn)
-	delete(m.connIDToConn, connID)
+	if reason == ttlcache.Expired && m.connStore != nil {
+		// only delete expired conns: conns removed because they are stale are still valid in the database
+		if err := m.connStore.DeleteConn(conn.ConnID); err != nil {
+			logger.Err(err).Str("conn", connID).Msg("failed to delete expired conn")
+		}
+	}
+	m.removeConn(conn)
+}
+
+// removeConn removes the conn from all the maps. Must be called with the lock held.
+func (m *ConnMap) removeConn(conn *Conn) {
+	connID := conn.ConnID.String()
+	// this is called asynchronously when conns are removed from the cache, by which time the conn may
+	// have been replaced, so make sure we only remove this exact conn.
+	if m.connIDToConn[connID] == conn {
+		delete(m.connIDToConn, connID)
+	}
 	state := conn.connState
 	if state != nil {
 		conns := m.userIDToConn[state.UserID()]
 		for i := 0; i < len(conns); i++ {
-			if conns[i].ConnID.String() == connID {
+			if conns[i] == conn {
 				// delete without preserving order
 				conns[i] = conns[len(conns)-1]
 				conns = conns[:len(conns)-1]
@@ -247,7 +410,7 @@ func (m *ConnMap) LoadUserRoomData(roomID, userID string) userRoomData {
 }
 
 // TODO: Move to cache struct
-func (m *ConnMap) OnUnreadCounts(roomID, userID string, highlightCount, notifCount *int) {
+func (m *ConnMap) OnUnreadCounts(roomID, userID string, highlightCount, notifCount, unreadCount *int) {
 	data := m.LoadUserRoomData(roomID, userID)
 	hasCountDecreased := false
 	if highlightCount != nil {
@@ -260,6 +423,12 @@ func (m *ConnMap) OnUnreadCounts(roomID, userID string, highlightCount, notifCou
 		}
 		data.notificationCount = *notifCount
 	}
+	if unreadCount != nil {
+		if !hasCountDecreased {
+			hasCountDecreased = *unreadCount < data.unreadCount
+		}
+		data.unreadCount = *unreadCount
+	}
 	key := userID + " " + roomID
 	m.perUserPerRoomData.Store(key, data)
 	if hasCountDecreased {
@@ -279,20 +448,41 @@ func (m *ConnMap) OnUnreadCounts(roomID, userID string, highlightCount, notifCou
 	}
 }
 
+// OnToDeviceMessages wakes up connections for this device, as new to-device messages have been stored for it.
+func (m *ConnMap) OnToDeviceMessages(deviceID string) {
+	m.mu.Lock()
+	var conns []*Conn
+	for _, conn := range m.connIDToConn {
+		if conn.ConnID.DeviceID == deviceID {
+			conns = append(conns, conn)
+		}
+	}
+	m.mu.Unlock()
+	for _, conn := range conns {
+		conn.PushNewEvent(&EventData{
+			toDevice: true,
+		})
+	}
+}
+
 // TODO: Move to cache struct
 // Call this when there is a new event received on a v2 stream.
 // This event must be globally unique, i.e indicated so by the state store.
 func (m *ConnMap) OnNewEvents(
-	roomID string, events []json.RawMessage, latestPos int64,
+	roomID string, events []json.RawMessage, latestPos int64, prevBatch string,
 ) {
-	for _, event := range events {
-		m.onNewEvent(roomID, event, latestPos)
+	for i, event := range events {
+		if i > 0 {
+			// the gap is only before the first event
+			prevBatch = ""
+		}
+		m.onNewEvent(roomID, event, latestPos, prevBatch)
 	}
 }
 
 // TODO: Move to cache struct
 func (m *ConnMap) onNewEvent(
-	roomID string, event json.RawMessage, latestPos int64,
+	roomID string, event json.RawMessage, latestPos int64, prevBatch string,
 ) {
 	// parse the event to pull out fields we care about
 	var stateKey *string
@@ -303,20 +493,30 @@ func (m *ConnMap) onNewEvent(
 	eventType := ev.Get("type").Str
 
 	// update the tracker
-	targetUser := ""
-	if eventType == "m.room.member" && stateKey != nil {
-		targetUser = *stateKey
-		// TODO: de-dupe joins in jrt else profile changes will results in 2x room IDs
-		membership := ev.Get("content.membership").Str
-		switch membership {
-		case "join":
-			m.jrt.UserJoinedRoom(targetUser, roomID)
-		case "ban":
-			fallthrough
-		case "leave":
-			m.jrt.UserLeftRoom(targetUser, roomID)
+	targetUser := m.trackMembership(roomID, ev, eventType, stateKey)
+	// the redacted event may be the room name, which has now been removed from the current state
+	var redactedName *string
+	if eventType == "m.room.redaction" && latestPos > 0 {
+		stateEvents, err := m.store.RoomStateAfterEventPosition(roomID, latestPos, "m.room.name", "m.room.canonical_alias")
+		if err != nil {
+			logger.Err(err).Str("room", roomID).Int64("pos", latestPos).Msg("failed to reload room name after redaction")
+		} else {
+			name := roomNameFromState(stateEvents)
+			redactedName = &name
 		}
 	}
+	// edits and reactions don't bump the room, but they change the latest event if they relate to it
+	relatesTo := aggregatedRelation(ev)
+	var bundledLatest json.RawMessage
+	if relatesTo != "" {
+		bundledLatest = m.bundleLatestEvent(roomID, relatesTo)
+	}
+	// thread replies change the thread summary of the thread root
+	threadRoot := state.ThreadRootID(ev)
+	var threadRootEvent json.RawMessage
+	if threadRoot != "" {
+		threadRootEvent = m.bundledEvent(roomID, threadRoot)
+	}
 	// update global state
 	m.mu.Lock()
 	globalRoom := m.globalRoomInfo[roomID]
@@ -325,44 +525,244 @@ func (m *ConnMap) onNewEvent(
 			RoomID: roomID,
 		}
 	}
-	if eventType == "m.room.name" && stateKey != nil && *stateKey == "" {
-		globalRoom.Name = ev.Get("content.name").Str
-	} else if eventType == "m.room.canonical_alias" && stateKey != nil && *stateKey == "" && globalRoom.Name == "" {
-		globalRoom.Name = ev.Get("content.alias").Str
+	applyStateToRoom(globalRoom, ev, eventType, stateKey)
+	if redactedName != nil {
+		globalRoom.Name = *redactedName
+	}
+	if relatesTo == "" {
+		globalRoom.LastMessageTimestamp = ev.Get("origin_server_ts").Int()
+		globalRoom.LastEventJSON = event
+	} else if bundledLatest != nil && gjson.GetBytes(globalRoom.LastEventJSON, "event_id").Str == relatesTo {
+		globalRoom.LastEventJSON = bundledLatest
+	} else {
+		bundledLatest = nil
+	}
+	eventTimestamp := globalRoom.LastMessageTimestamp
+	if latestPos > globalRoom.LastEventNID {
+		globalRoom.LastEventNID = latestPos
 	}
-	eventTimestamp := ev.Get("origin_server_ts").Int()
-	globalRoom.LastMessageTimestamp = eventTimestamp
-	globalRoom.LastEventJSON = event
 	m.globalRoomInfo[globalRoom.RoomID] = globalRoom
 	m.mu.Unlock()
 
 	ed := &EventData{
-		event:     event,
-		roomID:    roomID,
-		eventType: eventType,
-		stateKey:  stateKey,
-		content:   ev.Get("content"),
-		latestPos: latestPos,
-		timestamp: eventTimestamp,
-	}
-
-	// notify all people in this room
-	notifiedTargetUser := false
-	userIDs := m.jrt.JoinedUsersForRoom(roomID)
-	for _, userID := range userIDs {
+		event:      event,
+		roomID:     roomID,
+		eventType:  eventType,
+		stateKey:   stateKey,
+		content:    ev.Get("content"),
+		latestPos:  latestPos,
+		prevBatch:  prevBatch,
+		timestamp:  eventTimestamp,
+		aggregated: relatesTo != "",
+
+		bundledLatestEvent: bundledLatest,
+
+		threadRoot:      threadRoot,
+		threadRootEvent: threadRootEvent,
+	}
+	var targetUsers []string
+	if targetUser != "" {
+		targetUsers = append(targetUsers, targetUser)
+	}
+	m.pushToRoom(roomID, targetUsers, ed)
+}
+
+// TODO: Move to cache struct
+// OnStateReset is called when the current state of a room has been replaced rather than changed by new
+// events, e.g after a gap in the timeline or a state resolution change on the server. `replacedState` is
+// the state events which replaced events in the current state. Connections re-send the room's state.
+func (m *ConnMap) OnStateReset(roomID string, replacedState []json.RawMessage) {
+	// users who are no longer joined are sent their membership event so they can remove the room
+	var leaves []*EventData
+	for _, event := range replacedState {
+		var stateKey *string
+		ev := gjson.ParseBytes(event)
+		if sk := ev.Get("state_key"); sk.Exists() {
+			stateKey = &sk.Str
+		}
+		eventType := ev.Get("type").Str
+		m.trackMembership(roomID, ev, eventType, stateKey)
+		membership := ev.Get("content.membership").Str
+		if eventType == "m.room.member" && stateKey != nil && (membership == "leave" || membership == "ban") {
+			leaves = append(leaves, &EventData{
+				event:      event,
+				roomID:     roomID,
+				eventType:  eventType,
+				stateKey:   stateKey,
+				content:    ev.Get("content"),
+				stateReset: true,
+			})
+		}
 		m.mu.Lock()
-		conns := m.userIDToConn[userID]
+		if globalRoom := m.globalRoomInfo[roomID]; globalRoom != nil {
+			applyStateToRoom(globalRoom, ev, eventType, stateKey)
+		}
 		m.mu.Unlock()
-		for _, conn := range conns {
-			conn.PushNewEvent(ed)
-			if userID == targetUser {
-				notifiedTargetUser = true
-			}
+	}
+	m.pushToRoom(roomID, nil, &EventData{
+		roomID:     roomID,
+		stateReset: true,
+	})
+	for _, ed := range leaves {
+		m.pushToUsers([]string{*ed.stateKey}, ed)
+	}
+}
+
+// trackMembership updates the joined rooms tracker if this is a membership event. Returns the user whose
+// membership this is, or "" if this isn't a membership event.
+func (m *ConnMap) trackMembership(roomID string, ev gjson.Result, eventType string, stateKey *string) string {
+	if eventType != "m.room.member" || stateKey == nil {
+		return ""
+	}
+	switch ev.Get("content.membership").Str {
+	case "join":
+		m.jrt.UserJoinedRoom(*stateKey, roomID)
+	case "ban":
+		fallthrough
+	case "leave":
+		m.jrt.UserLeftRoom(*stateKey, roomID)
+	}
+	return *stateKey
+}
+
+// applyStateToRoom updates the fields of the room which come from state, if this is a state event we care about.
+func applyStateToRoom(room *SortableRoom, ev gjson.Result, eventType string, stateKey *string) {
+	if eventType == "m.room.name" && stateKey != nil && *stateKey == "" {
+		room.Name = ev.Get("content.name").Str
+	} else if eventType == "m.room.canonical_alias" && stateKey != nil && *stateKey == "" && room.Name == "" {
+		room.Name = ev.Get("content.alias").Str
+	}
+}
+
+// bundleLatestEvent returns the room's latest event with its relations bundled, if the latest event is
+// `eventID`. Returns nil otherwise.
+func (m *ConnMap) bundleLatestEvent(roomID, eventID string) json.RawMessage {
+	m.mu.Lock()
+	var latest json.RawMessage
+	if globalRoom := m.globalRoomInfo[roomID]; globalRoom != nil {
+		latest = globalRoom.LastEventJSON
+	}
+	m.mu.Unlock()
+	if latest == nil || gjson.GetBytes(latest, "event_id").Str != eventID {
+		return nil
+	}
+	bundled, err := m.store.BundleRelations([]json.RawMessage{latest})
+	if err != nil {
+		logger.Err(err).Str("room", roomID).Str("event_id", eventID).Msg("failed to bundle relations for latest event")
+		return nil
+	}
+	return bundled[0]
+}
+
+// bundledEvent returns the event with its relations bundled, or nil if the event isn't known.
+func (m *ConnMap) bundledEvent(roomID, eventID string) json.RawMessage {
+	events, err := m.store.EventsByIDs([]string{eventID})
+	if err != nil || len(events) == 0 || events[0].RoomID != roomID {
+		if err != nil {
+			logger.Err(err).Str("room", roomID).Str("event_id", eventID).Msg("failed to load event")
 		}
+		return nil
 	}
-	if !notifiedTargetUser {
+	bundled, err := m.store.BundleRelations([]json.RawMessage{events[0].JSON})
+	if err != nil {
+		logger.Err(err).Str("room", roomID).Str("event_id", eventID).Msg("failed to bundle relations for event")
+		return nil
+	}
+	return bundled[0]
+}
+
+// LoadMainTimeline returns the latest event in the room at this position which isn't a thread reply, with
+// its relations bundled.
+func (m *ConnMap) LoadMainTimeline(roomID string, loadPosition int64) []json.RawMessage {
+	ev, err := m.store.LatestMainTimelineEventInRoom(roomID, loadPosition)
+	if err != nil {
+		logger.Err(err).Str("room", roomID).Int64("pos", loadPosition).Msg("failed to load main timeline")
+		return nil
+	}
+	return []json.RawMessage{ev}
+}
+
+// LoadThreadTimeline returns the thread root and the latest replies in the thread, up to `limit` events.
+func (m *ConnMap) LoadThreadTimeline(roomID, threadRoot string, limit int64) []json.RawMessage {
+	timeline, err := m.store.ThreadTimeline(roomID, threadRoot, int(limit))
+	if err != nil {
+		logger.Err(err).Str("room", roomID).Str("thread_root", threadRoot).Msg("failed to load thread timeline")
+		return nil
+	}
+	return timeline
+}
+
+// LoadToDeviceMessages returns up to `limit` queued to-device messages for this device and their positions,
+// with room keys first if `roomKeysFirst` is set.
+func (m *ConnMap) LoadToDeviceMessages(deviceID string, limit int64, roomKeysFirst bool) ([]json.RawMessage, []int64) {
+	var priorityTypes []string
+	if roomKeysFirst {
+		priorityTypes = state.RoomKeyEventTypes
+	}
+	msgs, positions, err := m.store.ToDeviceTable.PriorityMessages(deviceID, priorityTypes, 0, math.MaxInt64, limit)
+	if err != nil {
+		logger.Err(err).Str("device", deviceID).Msg("failed to load to-device messages")
+		return nil, nil
+	}
+	return msgs, positions
+}
+
+// DeleteToDeviceMessages deletes to-device messages which have been delivered to this device.
+func (m *ConnMap) DeleteToDeviceMessages(deviceID string, positions []int64) {
+	if err := m.store.ToDeviceTable.DeleteMessages(deviceID, positions); err != nil {
+		// they will be sent again
+		logger.Err(err).Str("device", deviceID).Msg("failed to delete delivered to-device messages")
+	}
+}
+
+// aggregatedRelation returns the event ID this event relates to if it is aggregated onto that event,
+// i.e it is an edit or an annotation. Returns "" otherwise.
+func aggregatedRelation(ev gjson.Result) string {
+	relation := ev.Get(`content.m\.relates_to`)
+	switch relation.Get("rel_type").Str {
+	case "m.annotation", "m.replace":
+		return relation.Get("event_id").Str
+	}
+	return ""
+}
+
+// roomNameFromState returns the room name from these state events. The m.room.name takes precedence over
+// the m.room.canonical_alias.
+func roomNameFromState(stateEvents []state.Event) string {
+	var name, alias string
+	for _, ev := range stateEvents {
+		if ev.StateKey != "" {
+			continue
+		}
+		switch ev.Type {
+		case "m.room.name":
+			name = gjson.ParseBytes(ev.JSON).Get("content.name").Str
+		case "m.room.canonical_alias":
+			alias = gjson.ParseBytes(ev.JSON).Get("content.alias").Str
+		}
+	}
+	if name != "" {
+		return name
+	}
+	return alias
+}
+
+// pushToRoom pushes the event data to all connections for users joined to the room, along with the
+// target users, who may not be joined to the room any more e.g because they just left.
+func (m *ConnMap) pushToRoom(roomID string, targetUsers []string, ed *EventData) {
+	m.pushToUsers(append(m.jrt.JoinedUsersForRoom(roomID), targetUsers...), ed)
+}
+
+// pushToUsers pushes the event data to all connections for these users.
+func (m *ConnMap) pushToUsers(userIDs []string, ed *EventData) {
+	notified := make(map[string]bool, len(userIDs))
+	for _, userID := range userIDs {
+		if notified[userID] {
+			continue
+		}
+		notified[userID] = true
 		m.mu.Lock()
-		conns := m.userIDToConn[targetUser]
+		conns := m.userIDToConn[userID]
 		m.mu.Unlock()
 		for _, conn := range conns {
 			conn.PushNewEvent(ed)
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/matrix-org/sync-v3/state"
 	"github.com/matrix-org/sync-v3/testutils"
@@ -24,11 +25,11 @@ func TestConnMapLoadState(t *testing.T) {
 		testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": "The Room Name"}),
 		testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": "The Updated Room Name"}),
 	}
-	_, latest, err := store.Accumulate(roomID, events)
+	_, latest, err := store.Accumulate(roomID, "", events)
 	if err != nil {
 		t.Fatalf("Accumulate: %s", err)
 	}
-	cm := NewConnMap(store)
+	cm := NewConnMap(store, nil)
 	testCases := []struct {
 		requiredState [][2]string
 		wantEvents    []json.RawMessage
@@ -95,3 +96,27 @@ func TestConnMapLoadState(t *testing.T) {
 		}
 	}
 }
+
+// Test that streaming connections which call KeepAlive don't expire, and that KeepAlive reports when
+// a connection has expired.
+func TestConnMapKeepAlive(t *testing.T) {
+	defer func(ttl time.Duration) {
+		ConnTTL = ttl
+	}(ConnTTL)
+	ConnTTL = 100 * time.Millisecond
+	cm := NewConnMap(nil, nil)
+	conn, _ := cm.GetOrCreateConn(ConnID{SessionID: "s", DeviceID: "d"}, "@alice:localhost")
+	for i := 0; i < 10; i++ {
+		time.Sleep(30 * time.Millisecond)
+		if !cm.KeepAlive(conn) {
+			t.Fatalf("KeepAlive returned false after %d iterations, want true", i)
+		}
+	}
+	time.Sleep(300 * time.Millisecond)
+	if cm.KeepAlive(conn) {
+		t.Fatalf("KeepAlive returned true for an expired connection")
+	}
+	if cm.HasConnsForDevice("d") {
+		t.Fatalf("HasConnsForDevice returned true for an expired connection")
+	}
+}
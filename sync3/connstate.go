@@ -1,11 +1,16 @@
 package sync3
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"reflect"
 	"sort"
+	"strings"
 	"time"
+
+	"github.com/matrix-org/sync-v3/state"
+	"github.com/tidwall/gjson"
 )
 
 var (
@@ -13,12 +18,24 @@ var (
 	// buffer on this connection. Too large and we consume lots of memory. Too small and busy accounts
 	// will trip the connection knifing.
 	MaxPendingEventUpdates = 200
+	// The max number of buffered updates which will be batched up into a single response.
+	MaxBatchedEventUpdates = 50
+	// How long to wait for more updates after the first update wakes up a waiting request, so bursts of
+	// events are returned in a single response. 0 means only updates which are already buffered get batched.
+	BatchDebounceDuration = time.Duration(0)
 )
 
 type ConnStateStore interface {
 	LoadRoom(roomID string) *SortableRoom
 	LoadUserRoomData(roomID, userID string) userRoomData
 	LoadState(roomID string, loadPosition int64, requiredState [][2]string) []json.RawMessage
+	LoadMainTimeline(roomID string, loadPosition int64) []json.RawMessage
+	LoadThreadTimeline(roomID, threadRoot string, limit int64) []json.RawMessage
+	LoadPrevBatch(eventID string) string
+	// LoadToDeviceMessages returns up to `limit` queued to-device messages for this device and their
+	// positions, with room keys first if `roomKeysFirst` is set.
+	LoadToDeviceMessages(deviceID string, limit int64, roomKeysFirst bool) (msgs []json.RawMessage, positions []int64)
+	DeleteToDeviceMessages(deviceID string, positions []int64)
 	Load(userID string) (joinedRoomIDs []string, initialLoadPosition int64, err error)
 }
 
@@ -28,10 +45,22 @@ type ConnState struct {
 	store                      ConnStateStore
 	muxedReq                   *Request
 	userID                     string
+	deviceID                   string
 	sortedJoinedRooms          SortableRooms
 	sortedJoinedRoomsPositions map[string]int // room_id -> index in sortedJoinedRooms
 	roomSubscriptions          map[string]RoomSubscription
 	loadPosition               int64
+	// room_id -> load position when the room data was last sent to the client. Persisted so we can
+	// work out which rooms have changed if this connection is restored.
+	sentRoomPositions map[string]int64
+	// Set when this connection was restored from the database, until the first request is processed.
+	// These are the positions the client was last sent before the connection was restored.
+	restoredRoomPositions map[string]int64
+	// The positions of the to-device messages sent in the response to the request with position
+	// toDeviceReqPos. They are deleted when the client makes a request with a later position, as it must
+	// have received them. Persisted so they are still deleted if this connection is restored.
+	toDeviceSent   []int64
+	toDeviceReqPos int64
 	// A channel which v2 poll loops use to send updates to, via the ConnMap.
 	// Consumed when the conn is read. There is a limit to how many updates we will store before
 	// saying the client is ded and cleaning up the conn.
@@ -44,6 +73,7 @@ func NewConnState(userID string, store ConnStateStore) *ConnState {
 		userID:                     userID,
 		roomSubscriptions:          make(map[string]RoomSubscription),
 		sortedJoinedRoomsPositions: make(map[string]int),
+		sentRoomPositions:          make(map[string]int64),
 		updateEvents:               make(chan *EventData, MaxPendingEventUpdates), // TODO: customisable
 	}
 }
@@ -59,7 +89,7 @@ func NewConnState(userID string, store ConnStateStore) *ConnState {
 //     N events arrive and get buffered.
 //   - load() bases its current state based on the latest position, which includes processing of these N events.
 //   - post load() we read N events, processing them a 2nd time.
-func (s *ConnState) load(req *Request) error {
+func (s *ConnState) load(sortBy []string) error {
 	joinedRoomIDs, initialLoadPosition, err := s.store.Load(s.userID)
 	if err != nil {
 		return err
@@ -72,15 +102,55 @@ func (s *ConnState) load(req *Request) error {
 		s.sortedJoinedRooms[i] = *sr
 		s.sortedJoinedRoomsPositions[sr.RoomID] = i
 	}
-	s.sort(req.Sort)
+	s.sort(sortBy)
 
 	return nil
 }
 
+// sort the room list by each sort key in turn, falling back to the next key when rooms are equal. Rooms
+// which are equal for every key are sorted by recency. Counts sort highest first, names alphabetically
+// with unnamed rooms last.
 func (s *ConnState) sort(sortBy []string) {
-	// TODO: read sortBy, for now we always sort by most recent timestamp
+	var counts map[string]userRoomData
+	for _, key := range sortBy {
+		if key == SortByNotificationCount || key == SortByHighlightCount || key == SortByUnreadCount {
+			counts = make(map[string]userRoomData, len(s.sortedJoinedRooms))
+			for _, r := range s.sortedJoinedRooms {
+				counts[r.RoomID] = s.store.LoadUserRoomData(r.RoomID, s.userID)
+			}
+			break
+		}
+	}
 	sort.SliceStable(s.sortedJoinedRooms, func(i, j int) bool {
-		return s.sortedJoinedRooms[i].LastMessageTimestamp > s.sortedJoinedRooms[j].LastMessageTimestamp
+		a, b := &s.sortedJoinedRooms[i], &s.sortedJoinedRooms[j]
+		for _, key := range sortBy {
+			switch key {
+			case SortByRecency:
+				if a.LastMessageTimestamp != b.LastMessageTimestamp {
+					return a.LastMessageTimestamp > b.LastMessageTimestamp
+				}
+			case SortByName:
+				if a.Name != b.Name {
+					if a.Name == "" || b.Name == "" {
+						return b.Name == ""
+					}
+					return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+				}
+			case SortByNotificationCount:
+				if x, y := counts[a.RoomID].notificationCount, counts[b.RoomID].notificationCount; x != y {
+					return x > y
+				}
+			case SortByHighlightCount:
+				if x, y := counts[a.RoomID].highlightCount, counts[b.RoomID].highlightCount; x != y {
+					return x > y
+				}
+			case SortByUnreadCount:
+				if x, y := counts[a.RoomID].unreadCount, counts[b.RoomID].unreadCount; x != y {
+					return x > y
+				}
+			}
+		}
+		return a.LastMessageTimestamp > b.LastMessageTimestamp
 	})
 	for i := range s.sortedJoinedRooms {
 		s.sortedJoinedRoomsPositions[s.sortedJoinedRooms[i].RoomID] = i
@@ -88,9 +158,54 @@ func (s *ConnState) sort(sortBy []string) {
 	//logger.Info().Interface("pos", c.sortedJoinedRoomsPositions).Msg("sorted")
 }
 
+// connStateSnapshot is the persisted form of a ConnState. The sorted room list isn't persisted as
+// it is reloaded from the current state of the world when the connection is restored.
+type connStateSnapshot struct {
+	MuxedReq          *Request         `json:"muxed_req"`
+	SentRoomPositions map[string]int64 `json:"sent_room_positions"`
+	ToDeviceSent      []int64          `json:"to_device_sent,omitempty"`
+	ToDeviceReqPos    int64            `json:"to_device_req_pos,omitempty"`
+}
+
+func (s *ConnState) snapshot() *connStateSnapshot {
+	return &connStateSnapshot{
+		MuxedReq:          s.muxedReq,
+		SentRoomPositions: s.sentRoomPositions,
+		ToDeviceSent:      s.toDeviceSent,
+		ToDeviceReqPos:    s.toDeviceReqPos,
+	}
+}
+
+// restore this connection state from a snapshot. The room list will be loaded on the next request,
+// at which point any ranges with rooms which have changed since they were last sent will be re-sent.
+func (s *ConnState) restore(snapshot *connStateSnapshot) {
+	s.muxedReq = snapshot.MuxedReq
+	if s.muxedReq != nil {
+		for roomID, sub := range s.muxedReq.RoomSubscriptions {
+			s.roomSubscriptions[roomID] = sub
+		}
+	}
+	if snapshot.SentRoomPositions != nil {
+		s.sentRoomPositions = snapshot.SentRoomPositions
+	}
+	s.toDeviceSent = snapshot.ToDeviceSent
+	s.toDeviceReqPos = snapshot.ToDeviceReqPos
+	s.restoredRoomPositions = make(map[string]int64, len(s.sentRoomPositions))
+	for roomID, pos := range s.sentRoomPositions {
+		s.restoredRoomPositions[roomID] = pos
+	}
+}
+
 func (s *ConnState) HandleIncomingRequest(ctx context.Context, cid ConnID, req *Request) (*Response, error) {
+	s.deviceID = cid.DeviceID
 	if s.loadPosition == 0 {
-		s.load(req)
+		sortBy := req.Sort
+		if s.muxedReq != nil {
+			// this connection was restored, so the request is a delta on the restored request which may
+			// not include the sort order
+			sortBy = s.muxedReq.Sort
+		}
+		s.load(sortBy)
 	}
 	return s.onIncomingRequest(ctx, req)
 }
@@ -126,6 +241,7 @@ func (s *ConnState) onIncomingRequest(ctx context.Context, req *Request) (*Respo
 		prevRange = s.muxedReq.Rooms
 		prevSort = s.muxedReq.Sort
 	}
+	s.ackToDeviceMessages(req.pos)
 	var newSubs []string
 	var newUnsubs []string
 	if s.muxedReq == nil {
@@ -173,6 +289,15 @@ func (s *ConnState) onIncomingRequest(ctx context.Context, req *Request) (*Respo
 		same = nil
 	}
 
+	if s.restoredRoomPositions != nil {
+		// this connection was restored, so we may have missed updates whilst the connection didn't
+		// exist. Re-send any ranges which have changed since the client last saw them.
+		var stale SliceRanges
+		stale, same = s.staleRanges(same, s.restoredRoomPositions)
+		added = append(added, stale...)
+		s.restoredRoomPositions = nil
+	}
+
 	// send INVALIDATE for these ranges
 	for _, r := range removed {
 		responseOperations = append(responseOperations, &ResponseOpRange{
@@ -196,97 +321,341 @@ func (s *ConnState) onIncomingRequest(ctx context.Context, req *Request) (*Respo
 			Rooms:     roomsResponse,
 		})
 	}
+	s.loadToDeviceMessages(response)
 	// do live tracking if we haven't changed the range and we have nothing to tell the client yet
-	if same != nil && len(responseOperations) == 0 && len(response.RoomSubscriptions) == 0 {
-		// block until we get a new event, with appropriate timeout
-	blockloop:
-		for {
+	if same != nil && len(responseOperations) == 0 && len(response.RoomSubscriptions) == 0 && len(response.ToDevice) == 0 {
+		responseOperations = s.waitForUpdates(ctx, req.timeout, response)
+	}
+
+	response.Ops = responseOperations
+
+	return response, nil
+}
+
+// waitForUpdates blocks until there is something to tell the client, or until the timeout or context
+// expires. A timeout of 0 means we don't block at all and just return whatever has been buffered.
+// Once woken up, all updates already buffered (up to MaxBatchedEventUpdates) are drained and returned
+// together, waiting up to BatchDebounceDuration for more to arrive. Room subscription data is written
+// directly into the response.
+func (s *ConnState) waitForUpdates(ctx context.Context, timeout time.Duration, response *Response) []ResponseOp {
+	var timeoutCh <-chan time.Time // blocks forever if nil
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+	var responseOperations []ResponseOp
+	var debounceCh <-chan time.Time // set when we are woken up and should wait a bit for more updates
+	woken := false
+	numBatched := 0
+	for numBatched < MaxBatchedEventUpdates {
+		var updateEvent *EventData
+		select {
+		case updateEvent = <-s.updateEvents: // always process buffered updates first
+		default:
+			if woken && debounceCh == nil {
+				// we've drained everything that was buffered
+				return responseOperations
+			}
+			if !woken && timeout == 0 {
+				return responseOperations
+			}
 			select {
 			case <-ctx.Done(): // client has given up
-				break blockloop
-			case <-time.After(10 * time.Second): // TODO configurable
-				break blockloop
-			case updateEvent := <-s.updateEvents:
-				if updateEvent.latestPos > s.loadPosition {
-					s.loadPosition = updateEvent.latestPos
-				}
-				// TODO: Add filters to check if this event should cause a response or should be dropped (e.g filtering out messages)
-				// this is why this select is in a while loop as not all update event will wake up the stream
-
-				// TODO: Implement sorting by something other than recency. With recency sorting,
-				// most operations are DELETE/INSERT to bump rooms to the top of the list. We only
-				// do an UPDATE if the most recent room gets a 2nd event.
-				var targetRoom SortableRoom
-				fromIndex, ok := s.sortedJoinedRoomsPositions[updateEvent.roomID]
-				var lastTimestamp int64
-				if !ok {
-					// the user may have just joined the room hence not have an entry in this list yet.
-					fromIndex = len(s.sortedJoinedRooms)
-					newRoom := s.store.LoadRoom(updateEvent.roomID)
-					newRoom.LastMessageTimestamp = updateEvent.timestamp
-					s.sortedJoinedRooms = append(s.sortedJoinedRooms, *newRoom)
-					targetRoom = *newRoom
-				} else {
-					targetRoom = s.sortedJoinedRooms[fromIndex]
-					lastTimestamp = targetRoom.LastMessageTimestamp
-					targetRoom.LastEventJSON = updateEvent.event
-					targetRoom.LastMessageTimestamp = updateEvent.timestamp
-					s.sortedJoinedRooms[fromIndex] = targetRoom
-				}
-				// re-sort
-				s.sort(nil)
-
-				isSubscribedToRoom := false
-				if _, ok := s.roomSubscriptions[updateEvent.roomID]; ok {
-					// there is a subscription for this room, so update the room subscription field
-					response.RoomSubscriptions[updateEvent.roomID] = *s.getDeltaRoomData(updateEvent)
-					isSubscribedToRoom = true
-				}
-				toIndex := s.sortedJoinedRoomsPositions[updateEvent.roomID]
-				logger.Info().Int("from", fromIndex).Int("to", toIndex).
-					Int64("prev_ts", lastTimestamp).Int64("event_ts", updateEvent.timestamp).
-					Interface("room", targetRoom.RoomID).Msg("moved!")
-				// the toIndex may not be inside a tracked range. If it isn't, we actually need to notify about a
-				// different room
-				if !s.muxedReq.Rooms.Inside(int64(toIndex)) {
-					logger.Info().Msg("room isn't inside tracked range")
-					toIndex = int(s.muxedReq.Rooms.UpperClamp(int64(toIndex)))
-					if toIndex >= len(s.sortedJoinedRooms) {
-						// no room exists
-						logger.Warn().Int("to", toIndex).Int("size", len(s.sortedJoinedRooms)).Msg(
-							"cannot move to index, it's greater than the list of sorted rooms",
-						)
-						continue
-					}
-					if toIndex == -1 {
-						logger.Warn().Int("from", fromIndex).Int("to", toIndex).Interface("ranges", s.muxedReq.Rooms).Msg(
-							"room moved but not in tracked ranges, ignoring",
-						)
-						continue
-					}
-					// TODO inject last event if never seen before, else just room ID updateEvent = s.sortedJoinedRooms[toIndex].LastEvent
-					toRoom := s.sortedJoinedRooms[toIndex]
-					// fake an update event for this room.
-					// We do this because we are introducing a new room in the list because of this situation:
-					// tracking [10,20] and room 24 jumps to position 0, so now we are tracking [9,19] as all rooms
-					// have been shifted to the right
-					updateEvent = &EventData{
-						event:  toRoom.LastEventJSON,
-						roomID: toRoom.RoomID,
-					}
-				}
-
-				responseOperations = append(
-					responseOperations, s.moveRoom(updateEvent, fromIndex, toIndex, s.muxedReq.Rooms, isSubscribedToRoom)...,
-				)
-				break blockloop
+				return responseOperations
+			case <-timeoutCh:
+				return responseOperations
+			case <-debounceCh:
+				return responseOperations
+			case updateEvent = <-s.updateEvents:
+			}
+		}
+		if woken {
+			numBatched++
+		}
+		// TODO: Add filters to check if this event should cause a response or should be dropped (e.g filtering out messages)
+		// this is why this is in a loop as not all update events will wake up the stream
+		ops := s.processUpdate(updateEvent, response)
+		responseOperations = coalesceOps(responseOperations, ops)
+		if !woken && (len(responseOperations) > 0 || len(response.RoomSubscriptions) > 0 || len(response.ToDevice) > 0) {
+			woken = true
+			numBatched++
+			if BatchDebounceDuration > 0 {
+				debounceTimer := time.NewTimer(BatchDebounceDuration)
+				defer debounceTimer.Stop()
+				debounceCh = debounceTimer.C
 			}
 		}
 	}
+	return responseOperations
+}
 
-	response.Ops = responseOperations
+// processUpdate applies a single update to the sorted room list and returns the operations to send to
+// the client, which may be none if the update doesn't affect any tracked range.
+func (s *ConnState) processUpdate(updateEvent *EventData, response *Response) []ResponseOp {
+	if updateEvent.toDevice {
+		s.loadToDeviceMessages(response)
+		return nil
+	}
+	if updateEvent.latestPos > s.loadPosition {
+		s.loadPosition = updateEvent.latestPos
+	}
+	if s.isLeaveEvent(updateEvent) {
+		return s.removeRoom(updateEvent, response)
+	}
+	if updateEvent.stateReset {
+		return s.resyncRoom(updateEvent, response)
+	}
 
-	return response, nil
+	// With recency sorting, most operations are DELETE/INSERT to bump rooms to the top of the list. We
+	// only do an UPDATE if the most recent room gets a 2nd event.
+	var targetRoom SortableRoom
+	fromIndex, ok := s.sortedJoinedRoomsPositions[updateEvent.roomID]
+	var lastTimestamp int64
+	if !ok {
+		// the user may have just joined the room hence not have an entry in this list yet.
+		fromIndex = len(s.sortedJoinedRooms)
+		newRoom := s.store.LoadRoom(updateEvent.roomID)
+		newRoom.LastMessageTimestamp = updateEvent.timestamp
+		s.sortedJoinedRooms = append(s.sortedJoinedRooms, *newRoom)
+		targetRoom = *newRoom
+	} else {
+		targetRoom = s.sortedJoinedRooms[fromIndex]
+		lastTimestamp = targetRoom.LastMessageTimestamp
+		if updateEvent.userRoomData != nil {
+			// only the counts have changed, which may move the room when sorting by them
+		} else if !updateEvent.aggregated {
+			targetRoom.LastEventJSON = updateEvent.event
+			targetRoom.LastMessageTimestamp = updateEvent.timestamp
+		} else if updateEvent.bundledLatestEvent != nil &&
+			gjson.GetBytes(updateEvent.bundledLatestEvent, "event_id").Str == gjson.GetBytes(targetRoom.LastEventJSON, "event_id").Str {
+			// the latest event with an edit or reaction bundled into it
+			targetRoom.LastEventJSON = updateEvent.bundledLatestEvent
+		}
+		if updateEvent.latestPos > targetRoom.LastEventNID {
+			targetRoom.LastEventNID = updateEvent.latestPos
+		}
+		s.sortedJoinedRooms[fromIndex] = targetRoom
+	}
+	// re-sort
+	s.sort(s.muxedReq.Sort)
+	response.Count = int64(len(s.sortedJoinedRooms))
+
+	isSubscribedToRoom := s.updateRoomSubscription(updateEvent, response)
+	toIndex := s.sortedJoinedRoomsPositions[updateEvent.roomID]
+	if updateEvent.aggregated && toIndex == fromIndex && !s.muxedReq.Rooms.Inside(int64(toIndex)) {
+		// edits and reactions don't move the room, so there is nothing to tell the client
+		return nil
+	}
+	logger.Info().Int("from", fromIndex).Int("to", toIndex).
+		Int64("prev_ts", lastTimestamp).Int64("event_ts", updateEvent.timestamp).
+		Interface("room", targetRoom.RoomID).Msg("moved!")
+	// the toIndex may not be inside a tracked range. If it isn't, we actually need to notify about a
+	// different room
+	if !s.muxedReq.Rooms.Inside(int64(toIndex)) {
+		logger.Info().Msg("room isn't inside tracked range")
+		toIndex = int(s.muxedReq.Rooms.UpperClamp(int64(toIndex)))
+		if toIndex >= len(s.sortedJoinedRooms) {
+			// no room exists
+			logger.Warn().Int("to", toIndex).Int("size", len(s.sortedJoinedRooms)).Msg(
+				"cannot move to index, it's greater than the list of sorted rooms",
+			)
+			return nil
+		}
+		if toIndex == -1 {
+			logger.Warn().Int("from", fromIndex).Int("to", toIndex).Interface("ranges", s.muxedReq.Rooms).Msg(
+				"room moved but not in tracked ranges, ignoring",
+			)
+			return nil
+		}
+		// TODO inject last event if never seen before, else just room ID updateEvent = s.sortedJoinedRooms[toIndex].LastEvent
+		toRoom := s.sortedJoinedRooms[toIndex]
+		// fake an update event for this room.
+		// We do this because we are introducing a new room in the list because of this situation:
+		// tracking [10,20] and room 24 jumps to position 0, so now we are tracking [9,19] as all rooms
+		// have been shifted to the right
+		updateEvent = &EventData{
+			event:  toRoom.LastEventJSON,
+			roomID: toRoom.RoomID,
+		}
+	}
+
+	return s.moveRoom(updateEvent, fromIndex, toIndex, s.muxedReq.Rooms, isSubscribedToRoom)
+}
+
+// ackToDeviceMessages deletes the to-device messages sent in the last response if this request has a later
+// position, as the client must have received them. Requests with the same position (e.g retries with a
+// different body) or without a position are sent the messages again instead.
+func (s *ConnState) ackToDeviceMessages(pos int64) {
+	if len(s.toDeviceSent) > 0 && pos != 0 && pos != s.toDeviceReqPos {
+		s.store.DeleteToDeviceMessages(s.deviceID, s.toDeviceSent)
+		s.toDeviceSent = nil
+	}
+	s.toDeviceReqPos = pos
+}
+
+// loadToDeviceMessages adds the queued to-device messages for this device to the response, if the client
+// asked for them. Messages aren't deleted until they have been acknowledged, so this can be called again
+// to pick up new messages.
+func (s *ConnState) loadToDeviceMessages(response *Response) {
+	toDevice := s.muxedReq.ToDevice
+	if toDevice == nil {
+		return
+	}
+	response.ToDevice, s.toDeviceSent = s.store.LoadToDeviceMessages(s.deviceID, toDevice.GetLimit(), toDevice.RoomKeysFirst)
+}
+
+// updateRoomSubscription adds this update to the response if there is a subscription for the room.
+// Returns true if the room is subscribed to.
+func (s *ConnState) updateRoomSubscription(updateEvent *EventData, response *Response) bool {
+	if _, ok := s.roomSubscriptions[updateEvent.roomID]; !ok {
+		return false
+	}
+	var delta *Room
+	if updateEvent.stateReset {
+		delta = s.getStateResetRoomData(updateEvent.roomID)
+	} else {
+		delta = s.getDeltaRoomData(updateEvent)
+	}
+	if existing, ok := response.RoomSubscriptions[updateEvent.roomID]; ok {
+		mergeRoom(&existing, delta)
+		delta = &existing
+	}
+	response.RoomSubscriptions[updateEvent.roomID] = *delta
+	return true
+}
+
+// isLeaveEvent returns true if this update is the user leaving the room, including being kicked or banned.
+func (s *ConnState) isLeaveEvent(updateEvent *EventData) bool {
+	if updateEvent.eventType != "m.room.member" || updateEvent.stateKey == nil || *updateEvent.stateKey != s.userID {
+		return false
+	}
+	membership := updateEvent.content.Get("membership").Str
+	return membership == "leave" || membership == "ban"
+}
+
+// removeRoom removes a room the user has left from the sorted room list, and returns the operations to
+// shift the rest of each tracked range up to fill the gap. Rooms which aren't in the list, e.g because
+// they were first seen when the user left them, are ignored.
+func (s *ConnState) removeRoom(updateEvent *EventData, response *Response) []ResponseOp {
+	isSubscribedToRoom := s.updateRoomSubscription(updateEvent, response)
+	fromIndex, ok := s.sortedJoinedRoomsPositions[updateEvent.roomID]
+	if !ok {
+		return nil
+	}
+	var ops []ResponseOp
+	if !isSubscribedToRoom && !updateEvent.stateReset && s.muxedReq.Rooms.Inside(int64(fromIndex)) {
+		// send the leave event so the client knows why the room is being removed
+		ops = append(ops, &ResponseOpSingle{
+			Operation: "UPDATE",
+			Index:     &fromIndex,
+			Room:      s.getDeltaRoomData(updateEvent),
+		})
+	}
+	s.sortedJoinedRooms = append(s.sortedJoinedRooms[:fromIndex], s.sortedJoinedRooms[fromIndex+1:]...)
+	delete(s.sortedJoinedRoomsPositions, updateEvent.roomID)
+	delete(s.sentRoomPositions, updateEvent.roomID)
+	s.sort(s.muxedReq.Sort)
+	response.Count = int64(len(s.sortedJoinedRooms))
+
+	// Every room after the removed room moves up by 1. For each range, DELETE the first index which moved
+	// and INSERT the room which is now at the end of the range, which shifts everything in between.
+	lastIndex := int64(len(s.sortedJoinedRooms) - 1)
+	for _, r := range s.muxedReq.Rooms {
+		if r[1] < int64(fromIndex) || r[0] > lastIndex+1 {
+			// nothing in this range moved
+			continue
+		}
+		deleteIndex := int(r[0])
+		if deleteIndex < fromIndex {
+			deleteIndex = fromIndex
+		}
+		ops = append(ops, &ResponseOpSingle{
+			Operation: "DELETE",
+			Index:     &deleteIndex,
+		})
+		insertIndex := int(r[1])
+		if r[1] > lastIndex {
+			// the list no longer fills this range, so the last room moves up and leaves an empty slot
+			insertIndex = int(lastIndex)
+		}
+		if insertIndex < deleteIndex {
+			// the removed room was the last room in the list, so nothing moved
+			continue
+		}
+		ops = append(ops, &ResponseOpSingle{
+			Operation: "INSERT",
+			Index:     &insertIndex,
+			Room:      s.roomDataForInsert(s.sortedJoinedRooms[insertIndex].RoomID),
+		})
+		if insertIndex < int(r[1]) {
+			emptyIndex := insertIndex + 1
+			ops = append(ops, &ResponseOpSingle{
+				Operation: "DELETE",
+				Index:     &emptyIndex,
+			})
+		}
+	}
+	return ops
+}
+
+// resyncRoom re-sends the room with its current state, as the state was replaced rather than changed by new
+// events. This is sent as a SYNC for the room with no timeline, as the client has already seen every event.
+func (s *ConnState) resyncRoom(updateEvent *EventData, response *Response) []ResponseOp {
+	s.updateRoomSubscription(updateEvent, response)
+	index, ok := s.sortedJoinedRoomsPositions[updateEvent.roomID]
+	if !ok || !s.muxedReq.Rooms.Inside(int64(index)) {
+		return nil
+	}
+	room := &Room{
+		RoomID: updateEvent.roomID,
+	}
+	if _, ok := s.roomSubscriptions[updateEvent.roomID]; !ok {
+		room = s.getStateResetRoomData(updateEvent.roomID)
+	}
+	return []ResponseOp{
+		&ResponseOpRange{
+			Operation: "SYNC",
+			Range:     []int64{int64(index), int64(index)},
+			Rooms:     []Room{*room},
+		},
+	}
+}
+
+// roomDataForInsert returns the room data to send when a room enters a tracked range. Only the room ID is
+// sent for subscribed rooms as their data is sent via the subscription.
+func (s *ConnState) roomDataForInsert(roomID string) *Room {
+	if _, ok := s.roomSubscriptions[roomID]; ok {
+		return &Room{
+			RoomID: roomID,
+		}
+	}
+	return s.getInitialRoomData(roomID)
+}
+
+// staleRanges splits the ranges given into those which contain rooms which have changed since the
+// positions given (or which weren't sent at all), and those which haven't changed.
+func (s *ConnState) staleRanges(ranges SliceRanges, sentPositions map[string]int64) (stale, fresh SliceRanges) {
+	for _, r := range ranges {
+		sr := SliceRanges([][2]int64{r})
+		subslice := sr.SliceInto(s.sortedJoinedRooms)
+		isStale := false
+		if len(subslice) > 0 {
+			for _, room := range subslice[0].(SortableRooms) {
+				pos, ok := sentPositions[room.RoomID]
+				if !ok || room.LastEventNID > pos {
+					isStale = true
+					break
+				}
+			}
+		}
+		if isStale {
+			stale = append(stale, r)
+		} else {
+			fresh = append(fresh, r)
+		}
+	}
+	return
 }
 
 func (s *ConnState) updateRoomSubscriptions(subs, unsubs []string) map[string]Room {
@@ -302,6 +671,9 @@ func (s *ConnState) updateRoomSubscriptions(subs, unsubs []string) map[string]Ro
 		s.roomSubscriptions[roomID] = sub
 		// send initial room information
 		room := s.getInitialRoomData(roomID)
+		if sub.ThreadRoot != "" {
+			room.Timeline = s.store.LoadThreadTimeline(roomID, sub.ThreadRoot, s.muxedReq.GetTimelineLimit(roomID))
+		}
 		result[roomID] = *room
 	}
 	for _, roomID := range unsubs {
@@ -312,33 +684,86 @@ func (s *ConnState) updateRoomSubscriptions(subs, unsubs []string) map[string]Ro
 
 func (s *ConnState) getDeltaRoomData(updateEvent *EventData) *Room {
 	userRoomData := s.store.LoadUserRoomData(updateEvent.roomID, s.userID)
+	s.sentRoomPositions[updateEvent.roomID] = s.loadPosition
 	room := &Room{
 		RoomID:            updateEvent.roomID,
 		NotificationCount: int64(userRoomData.notificationCount),
 		HighlightCount:    int64(userRoomData.highlightCount),
+		UnreadCount:       int64(userRoomData.unreadCount),
 	}
-	if updateEvent.event != nil {
+	if ev := s.timelineEvent(updateEvent); ev != nil {
 		room.Timeline = []json.RawMessage{
-			updateEvent.event,
+			ev,
 		}
 	}
+	if updateEvent.prevBatch != "" {
+		room.Limited = true
+		room.PrevBatch = updateEvent.prevBatch
+	}
 	return room
 }
 
 func (s *ConnState) getInitialRoomData(roomID string) *Room {
 	r := s.store.LoadRoom(roomID)
 	userRoomData := s.store.LoadUserRoomData(roomID, s.userID)
-	return &Room{
+	s.sentRoomPositions[roomID] = s.loadPosition
+	room := &Room{
 		RoomID:            roomID,
 		Name:              r.Name,
 		NotificationCount: int64(userRoomData.notificationCount),
 		HighlightCount:    int64(userRoomData.highlightCount),
+		UnreadCount:       int64(userRoomData.unreadCount),
 		// TODO: timeline limits
-		Timeline: []json.RawMessage{
-			r.LastEventJSON,
-		},
+		Timeline:      s.initialTimeline(roomID, r),
 		RequiredState: s.store.LoadState(roomID, s.loadPosition, s.muxedReq.GetRequiredState(roomID)),
 	}
+	if len(room.Timeline) > 0 {
+		// tell the client if there is a gap before the timeline we're sending
+		if eventID := gjson.GetBytes(room.Timeline[0], "event_id").Str; eventID != "" {
+			room.PrevBatch = s.store.LoadPrevBatch(eventID)
+			room.Limited = room.PrevBatch != ""
+		}
+	}
+	return room
+}
+
+// initialTimeline returns the timeline for a room which is new to the client. If thread replies are
+// excluded and the latest event is a thread reply, the latest event in the main timeline is used.
+func (s *ConnState) initialTimeline(roomID string, r *SortableRoom) []json.RawMessage {
+	if s.muxedReq.ExcludesThreadReplies() && state.ThreadRootID(gjson.ParseBytes(r.LastEventJSON)) != "" {
+		return s.store.LoadMainTimeline(roomID, s.loadPosition)
+	}
+	return []json.RawMessage{
+		r.LastEventJSON,
+	}
+}
+
+// timelineEvent returns the event to send in the timeline for this update, or nil if there isn't one.
+// Subscriptions to a thread only get events in the thread. Thread replies are replaced by the thread root
+// with an updated thread summary if thread replies are excluded.
+func (s *ConnState) timelineEvent(updateEvent *EventData) json.RawMessage {
+	if updateEvent.event == nil {
+		return nil
+	}
+	if sub, ok := s.roomSubscriptions[updateEvent.roomID]; ok && sub.ThreadRoot != "" {
+		if updateEvent.threadRoot == sub.ThreadRoot || gjson.GetBytes(updateEvent.event, "event_id").Str == sub.ThreadRoot {
+			return updateEvent.event
+		}
+		return nil
+	}
+	if updateEvent.threadRoot != "" && s.muxedReq.ExcludesThreadReplies() {
+		return updateEvent.threadRootEvent
+	}
+	return updateEvent.event
+}
+
+// getStateResetRoomData returns the room with its current state and no timeline.
+func (s *ConnState) getStateResetRoomData(roomID string) *Room {
+	room := s.getInitialRoomData(roomID)
+	room.Timeline = nil
+	room.Limited = false
+	room.PrevBatch = ""
+	return room
 }
 
 func (s *ConnState) UserID() string {
@@ -395,3 +820,77 @@ func (s *ConnState) moveRoom(updateEvent *EventData, fromIndex, toIndex int, ran
 	}
 
 }
+
+// coalesceOps appends the operations for a single update onto the existing list of operations, merging
+// them with the tail of the existing list where they refer to the same room. For example:
+//   - UPDATE index=0 room=A, UPDATE index=0 room=A => UPDATE index=0 room=A (with both timelines)
+//   - INSERT index=0 room=A, UPDATE index=0 room=A => INSERT index=0 room=A (with both timelines)
+//   - INSERT index=3 room=A, DELETE index=3, INSERT index=0 room=A => INSERT index=0 room=A
+//
+// This is only done for the tail of the list as any other operation may have shifted the indexes around.
+func coalesceOps(existing, next []ResponseOp) []ResponseOp {
+	if len(existing) == 0 || len(next) == 0 {
+		return append(existing, next...)
+	}
+	last, ok := existing[len(existing)-1].(*ResponseOpSingle)
+	if !ok || last.Room == nil || last.Index == nil || (last.Operation != "INSERT" && last.Operation != "UPDATE") {
+		return append(existing, next...)
+	}
+	first, ok := next[0].(*ResponseOpSingle)
+	if !ok || first.Index == nil || *first.Index != *last.Index {
+		return append(existing, next...)
+	}
+	switch {
+	case len(next) == 1 && first.Operation == "UPDATE" && first.Room != nil && first.Room.RoomID == last.Room.RoomID:
+		mergeRoom(last.Room, first.Room)
+		return existing
+	case len(next) == 2 && first.Operation == "DELETE" && last.Operation == "INSERT":
+		insert, ok := next[1].(*ResponseOpSingle)
+		if !ok || insert.Room == nil || insert.Room.RoomID != last.Room.RoomID {
+			return append(existing, next...)
+		}
+		// the room we inserted is immediately deleted and re-inserted elsewhere, so just insert it there.
+		// Keep the room data from the first INSERT as it may contain data the second one doesn't.
+		mergeRoom(last.Room, insert.Room)
+		insert.Room = last.Room
+		return append(existing[:len(existing)-1], insert)
+	}
+	return append(existing, next...)
+}
+
+// mergeRoom merges the room data in `next` into `existing`. Timeline events are appended (ignoring
+// duplicates) and other fields are replaced if they are set in `next`.
+func mergeRoom(existing, next *Room) {
+	if next.Name != "" {
+		existing.Name = next.Name
+	}
+	if next.RequiredState != nil {
+		existing.RequiredState = next.RequiredState
+	}
+	if next.Limited {
+		// the events before the gap are superseded by the events after it
+		existing.Timeline = nil
+		existing.Limited = true
+		existing.PrevBatch = next.PrevBatch
+	}
+	for _, ev := range next.Timeline {
+		isDupe := false
+		for _, existingEv := range existing.Timeline {
+			if bytes.Equal(existingEv, ev) {
+				isDupe = true
+				break
+			}
+			eventID := gjson.GetBytes(ev, "event_id").Str
+			if eventID != "" && eventID == gjson.GetBytes(existingEv, "event_id").Str {
+				isDupe = true
+				break
+			}
+		}
+		if !isDupe {
+			existing.Timeline = append(existing.Timeline, ev)
+		}
+	}
+	existing.NotificationCount = next.NotificationCount
+	existing.HighlightCount = next.HighlightCount
+	existing.UnreadCount = next.UnreadCount
+}
@@ -6,8 +6,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/matrix-org/sync-v3/state"
+	"github.com/tidwall/gjson"
 )
 
 func newSortableRoom(roomID string, lastMsgTimestamp int64) SortableRoom {
@@ -25,6 +29,16 @@ type connStateStoreMock struct {
 	roomIDToRoom        map[string]SortableRoom
 	userIDToJoinedRooms map[string][]string
 	userIDToPosition    map[string]int64
+
+	roomIDToMainTimeline map[string][]json.RawMessage
+	threadRootToTimeline map[string][]json.RawMessage
+	roomIDToUserRoomData map[string]userRoomData
+	eventIDToPrevBatch   map[string]string
+
+	toDeviceMu        sync.Mutex
+	toDeviceMsgs      []json.RawMessage
+	toDevicePositions []int64
+	toDeviceDeleted   []int64
 }
 
 func (s *connStateStoreMock) LoadRoom(roomID string) *SortableRoom {
@@ -42,13 +56,67 @@ func (s *connStateStoreMock) Load(userID string) (joinedRoomIDs []string, initia
 func (s *connStateStoreMock) LoadState(roomID string, loadPosition int64, requiredState [][2]string) []json.RawMessage {
 	return nil
 }
+func (s *connStateStoreMock) LoadMainTimeline(roomID string, loadPosition int64) []json.RawMessage {
+	return s.roomIDToMainTimeline[roomID]
+}
+func (s *connStateStoreMock) LoadThreadTimeline(roomID, threadRoot string, limit int64) []json.RawMessage {
+	return s.threadRootToTimeline[threadRoot]
+}
+func (s *connStateStoreMock) LoadPrevBatch(eventID string) string {
+	return s.eventIDToPrevBatch[eventID]
+}
 func (s *connStateStoreMock) LoadUserRoomData(roomID, userID string) userRoomData {
-	return userRoomData{}
+	return s.roomIDToUserRoomData[roomID]
+}
+func (s *connStateStoreMock) LoadToDeviceMessages(deviceID string, limit int64, roomKeysFirst bool) (msgs []json.RawMessage, positions []int64) {
+	s.toDeviceMu.Lock()
+	defer s.toDeviceMu.Unlock()
+	var rest []json.RawMessage
+	var restPositions []int64
+	for i, msg := range s.toDeviceMsgs {
+		if roomKeysFirst && gjson.GetBytes(msg, "type").Str == "m.room_key" {
+			msgs = append(msgs, msg)
+			positions = append(positions, s.toDevicePositions[i])
+		} else {
+			rest = append(rest, msg)
+			restPositions = append(restPositions, s.toDevicePositions[i])
+		}
+	}
+	msgs = append(msgs, rest...)
+	positions = append(positions, restPositions...)
+	if int64(len(msgs)) > limit {
+		msgs = msgs[:limit]
+		positions = positions[:limit]
+	}
+	return
+}
+func (s *connStateStoreMock) DeleteToDeviceMessages(deviceID string, positions []int64) {
+	s.toDeviceMu.Lock()
+	defer s.toDeviceMu.Unlock()
+	s.toDeviceDeleted = append(s.toDeviceDeleted, positions...)
+	deleted := make(map[int64]bool, len(positions))
+	for _, pos := range positions {
+		deleted[pos] = true
+	}
+	var msgs []json.RawMessage
+	var msgPositions []int64
+	for i, pos := range s.toDevicePositions {
+		if !deleted[pos] {
+			msgs = append(msgs, s.toDeviceMsgs[i])
+			msgPositions = append(msgPositions, pos)
+		}
+	}
+	s.toDeviceMsgs = msgs
+	s.toDevicePositions = msgPositions
 }
 func (s *connStateStoreMock) PushNewEvent(cs *ConnState, ed *EventData) {
 	room := s.roomIDToRoom[ed.roomID]
-	room.LastEventJSON = ed.event
-	room.LastMessageTimestamp = ed.timestamp
+	if !ed.aggregated {
+		room.LastEventJSON = ed.event
+		room.LastMessageTimestamp = ed.timestamp
+	} else if ed.bundledLatestEvent != nil {
+		room.LastEventJSON = ed.bundledLatestEvent
+	}
 	if ed.eventType == "m.room.name" {
 		room.Name = ed.content.Get("name").Str
 	}
@@ -56,6 +124,40 @@ func (s *connStateStoreMock) PushNewEvent(cs *ConnState, ed *EventData) {
 	cs.PushNewEvent(ed)
 }
 
+const (
+	testUserID       = "@alice:localhost"
+	testTimestampNow = int64(1632131678061)
+)
+
+var testConnID = ConnID{
+	SessionID: "s",
+	DeviceID:  "d",
+}
+
+// newTestConnState makes a ConnState for testUserID, who is joined to these rooms, and returns it along with
+// its store so tests can set up more data before the first request.
+func newTestConnState(rooms ...SortableRoom) (*ConnState, *connStateStoreMock) {
+	csm := &connStateStoreMock{
+		userIDToJoinedRooms: make(map[string][]string),
+		roomIDToRoom:        make(map[string]SortableRoom),
+	}
+	for _, room := range rooms {
+		csm.userIDToJoinedRooms[testUserID] = append(csm.userIDToJoinedRooms[testUserID], room.RoomID)
+		csm.roomIDToRoom[room.RoomID] = room
+	}
+	return NewConnState(testUserID, csm), csm
+}
+
+// mustHandleRequest sends this request to the ConnState as testConnID, failing the test if it returns an error.
+func mustHandleRequest(t *testing.T, cs *ConnState, req *Request) *Response {
+	t.Helper()
+	res, err := cs.HandleIncomingRequest(context.Background(), testConnID, req)
+	if err != nil {
+		t.Fatalf("HandleIncomingRequest returned error : %s", err)
+	}
+	return res
+}
+
 // Sync an account with 3 rooms and check that we can grab all rooms and they are sorted correctly initially. Checks
 // that basic UPDATE and DELETE/INSERT works when tracking all rooms.
 func TestConnStateInitial(t *testing.T) {
@@ -574,6 +676,967 @@ func TestConnStateRoomSubscriptions(t *testing.T) {
 	})
 }
 
+// Test that the long-poll timeout is honoured, and that a timeout of 0 returns immediately with
+// whatever is buffered.
+func TestConnStateTimeout(t *testing.T) {
+	roomA := newSortableRoom("!a:localhost", testTimestampNow)
+	roomB := newSortableRoom("!b:localhost", testTimestampNow-1000)
+	cs, csm := newTestConnState(roomA, roomB)
+	mustHandleRequest(t, cs, &Request{
+		Sort: []string{SortByRecency},
+		Rooms: SliceRanges([][2]int64{
+			{0, 1},
+		}),
+	})
+
+	// nothing buffered: a timeout should block for that long
+	timeout := 50 * time.Millisecond
+	start := time.Now()
+	res := mustHandleRequest(t, cs, &Request{
+		timeout: timeout,
+	})
+	if took := time.Since(start); took < timeout {
+		t.Errorf("HandleIncomingRequest returned after %v, want at least %v", took, timeout)
+	}
+	if len(res.Ops) > 0 {
+		t.Errorf("response returned ops, expected none")
+	}
+
+	// nothing buffered: a timeout of 0 should return immediately
+	start = time.Now()
+	res = mustHandleRequest(t, cs, &Request{
+		timeout: 0,
+	})
+	if took := time.Since(start); took >= timeout {
+		t.Errorf("HandleIncomingRequest with timeout=0 took %v, want it to return immediately", took)
+	}
+	if len(res.Ops) > 0 {
+		t.Errorf("response returned ops, expected none")
+	}
+
+	// something buffered: a timeout of 0 should return it
+	csm.PushNewEvent(cs, &EventData{
+		event:     json.RawMessage(`{}`),
+		roomID:    roomB.RoomID,
+		eventType: "unimportant",
+		timestamp: testTimestampNow + 1000,
+	})
+	res = mustHandleRequest(t, cs, &Request{
+		timeout: 0,
+	})
+	checkResponse(t, true, res, &Response{
+		Count: 2,
+		Ops: []ResponseOp{
+			&ResponseOpSingle{
+				Operation: "DELETE",
+				Index:     intPtr(1),
+			},
+			&ResponseOpSingle{
+				Operation: "INSERT",
+				Index:     intPtr(0),
+				Room: &Room{
+					RoomID: roomB.RoomID,
+				},
+			},
+		},
+	})
+}
+
+// Test that multiple buffered updates are returned in a single response, with updates to the same room
+// coalesced together.
+func TestConnStateBatchesUpdates(t *testing.T) {
+	roomA := newSortableRoom("!a:localhost", testTimestampNow)
+	roomB := newSortableRoom("!b:localhost", testTimestampNow-1000)
+	roomC := newSortableRoom("!c:localhost", testTimestampNow-2000)
+	cs, csm := newTestConnState(roomA, roomB, roomC)
+	mustHandleRequest(t, cs, &Request{
+		Sort: []string{SortByRecency},
+		Rooms: SliceRanges([][2]int64{
+			{0, 2},
+		}),
+	})
+
+	// C gets 2 events then B gets an event
+	// A,B,C => C,A,B => C,A,B => B,C,A
+	c2 := json.RawMessage(`{"event_id":"$c2"}`)
+	b1 := json.RawMessage(`{"event_id":"$b1"}`)
+	csm.PushNewEvent(cs, &EventData{
+		event:     json.RawMessage(`{"event_id":"$c1"}`),
+		roomID:    roomC.RoomID,
+		eventType: "unimportant",
+		timestamp: testTimestampNow + 1000,
+	})
+	csm.PushNewEvent(cs, &EventData{
+		event:     c2,
+		roomID:    roomC.RoomID,
+		eventType: "unimportant",
+		timestamp: testTimestampNow + 2000,
+	})
+	csm.PushNewEvent(cs, &EventData{
+		event:     b1,
+		roomID:    roomB.RoomID,
+		eventType: "unimportant",
+		timestamp: testTimestampNow + 3000,
+	})
+	res := mustHandleRequest(t, cs, &Request{
+		timeout: time.Second,
+	})
+	checkResponse(t, true, res, &Response{
+		Count: 3,
+		Ops: []ResponseOp{
+			&ResponseOpSingle{
+				Operation: "DELETE",
+				Index:     intPtr(2),
+			},
+			&ResponseOpSingle{
+				Operation: "INSERT",
+				Index:     intPtr(0),
+				Room: &Room{
+					RoomID: roomC.RoomID,
+				},
+			},
+			&ResponseOpSingle{
+				Operation: "DELETE",
+				Index:     intPtr(2),
+			},
+			&ResponseOpSingle{
+				Operation: "INSERT",
+				Index:     intPtr(0),
+				Room: &Room{
+					RoomID: roomB.RoomID,
+				},
+			},
+		},
+	})
+	// the coalesced INSERT for C should include the latest event without duplicates, as the UPDATE for
+	// the 2nd event is merged into the INSERT which already loaded it
+	insertC := res.Ops[1].(*ResponseOpSingle)
+	if len(insertC.Room.Timeline) != 1 || !bytes.Equal(insertC.Room.Timeline[0], c2) {
+		t.Errorf("INSERT for C: got timeline %v want [%s]", serialise(t, insertC.Room.Timeline), c2)
+	}
+}
+
+// Test that updates which arrive within BatchDebounceDuration of the update which wakes up the request
+// are returned in the same response.
+func TestConnStateBatchDebounce(t *testing.T) {
+	defer func(d time.Duration) {
+		BatchDebounceDuration = d
+	}(BatchDebounceDuration)
+	BatchDebounceDuration = 200 * time.Millisecond
+	roomA := newSortableRoom("!a:localhost", testTimestampNow)
+	roomB := newSortableRoom("!b:localhost", testTimestampNow-1000)
+	roomC := newSortableRoom("!c:localhost", testTimestampNow-2000)
+	cs, _ := newTestConnState(roomA, roomB, roomC)
+	mustHandleRequest(t, cs, &Request{
+		Sort: []string{SortByRecency},
+		Rooms: SliceRanges([][2]int64{
+			{0, 2},
+		}),
+	})
+
+	// C gets an event which wakes up the waiting request, then B gets an event inside the debounce window
+	// A,B,C => C,A,B => B,C,A
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cs.PushNewEvent(&EventData{
+			event:     json.RawMessage(`{"event_id":"$c1"}`),
+			roomID:    roomC.RoomID,
+			eventType: "unimportant",
+			timestamp: testTimestampNow + 1000,
+		})
+		time.Sleep(50 * time.Millisecond)
+		cs.PushNewEvent(&EventData{
+			event:     json.RawMessage(`{"event_id":"$b1"}`),
+			roomID:    roomB.RoomID,
+			eventType: "unimportant",
+			timestamp: testTimestampNow + 2000,
+		})
+	}()
+	res := mustHandleRequest(t, cs, &Request{
+		timeout: 2 * time.Second,
+	})
+	checkResponse(t, true, res, &Response{
+		Count: 3,
+		Ops: []ResponseOp{
+			&ResponseOpSingle{
+				Operation: "DELETE",
+				Index:     intPtr(2),
+			},
+			&ResponseOpSingle{
+				Operation: "INSERT",
+				Index:     intPtr(0),
+				Room: &Room{
+					RoomID: roomC.RoomID,
+				},
+			},
+			&ResponseOpSingle{
+				Operation: "DELETE",
+				Index:     intPtr(2),
+			},
+			&ResponseOpSingle{
+				Operation: "INSERT",
+				Index:     intPtr(0),
+				Room: &Room{
+					RoomID: roomB.RoomID,
+				},
+			},
+		},
+	})
+}
+
+// Test that clients are told about timeline gaps, and that events before the gap are dropped when
+// updates are batched together.
+func TestConnStateLimitedTimeline(t *testing.T) {
+	roomA := newSortableRoom("!a:localhost", testTimestampNow)
+	roomB := newSortableRoom("!b:localhost", testTimestampNow-1000)
+	cs, csm := newTestConnState(roomA, roomB)
+	mustHandleRequest(t, cs, &Request{
+		Sort: []string{SortByRecency},
+		Rooms: SliceRanges([][2]int64{
+			{0, 1},
+		}),
+	})
+
+	// A gets an event, then a gap, then 2 more events
+	a2 := json.RawMessage(`{"event_id":"$a2"}`)
+	a3 := json.RawMessage(`{"event_id":"$a3"}`)
+	csm.PushNewEvent(cs, &EventData{
+		event:     json.RawMessage(`{"event_id":"$a1"}`),
+		roomID:    roomA.RoomID,
+		eventType: "unimportant",
+		timestamp: testTimestampNow + 1000,
+	})
+	csm.PushNewEvent(cs, &EventData{
+		event:     a2,
+		roomID:    roomA.RoomID,
+		eventType: "unimportant",
+		timestamp: testTimestampNow + 2000,
+		prevBatch: "prev_batch_token",
+	})
+	csm.PushNewEvent(cs, &EventData{
+		event:     a3,
+		roomID:    roomA.RoomID,
+		eventType: "unimportant",
+		timestamp: testTimestampNow + 3000,
+	})
+	res := mustHandleRequest(t, cs, &Request{
+		timeout: time.Second,
+	})
+	checkResponse(t, true, res, &Response{
+		Count: 2,
+		Ops: []ResponseOp{
+			&ResponseOpSingle{
+				Operation: "UPDATE",
+				Index:     intPtr(0),
+				Room: &Room{
+					RoomID: roomA.RoomID,
+				},
+			},
+		},
+	})
+	room := res.Ops[0].(*ResponseOpSingle).Room
+	if !room.Limited || room.PrevBatch != "prev_batch_token" {
+		t.Errorf("UPDATE for A: got limited=%v prev_batch=%s want limited=true prev_batch=prev_batch_token", room.Limited, room.PrevBatch)
+	}
+	wantTimeline := []json.RawMessage{a2, a3}
+	if !reflect.DeepEqual(room.Timeline, wantTimeline) {
+		t.Errorf("UPDATE for A: got timeline %v want %v", serialise(t, room.Timeline), serialise(t, wantTimeline))
+	}
+}
+
+// Test that rooms sent to the client for the first time say if there is a gap before their timeline.
+func TestConnStateLimitedTimelineInitial(t *testing.T) {
+	roomA := newSortableRoom("!a:localhost", testTimestampNow)
+	roomA.LastEventJSON = json.RawMessage(`{"event_id":"$a1"}`)
+	roomB := newSortableRoom("!b:localhost", testTimestampNow-1000)
+	roomB.LastEventJSON = json.RawMessage(`{"event_id":"$b1"}`)
+	cs, csm := newTestConnState(roomA, roomB)
+	csm.eventIDToPrevBatch = map[string]string{
+		"$a1": "prev_batch_token",
+	}
+	res := mustHandleRequest(t, cs, &Request{
+		Sort: []string{SortByRecency},
+		Rooms: SliceRanges([][2]int64{
+			{0, 1},
+		}),
+	})
+	checkResponse(t, true, res, &Response{
+		Count: 2,
+		Ops: []ResponseOp{
+			&ResponseOpRange{
+				Operation: "SYNC",
+				Range:     []int64{0, 1},
+				Rooms: []Room{
+					{
+						RoomID: roomA.RoomID,
+					},
+					{
+						RoomID: roomB.RoomID,
+					},
+				},
+			},
+		},
+	})
+	rooms := res.Ops[0].(*ResponseOpRange).Rooms
+	if !rooms[0].Limited || rooms[0].PrevBatch != "prev_batch_token" {
+		t.Errorf("SYNC for A: got limited=%v prev_batch=%s want limited=true prev_batch=prev_batch_token", rooms[0].Limited, rooms[0].PrevBatch)
+	}
+	if rooms[1].Limited || rooms[1].PrevBatch != "" {
+		t.Errorf("SYNC for B: got limited=%v prev_batch=%s want no gap", rooms[1].Limited, rooms[1].PrevBatch)
+	}
+}
+
+// Test that rooms are removed from the list when the user leaves them, and the rest of the range is
+// shifted up to fill the gap.
+func TestConnStateLeaveRoom(t *testing.T) {
+	roomA := newSortableRoom("!a:localhost", testTimestampNow)
+	roomB := newSortableRoom("!b:localhost", testTimestampNow-1000)
+	roomC := newSortableRoom("!c:localhost", testTimestampNow-2000)
+	roomD := newSortableRoom("!d:localhost", testTimestampNow-3000)
+	cs, csm := newTestConnState(roomA, roomB, roomC, roomD)
+	mustHandleRequest(t, cs, &Request{
+		Sort: []string{SortByRecency},
+		Rooms: SliceRanges([][2]int64{
+			{0, 2},
+		}),
+	})
+	leave := func(roomID string, timestamp int64) {
+		leaveEvent := json.RawMessage(fmt.Sprintf(
+			`{"type":"m.room.member","state_key":"%s","content":{"membership":"leave"}}`, testUserID,
+		))
+		stateKey := testUserID
+		csm.PushNewEvent(cs, &EventData{
+			event:     leaveEvent,
+			roomID:    roomID,
+			eventType: "m.room.member",
+			stateKey:  &stateKey,
+			content:   gjson.ParseBytes(leaveEvent).Get("content"),
+			timestamp: timestamp,
+		})
+	}
+
+	// leave B in the middle of the range: D moves into the range
+	leave(roomB.RoomID, testTimestampNow+1000)
+	res := mustHandleRequest(t, cs, &Request{
+		timeout: time.Second,
+	})
+	checkResponse(t, true, res, &Response{
+		Count: 3,
+		Ops: []ResponseOp{
+			&ResponseOpSingle{
+				Operation: "UPDATE",
+				Index:     intPtr(1),
+				Room: &Room{
+					RoomID: roomB.RoomID,
+				},
+			},
+			&ResponseOpSingle{
+				Operation: "DELETE",
+				Index:     intPtr(1),
+			},
+			&ResponseOpSingle{
+				Operation: "INSERT",
+				Index:     intPtr(2),
+				Room: &Room{
+					RoomID: roomD.RoomID,
+				},
+			},
+		},
+	})
+
+	// leaving a room which isn't in the list does nothing
+	leave("!unknown:localhost", testTimestampNow+2000)
+	res = mustHandleRequest(t, cs, &Request{
+		timeout: 100 * time.Millisecond,
+	})
+	if len(res.Ops) != 0 {
+		t.Errorf("leaving an unknown room: got ops %v want none", serialise(t, res.Ops))
+	}
+
+	// leave A at the start of the range: the list no longer fills the range
+	leave(roomA.RoomID, testTimestampNow+3000)
+	res = mustHandleRequest(t, cs, &Request{
+		timeout: time.Second,
+	})
+	checkResponse(t, true, res, &Response{
+		Count: 2,
+		Ops: []ResponseOp{
+			&ResponseOpSingle{
+				Operation: "UPDATE",
+				Index:     intPtr(0),
+				Room: &Room{
+					RoomID: roomA.RoomID,
+				},
+			},
+			&ResponseOpSingle{
+				Operation: "DELETE",
+				Index:     intPtr(0),
+			},
+			&ResponseOpSingle{
+				Operation: "INSERT",
+				Index:     intPtr(1),
+				Room: &Room{
+					RoomID: roomD.RoomID,
+				},
+			},
+			&ResponseOpSingle{
+				Operation: "DELETE",
+				Index:     intPtr(2),
+			},
+		},
+	})
+}
+
+// Test that a state reset re-sends the affected room, and only if it is in a tracked range.
+func TestConnStateStateReset(t *testing.T) {
+	roomA := newSortableRoom("!a:localhost", testTimestampNow)
+	roomB := newSortableRoom("!b:localhost", testTimestampNow-1000)
+	roomC := newSortableRoom("!c:localhost", testTimestampNow-2000)
+	cs, csm := newTestConnState(roomA, roomB, roomC)
+	mustHandleRequest(t, cs, &Request{
+		Sort: []string{SortByRecency},
+		Rooms: SliceRanges([][2]int64{
+			{0, 1},
+		}),
+	})
+
+	// B is in the range, so it is re-synced in place
+	csm.PushNewEvent(cs, &EventData{
+		roomID:     roomB.RoomID,
+		stateReset: true,
+	})
+	res := mustHandleRequest(t, cs, &Request{
+		timeout: time.Second,
+	})
+	checkResponse(t, true, res, &Response{
+		Ops: []ResponseOp{
+			&ResponseOpRange{
+				Operation: "SYNC",
+				Range:     []int64{1, 1},
+				Rooms: []Room{
+					{
+						RoomID: roomB.RoomID,
+					},
+				},
+			},
+		},
+	})
+	if res.Ops[0].(*ResponseOpRange).Rooms[0].Timeline != nil {
+		t.Errorf("state reset sent a timeline, wanted none")
+	}
+
+	// C is outside the range, so nothing is sent
+	csm.PushNewEvent(cs, &EventData{
+		roomID:     roomC.RoomID,
+		stateReset: true,
+	})
+	res = mustHandleRequest(t, cs, &Request{
+		timeout: 100 * time.Millisecond,
+	})
+	if len(res.Ops) != 0 {
+		t.Errorf("state reset outside the range: got ops %v want none", serialise(t, res.Ops))
+	}
+}
+
+// Test that rooms can be sorted by unread count, and that they move when the count decreases.
+func TestConnStateSortByUnreadCount(t *testing.T) {
+	roomA := newSortableRoom("!a:localhost", testTimestampNow)
+	roomB := newSortableRoom("!b:localhost", testTimestampNow-1000)
+	roomC := newSortableRoom("!c:localhost", testTimestampNow-2000)
+	cs, csm := newTestConnState(roomA, roomB, roomC)
+	csm.roomIDToUserRoomData = map[string]userRoomData{
+		roomB.RoomID: {unreadCount: 2},
+		roomC.RoomID: {unreadCount: 5},
+	}
+	res := mustHandleRequest(t, cs, &Request{
+		Sort: []string{SortByUnreadCount, SortByRecency},
+		Rooms: SliceRanges([][2]int64{
+			{0, 2},
+		}),
+	})
+	checkResponse(t, true, res, &Response{
+		Count: 3,
+		Ops: []ResponseOp{
+			&ResponseOpRange{
+				Operation: "SYNC",
+				Range:     []int64{0, 2},
+				Rooms: []Room{
+					{
+						RoomID: roomC.RoomID,
+					},
+					{
+						RoomID: roomB.RoomID,
+					},
+					{
+						RoomID: roomA.RoomID,
+					},
+				},
+			},
+		},
+	})
+	if got := res.Ops[0].(*ResponseOpRange).Rooms[0].UnreadCount; got != 5 {
+		t.Errorf("got unread_count %d want 5", got)
+	}
+
+	// C has been read, so it moves below A as the rooms are then sorted by recency
+	data := userRoomData{}
+	csm.roomIDToUserRoomData[roomC.RoomID] = data
+	cs.PushNewEvent(&EventData{
+		roomID:       roomC.RoomID,
+		userRoomData: &data,
+		timestamp:    roomC.LastMessageTimestamp,
+	})
+	res = mustHandleRequest(t, cs, &Request{
+		timeout: time.Second,
+	})
+	checkResponse(t, true, res, &Response{
+		Count: 3,
+		Ops: []ResponseOp{
+			&ResponseOpSingle{
+				Operation: "DELETE",
+				Index:     intPtr(0),
+			},
+			&ResponseOpSingle{
+				Operation: "INSERT",
+				Index:     intPtr(2),
+				Room: &Room{
+					RoomID: roomC.RoomID,
+				},
+			},
+		},
+	})
+	if got := res.Ops[1].(*ResponseOpSingle).Room.UnreadCount; got != 0 {
+		t.Errorf("got unread_count %d want 0", got)
+	}
+}
+
+// Test that edits and reactions don't bump rooms.
+func TestConnStateAggregatedRelations(t *testing.T) {
+	roomA := newSortableRoom("!a:localhost", testTimestampNow)
+	roomB := newSortableRoom("!b:localhost", testTimestampNow-1000)
+	roomC := newSortableRoom("!c:localhost", testTimestampNow-2000)
+	cs, csm := newTestConnState(roomA, roomB, roomC)
+	mustHandleRequest(t, cs, &Request{
+		Sort: []string{SortByRecency},
+		Rooms: SliceRanges([][2]int64{
+			{0, 1},
+		}),
+	})
+	react := func(roomID string) {
+		reaction := json.RawMessage(
+			`{"type":"m.reaction","content":{"m.relates_to":{"rel_type":"m.annotation","event_id":"$x","key":"👍"}}}`,
+		)
+		csm.PushNewEvent(cs, &EventData{
+			event:      reaction,
+			roomID:     roomID,
+			eventType:  "m.reaction",
+			content:    gjson.ParseBytes(reaction).Get("content"),
+			timestamp:  testTimestampNow + 5000,
+			aggregated: true,
+		})
+	}
+
+	// a reaction in B updates it in place
+	react(roomB.RoomID)
+	res := mustHandleRequest(t, cs, &Request{
+		timeout: time.Second,
+	})
+	checkResponse(t, true, res, &Response{
+		Ops: []ResponseOp{
+			&ResponseOpSingle{
+				Operation: "UPDATE",
+				Index:     intPtr(1),
+				Room: &Room{
+					RoomID: roomB.RoomID,
+				},
+			},
+		},
+	})
+
+	// a reaction in C doesn't bring it into the range
+	react(roomC.RoomID)
+	res = mustHandleRequest(t, cs, &Request{
+		timeout: 100 * time.Millisecond,
+	})
+	if len(res.Ops) != 0 {
+		t.Errorf("reaction outside the range: got ops %v want none", serialise(t, res.Ops))
+	}
+}
+
+// Test that room subscriptions are sent edits and reactions in their timeline, and that the latest event
+// in the room list has the relation bundled into it.
+func TestConnStateAggregatedRelationsSubscription(t *testing.T) {
+	target := json.RawMessage(`{"type":"m.room.message","event_id":"$x","content":{"body":"hi"}}`)
+	roomA := newSortableRoom("!a:localhost", testTimestampNow)
+	roomA.LastEventJSON = target
+	cs, csm := newTestConnState(roomA)
+	mustHandleRequest(t, cs, &Request{
+		Sort: []string{SortByRecency},
+		Rooms: SliceRanges([][2]int64{
+			{0, 0},
+		}),
+		RoomSubscriptions: map[string]RoomSubscription{
+			roomA.RoomID: {},
+		},
+	})
+	reaction := json.RawMessage(
+		`{"type":"m.reaction","event_id":"$r","content":{"m.relates_to":{"rel_type":"m.annotation","event_id":"$x","key":"👍"}}}`,
+	)
+	bundled := json.RawMessage(
+		`{"type":"m.room.message","event_id":"$x","content":{"body":"hi"},"unsigned":{"m.relations":{"m.annotation":{"chunk":[{"type":"m.reaction","key":"👍","count":1}]}}}}`,
+	)
+	csm.PushNewEvent(cs, &EventData{
+		event:              reaction,
+		roomID:             roomA.RoomID,
+		eventType:          "m.reaction",
+		content:            gjson.ParseBytes(reaction).Get("content"),
+		timestamp:          testTimestampNow,
+		aggregated:         true,
+		bundledLatestEvent: bundled,
+	})
+	res := mustHandleRequest(t, cs, &Request{
+		timeout: time.Second,
+	})
+	timeline := res.RoomSubscriptions[roomA.RoomID].Timeline
+	if len(timeline) != 1 || gjson.GetBytes(timeline[0], "event_id").Str != "$r" {
+		t.Fatalf("subscription timeline: got %v want the reaction", serialise(t, timeline))
+	}
+	if got := cs.sortedJoinedRooms[0].LastEventJSON; !bytes.Equal(got, bundled) {
+		t.Errorf("latest event: got %s want %s", string(got), string(bundled))
+	}
+}
+
+// Test that thread replies can be excluded from timelines, and that room subscriptions can target a thread.
+func TestConnStateThreads(t *testing.T) {
+	threadReply := func(eventID, rootID string) json.RawMessage {
+		return json.RawMessage(fmt.Sprintf(
+			`{"type":"m.room.message","event_id":"%s","content":{"body":"reply","m.relates_to":{"rel_type":"m.thread","event_id":"%s"}}}`,
+			eventID, rootID,
+		))
+	}
+	rootA := json.RawMessage(`{"type":"m.room.message","event_id":"$rootA","content":{"body":"root"},"unsigned":{"m.relations":{"m.thread":{"count":2}}}}`)
+	roomA := newSortableRoom("!a:localhost", testTimestampNow)
+	roomA.LastEventJSON = threadReply("$replyA", "$rootA")
+	roomB := newSortableRoom("!b:localhost", testTimestampNow-1000)
+	threadB := []json.RawMessage{
+		json.RawMessage(`{"type":"m.room.message","event_id":"$rootB","content":{"body":"root"}}`),
+		threadReply("$replyB", "$rootB"),
+	}
+	exclude := true
+	cs, csm := newTestConnState(roomA, roomB)
+	csm.roomIDToMainTimeline = map[string][]json.RawMessage{
+		roomA.RoomID: {rootA},
+	}
+	csm.threadRootToTimeline = map[string][]json.RawMessage{
+		"$rootB": threadB,
+	}
+	res := mustHandleRequest(t, cs, &Request{
+		Sort: []string{SortByRecency},
+		Rooms: SliceRanges([][2]int64{
+			{0, 1},
+		}),
+		ExcludeThreadReplies: &exclude,
+	})
+	checkTimeline := func(got, want []json.RawMessage) {
+		t.Helper()
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("timeline: got %s want %s", serialise(t, got), serialise(t, want))
+		}
+	}
+	// the latest event in A is a thread reply, so the latest event in the main timeline is sent
+	rooms := res.Ops[0].(*ResponseOpRange).Rooms
+	checkTimeline(rooms[0].Timeline, []json.RawMessage{rootA})
+	checkTimeline(rooms[1].Timeline, []json.RawMessage{roomB.LastEventJSON})
+
+	// a new thread reply in A is replaced by the thread root
+	reply := threadReply("$replyA2", "$rootA")
+	csm.PushNewEvent(cs, &EventData{
+		event:           reply,
+		roomID:          roomA.RoomID,
+		eventType:       "m.room.message",
+		content:         gjson.ParseBytes(reply).Get("content"),
+		timestamp:       testTimestampNow + 1000,
+		threadRoot:      "$rootA",
+		threadRootEvent: rootA,
+	})
+	res = mustHandleRequest(t, cs, &Request{
+		timeout: time.Second,
+	})
+	checkResponse(t, true, res, &Response{
+		Ops: []ResponseOp{
+			&ResponseOpSingle{
+				Operation: "UPDATE",
+				Index:     intPtr(0),
+				Room: &Room{
+					RoomID: roomA.RoomID,
+				},
+			},
+		},
+	})
+	checkTimeline(res.Ops[0].(*ResponseOpSingle).Room.Timeline, []json.RawMessage{rootA})
+
+	// subscribing to a thread in B returns the thread
+	res = mustHandleRequest(t, cs, &Request{
+		RoomSubscriptions: map[string]RoomSubscription{
+			roomB.RoomID: {
+				ThreadRoot: "$rootB",
+			},
+		},
+	})
+	checkTimeline(res.RoomSubscriptions[roomB.RoomID].Timeline, threadB)
+
+	// events outside the thread aren't sent to the subscription, events in the thread are
+	message := json.RawMessage(`{"type":"m.room.message","event_id":"$message","content":{"body":"not in the thread"}}`)
+	reply = threadReply("$replyB2", "$rootB")
+	for i, ev := range []json.RawMessage{message, reply} {
+		csm.PushNewEvent(cs, &EventData{
+			event:      ev,
+			roomID:     roomB.RoomID,
+			eventType:  "m.room.message",
+			content:    gjson.ParseBytes(ev).Get("content"),
+			timestamp:  testTimestampNow - 500 + int64(i),
+			threadRoot: state.ThreadRootID(gjson.ParseBytes(ev)),
+		})
+		res = mustHandleRequest(t, cs, &Request{
+			timeout: time.Second,
+		})
+		sub, ok := res.RoomSubscriptions[roomB.RoomID]
+		if !ok {
+			t.Fatalf("event %d: no room subscription update", i)
+		}
+		if i == 0 {
+			checkTimeline(sub.Timeline, nil)
+		} else {
+			checkTimeline(sub.Timeline, []json.RawMessage{reply})
+		}
+	}
+}
+
+// Test that buffered updates are only batched up to MaxBatchedEventUpdates.
+func TestConnStateBatchLimit(t *testing.T) {
+	roomA := newSortableRoom("!a:localhost", testTimestampNow)
+	roomB := newSortableRoom("!b:localhost", testTimestampNow-1000)
+	cs, csm := newTestConnState(roomA, roomB)
+	mustHandleRequest(t, cs, &Request{
+		Sort: []string{SortByRecency},
+		Rooms: SliceRanges([][2]int64{
+			{0, 1},
+		}),
+	})
+	prevMax := MaxBatchedEventUpdates
+	MaxBatchedEventUpdates = 2
+	defer func() {
+		MaxBatchedEventUpdates = prevMax
+	}()
+	// alternate between rooms so nothing gets coalesced
+	roomIDs := []string{roomB.RoomID, roomA.RoomID, roomB.RoomID}
+	for i, roomID := range roomIDs {
+		csm.PushNewEvent(cs, &EventData{
+			event:     json.RawMessage(fmt.Sprintf(`{"event_id":"$%d"}`, i)),
+			roomID:    roomID,
+			eventType: "unimportant",
+			timestamp: testTimestampNow + int64(1000*(i+1)),
+		})
+	}
+	res := mustHandleRequest(t, cs, &Request{})
+	if len(res.Ops) != 4 {
+		t.Fatalf("got %d ops, want 4 (2 updates): %v", len(res.Ops), serialise(t, res))
+	}
+	// the remaining update is returned next time
+	res = mustHandleRequest(t, cs, &Request{})
+	checkResponse(t, true, res, &Response{
+		Count: 2,
+		Ops: []ResponseOp{
+			&ResponseOpSingle{
+				Operation: "DELETE",
+				Index:     intPtr(1),
+			},
+			&ResponseOpSingle{
+				Operation: "INSERT",
+				Index:     intPtr(0),
+				Room: &Room{
+					RoomID: roomB.RoomID,
+				},
+			},
+		},
+	})
+}
+
+// Test that a restored connection only re-sends ranges which changed whilst the connection wasn't in memory.
+func TestConnStateRestore(t *testing.T) {
+	roomA := newSortableRoom("!a:localhost", testTimestampNow)
+	roomB := newSortableRoom("!b:localhost", testTimestampNow-1000)
+	roomC := newSortableRoom("!c:localhost", testTimestampNow-2000)
+	roomD := newSortableRoom("!d:localhost", testTimestampNow-3000)
+	cs, csm := newTestConnState(roomA, roomB, roomC, roomD)
+	mustHandleRequest(t, cs, &Request{
+		Sort: []string{SortByRecency},
+		Rooms: SliceRanges([][2]int64{
+			{0, 1}, {2, 3},
+		}),
+		RoomSubscriptions: map[string]RoomSubscription{
+			roomD.RoomID: {
+				TimelineLimit: 5,
+			},
+		},
+	})
+	data, err := json.Marshal(cs.snapshot())
+	if err != nil {
+		t.Fatalf("failed to marshal snapshot: %s", err)
+	}
+
+	// room D changes whilst the connection isn't in memory, without changing the sort order
+	roomD.LastEventNID = 5
+	csm.roomIDToRoom[roomD.RoomID] = roomD
+	csm.userIDToPosition = map[string]int64{
+		testUserID: 5,
+	}
+
+	var snapshot connStateSnapshot
+	if err = json.Unmarshal(data, &snapshot); err != nil {
+		t.Fatalf("failed to unmarshal snapshot: %s", err)
+	}
+	restored := NewConnState(testUserID, csm)
+	restored.restore(&snapshot)
+	if _, ok := restored.roomSubscriptions[roomD.RoomID]; !ok {
+		t.Errorf("room subscription was not restored")
+	}
+	res := mustHandleRequest(t, restored, &Request{})
+	checkResponse(t, true, res, &Response{
+		Count: 4,
+		Ops: []ResponseOp{
+			&ResponseOpRange{
+				Operation: "SYNC",
+				Range:     []int64{2, 3},
+				Rooms: []Room{
+					{
+						RoomID: roomC.RoomID,
+					},
+					{
+						RoomID: roomD.RoomID,
+					},
+				},
+			},
+		},
+	})
+
+	// subsequent requests behave as normal
+	res = mustHandleRequest(t, restored, &Request{})
+	checkResponse(t, true, res, &Response{
+		Count: 4,
+	})
+}
+
+// Test that a restored connection sorts the room list using the restored sort order.
+func TestConnStateRestoreSort(t *testing.T) {
+	roomA := newSortableRoom("!a:localhost", testTimestampNow)
+	roomA.Name = "Zebra"
+	roomB := newSortableRoom("!b:localhost", testTimestampNow-1000)
+	roomB.Name = "Yak"
+	roomC := newSortableRoom("!c:localhost", testTimestampNow-2000)
+	roomC.Name = "Aardvark"
+	cs, csm := newTestConnState(roomA, roomB, roomC)
+	mustHandleRequest(t, cs, &Request{
+		Sort: []string{SortByName},
+		Rooms: SliceRanges([][2]int64{
+			{0, 2},
+		}),
+	})
+	restored := NewConnState(testUserID, csm)
+	restored.restore(cs.snapshot())
+	res := mustHandleRequest(t, restored, &Request{})
+	if len(res.Ops) != 0 {
+		t.Errorf("restored connection sent ops %v, want none", serialise(t, res.Ops))
+	}
+	wantOrder := []string{roomC.RoomID, roomB.RoomID, roomA.RoomID}
+	for i, roomID := range wantOrder {
+		if restored.sortedJoinedRooms[i].RoomID != roomID {
+			t.Errorf("restored room list: got %s at index %d want %s", restored.sortedJoinedRooms[i].RoomID, i, roomID)
+		}
+	}
+}
+
+// Test that to-device messages are only sent when asked for, with room keys first if requested, and are
+// only deleted once the client makes a request with a later position.
+func TestConnStateToDevice(t *testing.T) {
+	roomA := newSortableRoom("!a:localhost", 1632131678061)
+	cs, csm := newTestConnState(roomA)
+	csm.toDeviceMsgs = []json.RawMessage{
+		json.RawMessage(`{"type":"m.room_key_request","sender":"@bob:localhost","content":{}}`),
+		json.RawMessage(`{"type":"m.room_key","sender":"@bob:localhost","content":{}}`),
+		json.RawMessage(`{"type":"m.dummy","sender":"@bob:localhost","content":{}}`),
+	}
+	csm.toDevicePositions = []int64{1, 2, 3}
+
+	// no to_device option: nothing is sent
+	res := mustHandleRequest(t, cs, &Request{
+		Rooms: SliceRanges([][2]int64{
+			{0, 0},
+		}),
+	})
+	if len(res.ToDevice) != 0 {
+		t.Fatalf("got %d to-device messages without asking for them", len(res.ToDevice))
+	}
+
+	// room keys first, limited to 2
+	res = mustHandleRequest(t, cs, &Request{
+		pos: 1,
+		ToDevice: &ToDeviceRequest{
+			Limit:         2,
+			RoomKeysFirst: true,
+		},
+	})
+	checkToDevice(t, res, "m.room_key", "m.room_key_request")
+
+	// a retry at the same position is sent the same messages and nothing is deleted
+	res = mustHandleRequest(t, cs, &Request{
+		pos: 1,
+	})
+	checkToDevice(t, res, "m.room_key", "m.room_key_request")
+	if len(csm.toDeviceDeleted) != 0 {
+		t.Fatalf("deleted to-device messages %v on a retry", csm.toDeviceDeleted)
+	}
+
+	// a later position acks the sent messages
+	res = mustHandleRequest(t, cs, &Request{
+		pos: 2,
+	})
+	if !reflect.DeepEqual(csm.toDeviceDeleted, []int64{2, 1}) {
+		t.Fatalf("deleted to-device messages: got %v want [2 1]", csm.toDeviceDeleted)
+	}
+	checkToDevice(t, res, "m.dummy")
+
+	// a waiting request is woken up by new to-device messages
+	mustHandleRequest(t, cs, &Request{
+		pos:     3,
+		timeout: time.Millisecond,
+	})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		csm.toDeviceMu.Lock()
+		csm.toDeviceMsgs = append(csm.toDeviceMsgs, json.RawMessage(`{"type":"m.new","sender":"@bob:localhost","content":{}}`))
+		csm.toDevicePositions = append(csm.toDevicePositions, 4)
+		csm.toDeviceMu.Unlock()
+		cs.PushNewEvent(&EventData{toDevice: true})
+	}()
+	res = mustHandleRequest(t, cs, &Request{
+		pos:     4,
+		timeout: time.Second,
+	})
+	checkToDevice(t, res, "m.new")
+}
+
+func checkToDevice(t *testing.T, res *Response, wantTypes ...string) {
+	t.Helper()
+	var gotTypes []string
+	for _, msg := range res.ToDevice {
+		gotTypes = append(gotTypes, gjson.GetBytes(msg, "type").Str)
+	}
+	if !reflect.DeepEqual(gotTypes, wantTypes) {
+		t.Fatalf("to-device messages: got %v want %v", gotTypes, wantTypes)
+	}
+}
+
 func checkResponse(t *testing.T, checkRoomIDsOnly bool, got, want *Response) {
 	t.Helper()
 	if want.Count > 0 {
@@ -0,0 +1,200 @@
+package sync3
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/fxamacker/cbor/v2"
+)
+
+const (
+	contentTypeJSON = "application/json"
+	contentTypeCBOR = "application/cbor"
+
+	contentEncodingGzip   = "gzip"
+	contentEncodingBrotli = "br"
+)
+
+// negotiateContentType returns the response content type the client prefers out of the ones we support.
+// Defaults to JSON.
+func negotiateContentType(req *http.Request) string {
+	best := contentTypeJSON
+	bestQ := 0.0
+	for _, accept := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		if mediaType != contentTypeJSON && mediaType != contentTypeCBOR {
+			continue
+		}
+		q := qValue(params)
+		if q > bestQ {
+			best = mediaType
+			bestQ = q
+		}
+	}
+	return best
+}
+
+// negotiateContentEncoding returns the compression the client prefers out of the ones we support, with
+// brotli preferred over gzip if they are equally acceptable. Returns "" for no compression.
+func negotiateContentEncoding(req *http.Request) string {
+	best := ""
+	bestQ := 0.0
+	for _, accept := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(accept, ";")
+		coding := strings.ToLower(strings.TrimSpace(parts[0]))
+		if coding != contentEncodingGzip && coding != contentEncodingBrotli {
+			continue
+		}
+		params := make(map[string]string)
+		for _, p := range parts[1:] {
+			kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+			if len(kv) == 2 {
+				params[strings.ToLower(kv[0])] = kv[1]
+			}
+		}
+		q := qValue(params)
+		if q > bestQ || (q == bestQ && q > 0 && coding == contentEncodingBrotli) {
+			best = coding
+			bestQ = q
+		}
+	}
+	return best
+}
+
+// qValue returns the q parameter, defaulting to 1
+func qValue(params map[string]string) float64 {
+	qStr, ok := params["q"]
+	if !ok {
+		return 1
+	}
+	q, err := strconv.ParseFloat(qStr, 64)
+	if err != nil {
+		return 0
+	}
+	return q
+}
+
+// writeResponse encodes the response using the content type and encoding negotiated with the client.
+func writeResponse(w http.ResponseWriter, req *http.Request, resp *Response) error {
+	contentType := negotiateContentType(req)
+	contentEncoding := negotiateContentEncoding(req)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Add("Vary", "Accept, Accept-Encoding")
+	if contentEncoding != "" {
+		w.Header().Set("Content-Encoding", contentEncoding)
+	}
+	w.WriteHeader(200)
+	return encodeResponse(w, resp, contentType, contentEncoding)
+}
+
+func encodeResponse(w io.Writer, resp *Response, contentType, contentEncoding string) error {
+	var compressor io.WriteCloser
+	switch contentEncoding {
+	case contentEncodingGzip:
+		compressor = gzip.NewWriter(w)
+	case contentEncodingBrotli:
+		compressor = brotli.NewWriter(w)
+	}
+	if compressor != nil {
+		w = compressor
+	}
+	var err error
+	switch contentType {
+	case contentTypeCBOR:
+		err = encodeCBOR(w, resp)
+	default:
+		err = json.NewEncoder(w).Encode(resp)
+	}
+	if err != nil {
+		return err
+	}
+	if compressor != nil {
+		return compressor.Close()
+	}
+	return nil
+}
+
+// encodeCBOR encodes the response as CBOR. Events are stored as raw JSON, which would be encoded as
+// opaque byte strings, so the response is transcoded via JSON into generic values first so that the
+// entire response is CBOR.
+func encodeCBOR(w io.Writer, resp *Response) error {
+	j, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.UseNumber()
+	var generic interface{}
+	if err = dec.Decode(&generic); err != nil {
+		return err
+	}
+	return cbor.NewEncoder(w).Encode(convertNumbers(generic))
+}
+
+// convertNumbers replaces json.Numbers with integers where possible, else floats, so they are encoded
+// as numbers rather than strings.
+func convertNumbers(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, inner := range val {
+			val[k] = convertNumbers(inner)
+		}
+		return val
+	case []interface{}:
+		for i, inner := range val {
+			val[i] = convertNumbers(inner)
+		}
+		return val
+	case json.Number:
+		if i, err := val.Int64(); err == nil {
+			return i
+		}
+		f, _ := val.Float64()
+		return f
+	}
+	return v
+}
+
+// readRequest decodes the request body into `into`, using the Content-Type and Content-Encoding of the
+// request. Defaults to uncompressed JSON.
+func readRequest(req *http.Request, into *Request) error {
+	var body io.Reader = req.Body
+	switch strings.ToLower(req.Header.Get("Content-Encoding")) {
+	case "", "identity":
+	case contentEncodingGzip:
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		body = gz
+	case contentEncodingBrotli:
+		body = brotli.NewReader(body)
+	default:
+		return fmt.Errorf("unsupported Content-Encoding: %s", req.Header.Get("Content-Encoding"))
+	}
+	mediaType := contentTypeJSON
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		var err error
+		mediaType, _, err = mime.ParseMediaType(ct)
+		if err != nil {
+			return err
+		}
+	}
+	if mediaType == contentTypeCBOR {
+		// requests have no raw JSON in them so can be decoded directly. CBOR honours the json struct tags.
+		return cbor.NewDecoder(body).Decode(into)
+	}
+	return json.NewDecoder(body).Decode(into)
+}
@@ -0,0 +1,283 @@
+package sync3
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/fxamacker/cbor/v2"
+)
+
+func TestNegotiateContentType(t *testing.T) {
+	testCases := []struct {
+		accept string
+		want   string
+	}{
+		{accept: "", want: contentTypeJSON},
+		{accept: "*/*", want: contentTypeJSON},
+		{accept: "application/json", want: contentTypeJSON},
+		{accept: "application/cbor", want: contentTypeCBOR},
+		{accept: "application/json;q=0.5, application/cbor", want: contentTypeCBOR},
+		{accept: "application/json, application/cbor;q=0.5", want: contentTypeJSON},
+		{accept: "application/cbor;q=0", want: contentTypeJSON},
+		{accept: "application/msgpack", want: contentTypeJSON},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest("POST", "/_matrix/client/v3/sync", nil)
+		req.Header.Set("Accept", tc.accept)
+		if got := negotiateContentType(req); got != tc.want {
+			t.Errorf("negotiateContentType(%q): got %v want %v", tc.accept, got, tc.want)
+		}
+	}
+}
+
+func TestNegotiateContentEncoding(t *testing.T) {
+	testCases := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{acceptEncoding: "", want: ""},
+		{acceptEncoding: "identity", want: ""},
+		{acceptEncoding: "gzip", want: "gzip"},
+		{acceptEncoding: "br", want: "br"},
+		{acceptEncoding: "gzip, deflate, br", want: "br"},
+		{acceptEncoding: "gzip;q=1.0, br;q=0.5", want: "gzip"},
+		{acceptEncoding: "gzip, br;q=0", want: "gzip"},
+		{acceptEncoding: "gzip;q=0, br;q=0", want: ""},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest("POST", "/_matrix/client/v3/sync", nil)
+		req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		if got := negotiateContentEncoding(req); got != tc.want {
+			t.Errorf("negotiateContentEncoding(%q): got %v want %v", tc.acceptEncoding, got, tc.want)
+		}
+	}
+}
+
+func TestEncodingWriteResponse(t *testing.T) {
+	resp := newBenchmarkResponse(3)
+	wantJSON, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatalf("failed to marshal response: %s", err)
+	}
+	var want interface{}
+	if err = json.Unmarshal(wantJSON, &want); err != nil {
+		t.Fatalf("failed to unmarshal response: %s", err)
+	}
+
+	for _, contentType := range []string{contentTypeJSON, contentTypeCBOR} {
+		for _, contentEncoding := range []string{"", contentEncodingGzip, contentEncodingBrotli} {
+			req := httptest.NewRequest("POST", "/_matrix/client/v3/sync", nil)
+			req.Header.Set("Accept", contentType)
+			req.Header.Set("Accept-Encoding", contentEncoding)
+			w := httptest.NewRecorder()
+			if err := writeResponse(w, req, resp); err != nil {
+				t.Fatalf("writeResponse(%s, %s) returned error: %s", contentType, contentEncoding, err)
+			}
+			if got := w.Header().Get("Content-Type"); got != contentType {
+				t.Errorf("Content-Type: got %s want %s", got, contentType)
+			}
+			if got := w.Header().Get("Content-Encoding"); got != contentEncoding {
+				t.Errorf("Content-Encoding: got %s want %s", got, contentEncoding)
+			}
+			body := decompress(t, w.Body, contentEncoding)
+			var got interface{}
+			if contentType == contentTypeCBOR {
+				var generic interface{}
+				if err := cbor.Unmarshal(body, &generic); err != nil {
+					t.Fatalf("failed to decode CBOR response: %s", err)
+				}
+				// round trip via JSON so numbers and maps are the same types as `want`
+				got = roundTripJSON(t, normaliseCBOR(generic))
+			} else {
+				if err := json.Unmarshal(body, &got); err != nil {
+					t.Fatalf("failed to decode JSON response: %s", err)
+				}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s %s: response mismatch\ngot  %v\nwant %v", contentType, contentEncoding, got, want)
+			}
+		}
+	}
+}
+
+func TestEncodingReadRequest(t *testing.T) {
+	want := Request{
+		Rooms:         SliceRanges{{0, 99}},
+		Sort:          []string{SortByRecency},
+		RequiredState: [][2]string{{"m.room.name", ""}},
+		TimelineLimit: 5,
+		SessionID:     "session",
+	}
+	for _, contentType := range []string{"", contentTypeJSON, contentTypeCBOR} {
+		for _, contentEncoding := range []string{"", contentEncodingGzip, contentEncodingBrotli} {
+			var body []byte
+			var err error
+			if contentType == contentTypeCBOR {
+				body, err = cbor.Marshal(want)
+			} else {
+				body, err = json.Marshal(want)
+			}
+			if err != nil {
+				t.Fatalf("failed to encode request: %s", err)
+			}
+			req := httptest.NewRequest("POST", "/_matrix/client/v3/sync", bytes.NewReader(compress(t, body, contentEncoding)))
+			req.Header.Set("Content-Type", contentType)
+			req.Header.Set("Content-Encoding", contentEncoding)
+			var got Request
+			if err = readRequest(req, &got); err != nil {
+				t.Fatalf("readRequest(%s, %s) returned error: %s", contentType, contentEncoding, err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s %s: request mismatch\ngot  %+v\nwant %+v", contentType, contentEncoding, got, want)
+			}
+		}
+	}
+
+	req := httptest.NewRequest("POST", "/_matrix/client/v3/sync", bytes.NewReader([]byte(`{}`)))
+	req.Header.Set("Content-Encoding", "compress")
+	var got Request
+	if err := readRequest(req, &got); err == nil {
+		t.Errorf("readRequest with unsupported Content-Encoding did not return an error")
+	}
+}
+
+// Compare the encoded sizes and encoding times of a large SYNC response. Run with:
+//
+//	go test -run xxx -bench BenchmarkEncoding ./sync3
+func BenchmarkEncoding(b *testing.B) {
+	resp := newBenchmarkResponse(100)
+	for _, contentType := range []string{contentTypeJSON, contentTypeCBOR} {
+		for _, contentEncoding := range []string{"", contentEncodingGzip, contentEncodingBrotli} {
+			name := contentType
+			if contentEncoding != "" {
+				name += "+" + contentEncoding
+			}
+			b.Run(name, func(b *testing.B) {
+				var size int
+				for i := 0; i < b.N; i++ {
+					var buf bytes.Buffer
+					if err := encodeResponse(&buf, resp, contentType, contentEncoding); err != nil {
+						b.Fatalf("encodeResponse returned error: %s", err)
+					}
+					size = buf.Len()
+				}
+				b.ReportMetric(float64(size), "bytes/op")
+			})
+		}
+	}
+}
+
+// newBenchmarkResponse makes a SYNC response for a range of rooms with required_state and a timeline
+func newBenchmarkResponse(numRooms int) *Response {
+	rooms := make([]Room, numRooms)
+	for i := range rooms {
+		roomID := fmt.Sprintf("!room%d:localhost", i)
+		rooms[i] = Room{
+			RoomID: roomID,
+			Name:   fmt.Sprintf("Room %d", i),
+			RequiredState: []json.RawMessage{
+				json.RawMessage(fmt.Sprintf(`{"type":"m.room.create","state_key":"","sender":"@alice:localhost","content":{"creator":"@alice:localhost","room_version":"6"},"event_id":"$create%d","origin_server_ts":1632131678061}`, i)),
+				json.RawMessage(fmt.Sprintf(`{"type":"m.room.name","state_key":"","sender":"@alice:localhost","content":{"name":"Room %d"},"event_id":"$name%d","origin_server_ts":1632131678062}`, i, i)),
+				json.RawMessage(fmt.Sprintf(`{"type":"m.room.member","state_key":"@alice:localhost","sender":"@alice:localhost","content":{"membership":"join","displayname":"Alice"},"event_id":"$member%d","origin_server_ts":1632131678063}`, i)),
+			},
+			Timeline: []json.RawMessage{
+				json.RawMessage(fmt.Sprintf(`{"type":"m.room.message","sender":"@alice:localhost","content":{"msgtype":"m.text","body":"Hello world %d"},"event_id":"$msg%d","origin_server_ts":1632131678064}`, i, i)),
+			},
+			NotificationCount: int64(i % 3),
+		}
+	}
+	return &Response{
+		Ops: []ResponseOp{
+			&ResponseOpRange{
+				Operation: "SYNC",
+				Range:     []int64{0, int64(numRooms - 1)},
+				Rooms:     rooms,
+			},
+		},
+		Count: int64(numRooms),
+		Pos:   1,
+	}
+}
+
+func compress(t *testing.T, body []byte, contentEncoding string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch contentEncoding {
+	case contentEncodingGzip:
+		w = gzip.NewWriter(&buf)
+	case contentEncodingBrotli:
+		w = brotli.NewWriter(&buf)
+	default:
+		return body
+	}
+	if _, err := w.Write(body); err != nil {
+		t.Fatalf("failed to compress: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to compress: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func decompress(t *testing.T, body io.Reader, contentEncoding string) []byte {
+	t.Helper()
+	var r io.Reader
+	switch contentEncoding {
+	case contentEncodingGzip:
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			t.Fatalf("failed to make gzip reader: %s", err)
+		}
+		r = gz
+	case contentEncodingBrotli:
+		r = brotli.NewReader(body)
+	default:
+		r = body
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to decompress: %s", err)
+	}
+	return b
+}
+
+// normaliseCBOR converts the map[interface{}]interface{} maps produced by decoding CBOR into
+// map[string]interface{} so it can be marshalled as JSON.
+func normaliseCBOR(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(val))
+		for k, inner := range val {
+			m[fmt.Sprint(k)] = normaliseCBOR(inner)
+		}
+		return m
+	case []interface{}:
+		for i, inner := range val {
+			val[i] = normaliseCBOR(inner)
+		}
+		return val
+	}
+	return v
+}
+
+func roundTripJSON(t *testing.T, v interface{}) interface{} {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("failed to marshal: %s", err)
+	}
+	var out interface{}
+	if err = json.Unmarshal(b, &out); err != nil {
+		t.Fatalf("failed to unmarshal: %s", err)
+	}
+	return out
+}
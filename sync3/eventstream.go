@@ -0,0 +1,160 @@
+package sync3
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/sync-v3/internal"
+	"github.com/rs/zerolog/hlog"
+)
+
+// isEventStreamRequest returns true if the client wants a Server-Sent Events stream
+func isEventStreamRequest(req *http.Request) bool {
+	for _, accept := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && mediaType == "text/event-stream" {
+			return true
+		}
+	}
+	return false
+}
+
+// serveEventStream serves sync v3 as a stream of Server-Sent Events. The request is given as JSON in
+// ?request= and the same request is used for every iteration of the sync loop. Every response is sent
+// as an event, with the response position as the event ID. This means that when the client reconnects
+// with the same ?request= and a Last-Event-ID header, the connection resumes from that position. If the
+// last event was lost, the client's request will look like a retry and the lost response is resent.
+//
+// As browsers cannot set headers on EventSources, the access token can be given via ?access_token=
+func (h *SyncLiveHandler) serveEventStream(w http.ResponseWriter, req *http.Request) error {
+	accessTokenFromQuery(req)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return &internal.HandlerError{
+			StatusCode: 500,
+			Err:        fmt.Errorf("streaming is not supported"),
+		}
+	}
+	var requestBody Request
+	if queryRequest := req.URL.Query().Get("request"); queryRequest != "" {
+		if err := json.Unmarshal([]byte(queryRequest), &requestBody); err != nil {
+			hlog.FromRequest(req).Err(err).Msg("failed to decode ?request=")
+			return &internal.HandlerError{
+				StatusCode: 400,
+				ErrCode:    internal.ErrCodeBadJSON,
+				Err:        err,
+			}
+		}
+	}
+	if requestBody.SessionID == "" {
+		requestBody.SessionID = DefaultSessionID
+	}
+	cpos, err := positionFromRequest(req)
+	if err != nil {
+		return err
+	}
+	hasPos := req.URL.Query().Get("pos") != ""
+	if lastEventID := req.Header.Get("Last-Event-ID"); lastEventID != "" {
+		cpos, err = strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil {
+			return &internal.HandlerError{
+				StatusCode: 400,
+				ErrCode:    internal.ErrCodeInvalidParam,
+				Err:        fmt.Errorf("invalid Last-Event-ID: %s", lastEventID),
+			}
+		}
+		hasPos = true
+	}
+	requestBody.timeout, err = eventStreamTimeoutFromRequest(req)
+	if err != nil {
+		return err
+	}
+
+	requestBody.pos = cpos
+	conn, err := h.setupConnection(req, &requestBody, hasPos)
+	if err != nil {
+		hlog.FromRequest(req).Err(err).Msg("failed to get or create Conn")
+		return err
+	}
+	log := hlog.FromRequest(req).With().Str("conn_id", conn.ConnID.String()).Logger()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	for {
+		if !h.ConnMap.KeepAlive(conn) {
+			herr := &internal.HandlerError{
+				StatusCode: 400,
+				ErrCode:    internal.ErrCodeUnknownPos,
+				Err:        fmt.Errorf("session expired"),
+			}
+			writeEvent(w, "error", "", herr.JSON())
+			flusher.Flush()
+			return nil
+		}
+		// use a copy of the same request every time, so reconnections look like retries
+		syncReq := requestBody
+		syncReq.pos = cpos
+		resp, herr := conn.OnIncomingRequest(req.Context(), &syncReq)
+		if req.Context().Err() != nil {
+			// the client has gone away, so they won't see this response. They'll retry this request
+			// when they reconnect.
+			return nil
+		}
+		if herr != nil {
+			log.Err(herr).Msg("failed to OnIncomingRequest")
+			writeEvent(w, "error", "", herr.JSON())
+			flusher.Flush()
+			return nil
+		}
+		data, err := json.Marshal(resp)
+		if err != nil {
+			log.Err(err).Msg("failed to marshal response")
+			return nil
+		}
+		if err = writeEvent(w, "", strconv.FormatInt(resp.Pos, 10), data); err != nil {
+			log.Warn().Err(err).Msg("failed to write event")
+			return nil
+		}
+		flusher.Flush()
+		cpos = resp.Pos
+	}
+}
+
+// eventStreamTimeoutFromRequest returns the ?timeout= to use for each iteration of the sync loop. Unlike
+// long-polling, a timeout of 0 uses DefaultTimeout, else the stream would send empty events as fast as it
+// can write them.
+func eventStreamTimeoutFromRequest(req *http.Request) (time.Duration, error) {
+	timeout, err := timeoutFromRequest(req)
+	if err != nil {
+		return 0, err
+	}
+	if timeout <= 0 {
+		return DefaultTimeout, nil
+	}
+	return timeout, nil
+}
+
+// writeEvent writes a single Server-Sent Event. The data must not contain newlines.
+func writeEvent(w io.Writer, eventType, id string, data []byte) error {
+	var sb strings.Builder
+	if eventType != "" {
+		sb.WriteString("event: " + eventType + "\n")
+	}
+	if id != "" {
+		sb.WriteString("id: " + id + "\n")
+	}
+	sb.WriteString("data: ")
+	sb.Write(data)
+	sb.WriteString("\n\n")
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
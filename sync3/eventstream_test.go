@@ -0,0 +1,97 @@
+package sync3
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestIsEventStreamRequest(t *testing.T) {
+	testCases := []struct {
+		accept string
+		want   bool
+	}{
+		{accept: "", want: false},
+		{accept: "application/json", want: false},
+		{accept: "text/event-stream", want: true},
+		{accept: "application/json, text/event-stream;q=0.9", want: true},
+		{accept: "text/event-stream-ish", want: false},
+	}
+	for _, tc := range testCases {
+		req, err := http.NewRequest("GET", "/_matrix/client/v3/sync", nil)
+		if err != nil {
+			t.Fatalf("failed to make request: %s", err)
+		}
+		req.Header.Set("Accept", tc.accept)
+		if got := isEventStreamRequest(req); got != tc.want {
+			t.Errorf("isEventStreamRequest(%q): got %v want %v", tc.accept, got, tc.want)
+		}
+	}
+}
+
+// Test that EventSources, which cannot set headers, can authenticate with ?access_token=
+func TestAccessTokenFromQuery(t *testing.T) {
+	testCases := []struct {
+		url        string
+		authHeader string
+		want       string
+	}{
+		{url: "/_matrix/client/v3/sync", want: ""},
+		{url: "/_matrix/client/v3/sync?access_token=foo", want: "Bearer foo"},
+		{url: "/_matrix/client/v3/sync?access_token=foo", authHeader: "Bearer bar", want: "Bearer bar"},
+	}
+	for _, tc := range testCases {
+		req, err := http.NewRequest("GET", tc.url, nil)
+		if err != nil {
+			t.Fatalf("failed to make request: %s", err)
+		}
+		if tc.authHeader != "" {
+			req.Header.Set("Authorization", tc.authHeader)
+		}
+		accessTokenFromQuery(req)
+		if got := req.Header.Get("Authorization"); got != tc.want {
+			t.Errorf("accessTokenFromQuery(%q, %q): got %q want %q", tc.url, tc.authHeader, got, tc.want)
+		}
+	}
+}
+
+// Test that ?timeout=0 doesn't make the stream send empty events back-to-back.
+func TestEventStreamTimeoutFromRequest(t *testing.T) {
+	testCases := []struct {
+		url  string
+		want time.Duration
+	}{
+		{url: "/_matrix/client/v3/sync", want: DefaultTimeout},
+		{url: "/_matrix/client/v3/sync?timeout=0", want: DefaultTimeout},
+		{url: "/_matrix/client/v3/sync?timeout=1", want: MinTimeout},
+		{url: "/_matrix/client/v3/sync?timeout=5000", want: 5 * time.Second},
+	}
+	for _, tc := range testCases {
+		req, err := http.NewRequest("GET", tc.url, nil)
+		if err != nil {
+			t.Fatalf("failed to make request: %s", err)
+		}
+		got, err := eventStreamTimeoutFromRequest(req)
+		if err != nil {
+			t.Fatalf("eventStreamTimeoutFromRequest(%q) returned error: %s", tc.url, err)
+		}
+		if got != tc.want {
+			t.Errorf("eventStreamTimeoutFromRequest(%q): got %v want %v", tc.url, got, tc.want)
+		}
+	}
+}
+
+func TestWriteEvent(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeEvent(&buf, "", "5", []byte(`{"pos":5}`)); err != nil {
+		t.Fatalf("writeEvent returned error: %s", err)
+	}
+	if err := writeEvent(&buf, "error", "", []byte(`{"error":"oops"}`)); err != nil {
+		t.Fatalf("writeEvent returned error: %s", err)
+	}
+	want := "id: 5\ndata: {\"pos\":5}\n\nevent: error\ndata: {\"error\":\"oops\"}\n\n"
+	if buf.String() != want {
+		t.Errorf("writeEvent: got %q want %q", buf.String(), want)
+	}
+}
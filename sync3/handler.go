@@ -1,12 +1,18 @@
 package sync3
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/jmoiron/sqlx"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/sync-v3/internal"
 	"github.com/matrix-org/sync-v3/state"
@@ -18,6 +24,10 @@ import (
 
 const DefaultSessionID = "default"
 
+// How often to check that the access tokens for connections which aren't being polled are still valid.
+// Tokens for connections which are being polled are checked by the poller.
+var TokenRevalidationInterval = 10 * time.Minute
+
 var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
 	Out:        os.Stderr,
 	TimeFormat: "15:04:05",
@@ -26,21 +36,56 @@ var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.C
 // This is a net.http Handler for sync v3. It is responsible for pairing requests to Conns and to
 // ensure that the sync v2 poller is running for this client.
 type SyncLiveHandler struct {
-	V2        sync2.Client
-	Storage   *state.Storage
-	V2Store   *sync2.Storage
-	PollerMap *sync2.PollerMap
-	ConnMap   *ConnMap
+	// A unique ID for this instance, as many instances can share the same database
+	InstanceID string
+	V2         sync2.Client
+	Storage    *state.Storage
+	V2Store    *sync2.Storage
+	ConnStore  *ConnStorage
+	PollerMap  *sync2.PollerMap
+	ConnMap    *ConnMap
+	Notifier   *Notifier
+	// Stores access tokens so pollers can be resumed on startup. nil if this is disabled.
+	TokenStore *sync2.TokenStorage
+
+	// device_id -> Authorization header, for revalidating tokens of connections which aren't being polled
+	authHeaders *sync.Map
+	// device_id -> true for devices whose access token has been rejected, to save hitting the database
+	invalidTokens *sync.Map
 }
 
-func NewSync3Handler(v2Client sync2.Client, postgresDBURI string) (*SyncLiveHandler, error) {
+// NewSync3Handler makes a new sync v3 handler. If tokenSecret is set, access tokens are stored in the
+// database encrypted with this secret, and pollers for devices with connections are resumed on startup.
+func NewSync3Handler(v2Client sync2.Client, postgresDBURI, tokenSecret string) (*SyncLiveHandler, error) {
+	instanceID, err := randomID()
+	if err != nil {
+		return nil, err
+	}
 	sh := &SyncLiveHandler{
-		V2:      v2Client,
-		Storage: state.NewStorage(postgresDBURI),
-		V2Store: sync2.NewStore(postgresDBURI),
+		InstanceID:    instanceID,
+		V2:            v2Client,
+		Storage:       state.NewStorage(postgresDBURI),
+		V2Store:       sync2.NewStore(postgresDBURI),
+		ConnStore:     NewConnStorage(postgresDBURI),
+		authHeaders:   &sync.Map{},
+		invalidTokens: &sync.Map{},
 	}
-	sh.PollerMap = sync2.NewPollerMap(v2Client, sh)
-	sh.ConnMap = NewConnMap(sh.Storage)
+	if tokenSecret != "" {
+		sh.TokenStore, err = sync2.NewTokenStorage(postgresDBURI, tokenSecret)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sh.PollerMap = sync2.NewPollerMap(v2Client, sh, sh.V2Store.Leaser(instanceID), sh.V2Store)
+	sh.ConnMap = NewConnMap(sh.Storage, sh.ConnStore)
+	sh.ConnMap.Degraded = sh.PollerMap.Degraded
+
+	// remove connections which expired whilst we weren't running
+	numExpired, err := sh.ConnStore.DeleteConnsBefore(time.Now().Add(-ConnTTL))
+	if err != nil {
+		return nil, err
+	}
+	logger.Info().Int64("num", numExpired).Msg("deleted expired connections")
 
 	roomToJoinedUsers, err := sh.Storage.AllJoinedMembers()
 	if err != nil {
@@ -50,16 +95,30 @@ func NewSync3Handler(v2Client sync2.Client, postgresDBURI string) (*SyncLiveHand
 	if err != nil {
 		return nil, err
 	}
+	// Listen for updates from other instances after loading the baseline, for the same reasons v2 poll
+	// loops must be started after loading the baseline.
+	sh.Notifier = NewNotifier(postgresDBURI, instanceID, sh.onNotification)
+	logger.Info().Str("instance_id", instanceID).Msg("started instance")
+	go sh.revalidateTokens()
+	go sh.stopIdlePollers()
+	// start pollers after loading the baseline, else they could race with it
+	if sh.TokenStore != nil {
+		go sh.resumePollers()
+	}
 
 	return sh, nil
 }
 
 func (h *SyncLiveHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if req.Method != "POST" {
+	var err error
+	if req.Method == "GET" && isEventStreamRequest(req) {
+		err = h.serveEventStream(w, req)
+	} else if req.Method == "POST" {
+		err = h.serve(w, req)
+	} else {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-	err := h.serve(w, req)
 	if err != nil {
 		herr, ok := err.(*internal.HandlerError)
 		if !ok {
@@ -68,6 +127,7 @@ func (h *SyncLiveHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 				Err:        err,
 			}
 		}
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(herr.StatusCode)
 		w.Write(herr.JSON())
 	}
@@ -78,10 +138,11 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 	var requestBody Request
 	if req.Body != nil {
 		defer req.Body.Close()
-		if err := json.NewDecoder(req.Body).Decode(&requestBody); err != nil {
+		if err := readRequest(req, &requestBody); err != nil {
 			log.Err(err).Msg("failed to read/decode request body")
 			return &internal.HandlerError{
 				StatusCode: 400,
+				ErrCode:    internal.ErrCodeBadJSON,
 				Err:        err,
 			}
 		}
@@ -90,35 +151,31 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 		requestBody.SessionID = DefaultSessionID
 	}
 
+	// set pos if specified
+	cpos, err := positionFromRequest(req)
+	if err != nil {
+		return err
+	}
+	requestBody.pos = cpos
+	// set the long-poll timeout if specified
+	requestBody.timeout, err = timeoutFromRequest(req)
+	if err != nil {
+		return err
+	}
+
 	conn, err := h.setupConnection(req, &requestBody, req.URL.Query().Get("pos") != "")
 	if err != nil {
 		hlog.FromRequest(req).Err(err).Msg("failed to get or create Conn")
 		return err
 	}
 	log := hlog.FromRequest(req).With().Str("conn_id", conn.ConnID.String()).Logger()
-	// set pos if specified
-	var cpos int64
-	queryPos := req.URL.Query().Get("pos")
-	if queryPos != "" {
-		cpos, err = strconv.ParseInt(queryPos, 10, 64)
-		if err != nil {
-			log.Err(err).Msg("failed to get ?pos=")
-			return &internal.HandlerError{
-				StatusCode: 400,
-				Err:        fmt.Errorf("invalid position: %s", queryPos),
-			}
-		}
-	}
-	requestBody.pos = cpos
 
 	resp, herr := conn.OnIncomingRequest(req.Context(), &requestBody)
 	if herr != nil {
 		log.Err(herr).Msg("failed to OnIncomingRequest")
 		return herr
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(200)
-	if err := json.NewEncoder(w).Encode(resp); err != nil {
+	if err := writeResponse(w, req, resp); err != nil {
 		return &internal.HandlerError{
 			StatusCode: 500,
 			Err:        err,
@@ -127,6 +184,51 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 	return nil
 }
 
+// positionFromRequest returns the ?pos= in the request, or 0 if there is no position.
+func positionFromRequest(req *http.Request) (int64, error) {
+	queryPos := req.URL.Query().Get("pos")
+	if queryPos == "" {
+		return 0, nil
+	}
+	cpos, err := strconv.ParseInt(queryPos, 10, 64)
+	if err != nil {
+		hlog.FromRequest(req).Err(err).Msg("failed to get ?pos=")
+		return 0, &internal.HandlerError{
+			StatusCode: 400,
+			ErrCode:    internal.ErrCodeInvalidParam,
+			Err:        fmt.Errorf("invalid position: %s", queryPos),
+		}
+	}
+	return cpos, nil
+}
+
+// accessTokenFromQuery sets the Authorization header from ?access_token= if the header is missing. This
+// is for browsers, which cannot set headers on WebSockets or EventSources.
+func accessTokenFromQuery(req *http.Request) {
+	if req.Header.Get("Authorization") == "" && req.URL.Query().Get("access_token") != "" {
+		req.Header.Set("Authorization", "Bearer "+req.URL.Query().Get("access_token"))
+	}
+}
+
+// timeoutFromRequest returns the ?timeout= in the request, in milliseconds, clamped to the configured bounds.
+// Returns DefaultTimeout if there is no timeout.
+func timeoutFromRequest(req *http.Request) (time.Duration, error) {
+	queryTimeout := req.URL.Query().Get("timeout")
+	if queryTimeout == "" {
+		return DefaultTimeout, nil
+	}
+	timeoutMS, err := strconv.ParseInt(queryTimeout, 10, 64)
+	if err != nil || timeoutMS < 0 {
+		hlog.FromRequest(req).Warn().Str("timeout", queryTimeout).Msg("failed to get ?timeout=")
+		return 0, &internal.HandlerError{
+			StatusCode: 400,
+			ErrCode:    internal.ErrCodeInvalidParam,
+			Err:        fmt.Errorf("invalid timeout: %s", queryTimeout),
+		}
+	}
+	return ClampTimeout(time.Duration(timeoutMS) * time.Millisecond), nil
+}
+
 // setupConnection associates this request with an existing connection or makes a new connection.
 // It also sets a v2 sync poll loop going if one didn't exist already for this user.
 // When this function returns, the connection is alive and active.
@@ -139,24 +241,37 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, syncReq *Request, c
 	if err != nil {
 		log.Warn().Err(err).Msg("failed to get device ID from request")
 		return nil, &internal.HandlerError{
-			StatusCode: 400,
+			StatusCode: 401,
+			ErrCode:    internal.ErrCodeMissingToken,
 			Err:        err,
 		}
 	}
 
+	cid := ConnID{
+		SessionID: syncReq.SessionID,
+		DeviceID:  deviceID,
+	}
+
 	// client thinks they have a connection
 	if containsPos {
 		// Lookup the connection
 		// we need to map based on both as the session ID isn't crypto secure but the device ID is (Auth header)
-		conn = h.ConnMap.Conn(ConnID{
-			SessionID: syncReq.SessionID,
-			DeviceID:  deviceID,
-		})
-		if err != nil {
-			log.Warn().Err(err).Msg("failed to lookup conn for request")
-			return nil, &internal.HandlerError{
-				StatusCode: 400,
-				Err:        err,
+		conn = h.ConnMap.Conn(cid)
+		if conn == nil || !conn.KnowsPosition(syncReq.pos) || h.PollerMap.NeedsPolling(deviceID) {
+			// We may have restarted, another instance may have served this connection since, or the
+			// instance polling for this device may have gone away. Make sure we are polling then load
+			// the connection from the database.
+			v2device, err := h.ensurePolling(req, deviceID)
+			if err != nil {
+				return nil, err
+			}
+			conn, err = h.ConnMap.RestoreConn(cid, v2device.UserID, syncReq.pos)
+			if err != nil {
+				log.Warn().Err(err).Msg("failed to restore conn for request")
+				return nil, &internal.HandlerError{
+					StatusCode: 500,
+					Err:        err,
+				}
 			}
 		}
 		if conn != nil {
@@ -165,12 +280,49 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, syncReq *Request, c
 		// conn doesn't exist, we probably nuked it.
 		return nil, &internal.HandlerError{
 			StatusCode: 400,
+			ErrCode:    internal.ErrCodeUnknownPos,
 			Err:        fmt.Errorf("session expired"),
 		}
 	}
 
 	// We're going to make a new connection
 	// Ensure we have the v2 side of things hooked up
+	v2device, err := h.ensurePolling(req, deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Now the v2 side of things are running, we can make a v3 live sync conn
+	// NB: this isn't inherently racey (we did the check for an existing conn before EnsurePolling)
+	// because we *either* do the existing check *or* make a new conn. It's important for CreateConn
+	// to check for an existing connection though, as it's possible for the client to call /sync
+	// twice for a new connection and get the same session ID.
+	conn, created := h.ConnMap.GetOrCreateConn(cid, v2device.UserID)
+	if created {
+		log.Info().Str("conn_id", conn.ConnID.String()).Msg("created new connection")
+	} else {
+		log.Info().Str("conn_id", conn.ConnID.String()).Msg("using existing connection")
+	}
+	return conn, nil
+}
+
+// ensurePolling makes sure there is a v2 poller running for this device, returning the v2 device.
+func (h *SyncLiveHandler) ensurePolling(req *http.Request, deviceID string) (*sync2.Device, error) {
+	log := hlog.FromRequest(req)
+	if _, invalid := h.invalidTokens.Load(deviceID); invalid {
+		return nil, errInvalidToken
+	}
+	invalid, err := h.V2Store.IsTokenInvalid(deviceID)
+	if err != nil {
+		log.Warn().Err(err).Str("device_id", deviceID).Msg("failed to check if token is invalid")
+		return nil, &internal.HandlerError{
+			StatusCode: 500,
+			Err:        err,
+		}
+	}
+	if invalid {
+		return nil, errInvalidToken
+	}
 	v2device, err := h.V2Store.InsertDevice(deviceID)
 	if err != nil {
 		log.Warn().Err(err).Str("device_id", deviceID).Msg("failed to insert v2 device")
@@ -180,13 +332,11 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, syncReq *Request, c
 		}
 	}
 	if v2device.UserID == "" {
-		v2device.UserID, err = h.V2.WhoAmI(req.Header.Get("Authorization"))
+		var statusCode int
+		v2device.UserID, statusCode, err = h.V2.WhoAmI(req.Header.Get("Authorization"))
 		if err != nil {
-			log.Warn().Err(err).Str("device_id", deviceID).Msg("failed to get user ID from device ID")
-			return nil, &internal.HandlerError{
-				StatusCode: http.StatusBadGateway,
-				Err:        err,
-			}
+			log.Warn().Err(err).Str("device_id", deviceID).Int("code", statusCode).Msg("failed to get user ID from device ID")
+			return nil, whoAmIError(statusCode, err)
 		}
 		if err = h.V2Store.UpdateUserIDForDevice(deviceID, v2device.UserID); err != nil {
 			log.Warn().Err(err).Str("device_id", deviceID).Msg("failed to persist user ID -> device ID mapping")
@@ -197,32 +347,77 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, syncReq *Request, c
 		req.Header.Get("Authorization"), v2device.UserID, v2device.DeviceID, v2device.Since,
 		hlog.FromRequest(req).With().Str("user_id", v2device.UserID).Logger(),
 	)
+	// the poller may have just found out that the token is invalid
+	if _, invalid := h.invalidTokens.Load(deviceID); invalid {
+		return nil, errInvalidToken
+	}
+	h.authHeaders.Store(deviceID, req.Header.Get("Authorization"))
+	if h.TokenStore != nil {
+		accessToken := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if err = h.TokenStore.UpsertToken(deviceID, accessToken); err != nil {
+			// non-fatal, we just won't resume polling for this device on startup
+			log.Warn().Err(err).Str("device_id", deviceID).Msg("failed to store access token")
+		}
+	}
+	return v2device, nil
+}
 
-	// Now the v2 side of things are running, we can make a v3 live sync conn
-	// NB: this isn't inherently racey (we did the check for an existing conn before EnsurePolling)
-	// because we *either* do the existing check *or* make a new conn. It's important for CreateConn
-	// to check for an existing connection though, as it's possible for the client to call /sync
-	// twice for a new connection and get the same session ID.
-	conn, created := h.ConnMap.GetOrCreateConn(ConnID{
-		SessionID: syncReq.SessionID,
-		DeviceID:  deviceID,
-	}, v2device.UserID)
-	if created {
-		log.Info().Str("conn_id", conn.ConnID.String()).Msg("created new connection")
-	} else {
-		log.Info().Str("conn_id", conn.ConnID.String()).Msg("using existing connection")
+// The error returned for all requests using an access token which the homeserver has rejected
+var errInvalidToken = &internal.HandlerError{
+	StatusCode: http.StatusUnauthorized,
+	ErrCode:    internal.ErrCodeUnknownToken,
+	Err:        fmt.Errorf("access token has been invalidated"),
+}
+
+// whoAmIError converts a failed /whoami request into an error for the client. Token errors are passed
+// through to the client, everything else is the upstream server's fault.
+func whoAmIError(statusCode int, err error) *internal.HandlerError {
+	switch statusCode {
+	case http.StatusUnauthorized:
+		return &internal.HandlerError{
+			StatusCode: http.StatusUnauthorized,
+			ErrCode:    internal.ErrCodeUnknownToken,
+			Err:        err,
+		}
+	case http.StatusTooManyRequests:
+		return &internal.HandlerError{
+			StatusCode: http.StatusTooManyRequests,
+			ErrCode:    internal.ErrCodeLimitExceeded,
+			Err:        err,
+		}
+	}
+	return &internal.HandlerError{
+		StatusCode: http.StatusBadGateway,
+		Err:        err,
 	}
-	return conn, nil
 }
 
 // Called from the v2 poller, implements V2DataReceiver
-func (h *SyncLiveHandler) UpdateDeviceSince(deviceID, since string) error {
-	return h.V2Store.UpdateDeviceSince(deviceID, since)
+func (h *SyncLiveHandler) Begin() (sync2.V2DataTxn, error) {
+	txn, err := h.Storage.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &v2Txn{
+		h:   h,
+		txn: txn,
+	}, nil
 }
 
-// Called from the v2 poller, implements V2DataReceiver
-func (h *SyncLiveHandler) Accumulate(roomID string, timeline []json.RawMessage) error {
-	numNew, latestPos, err := h.Storage.Accumulate(roomID, timeline)
+// v2Txn applies a single v2 response in one database transaction. Connections and other instances are
+// only told about the response once the transaction commits, so they never see data which is rolled back.
+type v2Txn struct {
+	h        *SyncLiveHandler
+	txn      *sqlx.Tx
+	onCommit []func()
+}
+
+func (t *v2Txn) UpdateDeviceSince(deviceID, since string) error {
+	return t.h.V2Store.UpdateDeviceSince(t.txn, deviceID, since)
+}
+
+func (t *v2Txn) Accumulate(roomID, prevBatch string, timeline []json.RawMessage) error {
+	numNew, latestPos, err := t.h.Storage.AccumulateTxn(t.txn, roomID, prevBatch, timeline)
 	if err != nil {
 		return err
 	}
@@ -231,44 +426,264 @@ func (h *SyncLiveHandler) Accumulate(roomID string, timeline []json.RawMessage)
 		return nil
 	}
 	newEvents := timeline[len(timeline)-numNew:]
+	if numNew != len(timeline) {
+		// the timeline overlaps events we already have so there is no gap
+		prevBatch = ""
+	}
 
-	// we have new events, let the connection map handle them
-	h.ConnMap.OnNewEvents(roomID, newEvents, latestPos)
-	return err
+	t.onCommit = append(t.onCommit, func() {
+		// we have new events, let the connection map handle them
+		t.h.ConnMap.OnNewEvents(roomID, newEvents, latestPos, prevBatch)
+		// and tell other instances about them
+		if err := t.h.Notifier.NotifyNewEvents(roomID, newEvents, latestPos, prevBatch); err != nil {
+			logger.Err(err).Str("room", roomID).Msg("failed to notify other instances of new events")
+		}
+	})
+	return nil
 }
 
-// Called from the v2 poller, implements V2DataReceiver
-func (h *SyncLiveHandler) Initialise(roomID string, state []json.RawMessage) error {
-	added, err := h.Storage.Initialise(roomID, state)
+func (t *v2Txn) Initialise(roomID string, state, timeline []json.RawMessage) error {
+	res, err := t.h.Storage.InitialiseTxn(t.txn, roomID, state, timeline)
 	if err != nil {
 		return err
 	}
-	if !added {
-		// no new events
-		return nil
+	if res.AddedEvents {
+		t.onCommit = append(t.onCommit, func() {
+			// we have new events, let the connection map handle them
+			t.h.ConnMap.OnNewEvents(roomID, state, 0, "")
+			if err := t.h.Notifier.NotifyNewEvents(roomID, state, 0, ""); err != nil {
+				logger.Err(err).Str("room", roomID).Msg("failed to notify other instances of new state")
+			}
+		})
 	}
-	// we have new events, let the connection map handle them
-	h.ConnMap.OnNewEvents(roomID, state, 0)
-	return err
+	if len(res.ReplacedState) > 0 {
+		t.onCommit = append(t.onCommit, func() {
+			// the current state was replaced, so connections need to re-send the room's state
+			t.h.ConnMap.OnStateReset(roomID, res.ReplacedState)
+			if err := t.h.Notifier.NotifyStateReset(roomID, res.ReplacedState); err != nil {
+				logger.Err(err).Str("room", roomID).Msg("failed to notify other instances of state reset")
+			}
+		})
+	}
+	return nil
 }
 
-// Called from the v2 poller, implements V2DataReceiver
-func (h *SyncLiveHandler) SetTyping(roomID string, userIDs []string) (int64, error) {
-	return h.Storage.TypingTable.SetTyping(roomID, userIDs)
+func (t *v2Txn) SetTyping(roomID, userID string, userIDs []string) (int64, error) {
+	return t.h.Storage.TypingTable.SetTyping(t.txn, roomID, userID, userIDs)
+}
+
+func (t *v2Txn) AddToDeviceMessages(userID, deviceID string, msgs []gomatrixserverlib.SendToDeviceEvent) error {
+	_, err := t.h.Storage.ToDeviceTable.InsertMessages(t.txn, deviceID, msgs)
+	if err != nil {
+		return err
+	}
+	t.onCommit = append(t.onCommit, func() {
+		t.h.ConnMap.OnToDeviceMessages(deviceID)
+		if err := t.h.Notifier.NotifyToDevice(deviceID); err != nil {
+			logger.Err(err).Str("device", deviceID).Msg("failed to notify other instances of to-device messages")
+		}
+	})
+	return nil
+}
+
+func (t *v2Txn) UpdateUnreadCounts(roomID, userID string, highlightCount, notifCount, unreadCount *int) error {
+	err := t.h.Storage.UnreadTable.UpdateUnreadCounters(t.txn, userID, roomID, highlightCount, notifCount, unreadCount)
+	if err != nil {
+		return err
+	}
+	t.onCommit = append(t.onCommit, func() {
+		t.h.ConnMap.OnUnreadCounts(roomID, userID, highlightCount, notifCount, unreadCount)
+		if err := t.h.Notifier.NotifyUnreadCounts(roomID, userID, highlightCount, notifCount, unreadCount); err != nil {
+			logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to notify other instances of unread counters")
+		}
+	})
+	return nil
+}
+
+func (t *v2Txn) Commit() error {
+	if err := t.txn.Commit(); err != nil {
+		return err
+	}
+	for _, fn := range t.onCommit {
+		fn()
+	}
+	return nil
+}
+
+func (t *v2Txn) Rollback() {
+	if err := t.txn.Rollback(); err != nil {
+		logger.Err(err).Msg("failed to rollback v2 response")
+	}
 }
 
 // Called from the v2 poller, implements V2DataReceiver
-// Add messages for this device. If an error is returned, the poll loop is terminated as continuing
-// would implicitly acknowledge these messages.
-func (h *SyncLiveHandler) AddToDeviceMessages(userID, deviceID string, msgs []gomatrixserverlib.SendToDeviceEvent) error {
-	_, err := h.Storage.ToDeviceTable.InsertMessages(deviceID, msgs)
-	return err
+func (h *SyncLiveHandler) OnInvalidToken(deviceID string) {
+	if err := h.V2Store.InvalidateToken(deviceID); err != nil {
+		logger.Err(err).Str("device", deviceID).Msg("failed to persist invalid token")
+	}
+	if h.TokenStore != nil {
+		if err := h.TokenStore.DeleteToken(deviceID); err != nil {
+			logger.Err(err).Str("device", deviceID).Msg("failed to delete invalid token")
+		}
+	}
+	h.closeInvalidTokenConns(deviceID)
+	if err := h.Notifier.NotifyInvalidToken(deviceID); err != nil {
+		logger.Err(err).Str("device", deviceID).Msg("failed to notify other instances of invalid token")
+	}
+}
+
+// closeInvalidTokenConns closes all connections for this device, which has an invalid access token.
+func (h *SyncLiveHandler) closeInvalidTokenConns(deviceID string) {
+	h.invalidTokens.Store(deviceID, true)
+	h.authHeaders.Delete(deviceID)
+	numClosed := h.ConnMap.CloseConnsForDevice(deviceID, errInvalidToken)
+	logger.Info().Str("device", deviceID).Int("num_conns", numClosed).Msg("closed connections for invalid token")
+}
+
+// revalidateTokens periodically checks that the access tokens of connections are still valid, if there
+// is no poller running for them which would notice the token being invalidated. Blocks forever.
+func (h *SyncLiveHandler) revalidateTokens() {
+	for range time.Tick(TokenRevalidationInterval) {
+		h.authHeaders.Range(func(key, value interface{}) bool {
+			deviceID := key.(string)
+			if !h.ConnMap.HasConnsForDevice(deviceID) {
+				// the conns have expired, so there is nothing to revalidate
+				h.authHeaders.Delete(deviceID)
+				return true
+			}
+			if !h.PollerMap.NeedsPolling(deviceID) {
+				return true // the poller will tell us if the token is invalid
+			}
+			_, statusCode, err := h.V2.WhoAmI(value.(string))
+			if statusCode == http.StatusUnauthorized {
+				h.OnInvalidToken(deviceID)
+			} else if err != nil {
+				// non-fatal, we'll try again next time
+				logger.Warn().Err(err).Str("device", deviceID).Int("code", statusCode).Msg("failed to revalidate token")
+			}
+			return true
+		})
+	}
 }
 
-func (h *SyncLiveHandler) UpdateUnreadCounts(roomID, userID string, highlightCount, notifCount *int) {
-	err := h.Storage.UnreadTable.UpdateUnreadCounters(userID, roomID, highlightCount, notifCount)
+// resumePollers starts pollers for devices which have connections which haven't expired, so data is
+// fresh when their clients reconnect. Tokens for other devices are deleted as they'll never be used.
+func (h *SyncLiveHandler) resumePollers() {
+	tokens, err := h.TokenStore.Tokens()
 	if err != nil {
-		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to update unread counters")
+		logger.Err(err).Msg("failed to load stored access tokens, not resuming pollers")
+		return
+	}
+	deviceIDs, err := h.ConnStore.SelectDeviceIDs()
+	if err != nil {
+		logger.Err(err).Msg("failed to load devices with connections, not resuming pollers")
+		return
+	}
+	hasConns := make(map[string]bool, len(deviceIDs))
+	for _, deviceID := range deviceIDs {
+		hasConns[deviceID] = true
+	}
+	numResumed := 0
+	for deviceID, accessToken := range tokens {
+		invalid, err := h.V2Store.IsTokenInvalid(deviceID)
+		if err != nil {
+			logger.Err(err).Str("device", deviceID).Msg("failed to check if token is invalid")
+			continue
+		}
+		if !hasConns[deviceID] || invalid {
+			if err = h.TokenStore.DeleteToken(deviceID); err != nil {
+				logger.Err(err).Str("device", deviceID).Msg("failed to delete unused token")
+			}
+			continue
+		}
+		device, err := h.V2Store.Device(deviceID)
+		if err != nil || device.UserID == "" {
+			logger.Warn().Err(err).Str("device", deviceID).Msg("failed to load device, not resuming poller")
+			continue
+		}
+		pollerLogger := logger.With().Str("user_id", device.UserID).Logger()
+		if device.Since == "" {
+			// this blocks until the first sync completes, which can take a while
+			go h.PollerMap.EnsurePolling("Bearer "+accessToken, device.UserID, deviceID, device.Since, pollerLogger)
+		} else {
+			h.PollerMap.EnsurePolling("Bearer "+accessToken, device.UserID, deviceID, device.Since, pollerLogger)
+		}
+		numResumed++
+	}
+	logger.Info().Int("num", numResumed).Msg("resumed pollers")
+}
+
+// stopIdlePollers periodically stops v2 pollers for devices which no longer have any connections.
+// Blocks forever.
+func (h *SyncLiveHandler) stopIdlePollers() {
+	if sync2.PollerIdleTimeout == 0 {
+		return
+	}
+	for range time.Tick(sync2.PollerIdleTimeout / 2) {
+		numStopped := h.PollerMap.StopIdlePollers(h.hasConnsForDevice)
+		if numStopped > 0 {
+			logger.Info().Int("num", numStopped).Msg("stopped idle pollers")
+		}
+	}
+}
+
+// hasConnsForDevice returns true if this device has connections on this instance or any other instance.
+// Connections are often served by a different instance to the one polling for the device.
+func (h *SyncLiveHandler) hasConnsForDevice(deviceID string) bool {
+	if h.ConnMap.HasConnsForDevice(deviceID) {
+		return true
+	}
+	if h.ConnStore == nil {
+		return false
+	}
+	hasConns, err := h.ConnStore.HasConnsForDevice(deviceID, time.Now().Add(-ConnTTL))
+	if err != nil {
+		logger.Err(err).Str("device", deviceID).Msg("failed to check for connections on other instances")
+		// don't stop the poller if we don't know
+		return true
+	}
+	return hasConns
+}
+
+// Called when another instance has processed data from a v2 poller.
+func (h *SyncLiveHandler) onNotification(n *Notification) {
+	switch n.Type {
+	case NotificationTypeEvents:
+		events, err := h.Storage.EventsByIDs(n.EventIDs)
+		if err != nil {
+			logger.Err(err).Str("room", n.RoomID).Msg("failed to load events from notification")
+			return
+		}
+		eventsJSON := make([]json.RawMessage, len(events))
+		for i := range events {
+			eventsJSON[i] = events[i].JSON
+		}
+		h.ConnMap.OnNewEvents(n.RoomID, eventsJSON, n.LatestPos, n.PrevBatch)
+	case NotificationTypeStateReset:
+		events, err := h.Storage.EventsByIDs(n.EventIDs)
+		if err != nil {
+			logger.Err(err).Str("room", n.RoomID).Msg("failed to load replaced state from notification")
+			return
+		}
+		eventsJSON := make([]json.RawMessage, len(events))
+		for i := range events {
+			eventsJSON[i] = events[i].JSON
+		}
+		h.ConnMap.OnStateReset(n.RoomID, eventsJSON)
+	case NotificationTypeUnread:
+		h.ConnMap.OnUnreadCounts(n.RoomID, n.UserID, n.HighlightCount, n.NotificationCount, n.UnreadCount)
+	case NotificationTypeInvalidToken:
+		h.closeInvalidTokenConns(n.DeviceID)
+	case NotificationTypeToDevice:
+		h.ConnMap.OnToDeviceMessages(n.DeviceID)
+	}
+}
+
+// randomID returns a random hex string, used to identify this instance.
+func randomID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
 	}
-	h.ConnMap.OnUnreadCounts(roomID, userID, highlightCount, notifCount)
+	return hex.EncodeToString(b), nil
 }
@@ -0,0 +1,185 @@
+package sync3
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/tidwall/gjson"
+)
+
+// The postgres channel used to fan out updates between instances
+const notifyChannel = "syncv3_notifications"
+
+// Postgres limits NOTIFY payloads to 8000 bytes, so keep the event IDs in a single payload below this
+const maxNotifyEventIDBytes = 6000
+
+const (
+	NotificationTypeEvents       = "events"
+	NotificationTypeUnread       = "unread"
+	NotificationTypeInvalidToken = "invalid_token"
+	NotificationTypeStateReset   = "state_reset"
+	NotificationTypeToDevice     = "to_device"
+)
+
+// Notification is an update sent from one instance to all other instances sharing the same database.
+type Notification struct {
+	Type       string `json:"type"`
+	InstanceID string `json:"instance_id"`
+	RoomID     string `json:"room_id"`
+	// for NotificationTypeEvents: the new events which have been stored, along with the latest position
+	// at the time they were stored. PrevBatch is set if there is a timeline gap before the first event.
+	// for NotificationTypeStateReset: the state events which replaced the current state.
+	EventIDs  []string `json:"event_ids,omitempty"`
+	LatestPos int64    `json:"latest_pos,omitempty"`
+	PrevBatch string   `json:"prev_batch,omitempty"`
+	// for NotificationTypeUnread
+	UserID            string `json:"user_id,omitempty"`
+	HighlightCount    *int   `json:"highlight_count,omitempty"`
+	NotificationCount *int   `json:"notification_count,omitempty"`
+	UnreadCount       *int   `json:"unread_count,omitempty"`
+	// for NotificationTypeInvalidToken and NotificationTypeToDevice
+	DeviceID string `json:"device_id,omitempty"`
+}
+
+// Notifier fans out updates between proxy instances which share the same database via postgres
+// LISTEN/NOTIFY. Each instance only polls for some devices, so updates received from v2 poll loops
+// need to be sent to every other instance so they can update their in-memory state and connections.
+type Notifier struct {
+	db         *sqlx.DB
+	listener   *pq.Listener
+	instanceID string
+}
+
+// NewNotifier makes a new notifier and starts listening for notifications from other instances.
+// The callback is invoked for every notification sent by another instance.
+func NewNotifier(postgresURI, instanceID string, callback func(n *Notification)) *Notifier {
+	db, err := sqlx.Open("postgres", postgresURI)
+	if err != nil {
+		logger.Panic().Err(err).Str("uri", postgresURI).Msg("failed to open SQL DB")
+	}
+	listener := pq.NewListener(postgresURI, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		switch ev {
+		case pq.ListenerEventDisconnected:
+			logger.Warn().Err(err).Msg("Notifier: disconnected from database")
+		case pq.ListenerEventReconnected:
+			// notifications sent whilst we were disconnected are lost
+			logger.Warn().Msg("Notifier: reconnected to database, updates from other instances may have been missed")
+		case pq.ListenerEventConnectionAttemptFailed:
+			logger.Warn().Err(err).Msg("Notifier: failed to connect to database")
+		}
+	})
+	if err = listener.Listen(notifyChannel); err != nil {
+		logger.Panic().Err(err).Msg("failed to LISTEN for notifications")
+	}
+	n := &Notifier{
+		db:         db,
+		listener:   listener,
+		instanceID: instanceID,
+	}
+	go n.listen(callback)
+	return n
+}
+
+func (n *Notifier) listen(callback func(n *Notification)) {
+	for pqNotification := range n.listener.Notify {
+		if pqNotification == nil {
+			// sent on reconnection
+			continue
+		}
+		var notification Notification
+		if err := json.Unmarshal([]byte(pqNotification.Extra), &notification); err != nil {
+			logger.Err(err).Str("payload", pqNotification.Extra).Msg("Notifier: failed to unmarshal notification")
+			continue
+		}
+		if notification.InstanceID == n.instanceID {
+			continue // we sent this
+		}
+		callback(&notification)
+	}
+}
+
+// NotifyNewEvents tells other instances that these events have been stored. `prevBatch` is set if there
+// is a timeline gap before the first event.
+func (n *Notifier) NotifyNewEvents(roomID string, events []json.RawMessage, latestPos int64, prevBatch string) error {
+	return n.notifyEvents(NotificationTypeEvents, roomID, events, latestPos, prevBatch)
+}
+
+// NotifyStateReset tells other instances that the current state of this room was replaced by these events.
+func (n *Notifier) NotifyStateReset(roomID string, replacedState []json.RawMessage) error {
+	return n.notifyEvents(NotificationTypeStateReset, roomID, replacedState, 0, "")
+}
+
+// notifyEvents sends the IDs of these events, split over as many notifications as needed to fit in the
+// NOTIFY payload limit.
+func (n *Notifier) notifyEvents(notificationType, roomID string, events []json.RawMessage, latestPos int64, prevBatch string) error {
+	var eventIDs []string
+	size := 0
+	for _, ev := range events {
+		eventID := gjson.GetBytes(ev, "event_id").Str
+		if size+len(eventID) > maxNotifyEventIDBytes {
+			if err := n.notifyEventIDs(notificationType, roomID, eventIDs, latestPos, prevBatch); err != nil {
+				return err
+			}
+			// the gap is only before the first event
+			prevBatch = ""
+			eventIDs = nil
+			size = 0
+		}
+		eventIDs = append(eventIDs, eventID)
+		size += len(eventID)
+	}
+	if len(eventIDs) == 0 {
+		return nil
+	}
+	return n.notifyEventIDs(notificationType, roomID, eventIDs, latestPos, prevBatch)
+}
+
+func (n *Notifier) notifyEventIDs(notificationType, roomID string, eventIDs []string, latestPos int64, prevBatch string) error {
+	return n.notify(&Notification{
+		Type:      notificationType,
+		RoomID:    roomID,
+		EventIDs:  eventIDs,
+		LatestPos: latestPos,
+		PrevBatch: prevBatch,
+	})
+}
+
+// NotifyUnreadCounts tells other instances that the unread counts for this user in this room have changed.
+func (n *Notifier) NotifyUnreadCounts(roomID, userID string, highlightCount, notifCount, unreadCount *int) error {
+	return n.notify(&Notification{
+		Type:              NotificationTypeUnread,
+		RoomID:            roomID,
+		UserID:            userID,
+		HighlightCount:    highlightCount,
+		NotificationCount: notifCount,
+		UnreadCount:       unreadCount,
+	})
+}
+
+// NotifyInvalidToken tells other instances that the access token for this device has been rejected.
+func (n *Notifier) NotifyInvalidToken(deviceID string) error {
+	return n.notify(&Notification{
+		Type:     NotificationTypeInvalidToken,
+		DeviceID: deviceID,
+	})
+}
+
+// NotifyToDevice tells other instances that new to-device messages have been stored for this device.
+func (n *Notifier) NotifyToDevice(deviceID string) error {
+	return n.notify(&Notification{
+		Type:     NotificationTypeToDevice,
+		DeviceID: deviceID,
+	})
+}
+
+func (n *Notifier) notify(notification *Notification) error {
+	notification.InstanceID = n.instanceID
+	payload, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	_, err = n.db.Exec(`SELECT pg_notify($1, $2)`, notifyChannel, string(payload))
+	return err
+}
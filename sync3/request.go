@@ -3,6 +3,7 @@ package sync3
 import (
 	"bytes"
 	"encoding/json"
+	"time"
 )
 
 var (
@@ -10,8 +11,19 @@ var (
 	SortByRecency           = "by_recency"
 	SortByNotificationCount = "by_notification_count"
 	SortByHighlightCount    = "by_highlight_count"
-	SortBy                  = []string{SortByHighlightCount, SortByName, SortByNotificationCount, SortByRecency}
+	SortByUnreadCount       = "by_unread_count"
+	SortBy                  = []string{SortByHighlightCount, SortByName, SortByNotificationCount, SortByRecency, SortByUnreadCount}
 	DefaultTimelineLimit    = int64(20)
+	DefaultToDeviceLimit    = int64(100)
+)
+
+var (
+	// The long-poll timeout used when the client doesn't specify ?timeout=
+	DefaultTimeout = 10 * time.Second
+	// The bounds the client-specified ?timeout= is clamped to. A timeout of 0 is always allowed and means
+	// "return immediately with whatever is buffered".
+	MinTimeout = 1 * time.Second
+	MaxTimeout = 5 * time.Minute
 )
 
 type Request struct {
@@ -22,11 +34,32 @@ type Request struct {
 	RoomSubscriptions map[string]RoomSubscription `json:"room_subscriptions"`
 	UnsubscribeRooms  []string                    `json:"unsubscribe_rooms"`
 	Filters           *RequestFilters             `json:"filters"`
+	// If true, thread replies are not sent in room timelines. Instead, the thread root is sent with a summary
+	// of the thread. Rooms are still bumped by thread replies.
+	ExcludeThreadReplies *bool `json:"exclude_thread_replies,omitempty"`
+	// If set, to-device messages for this device are sent in responses.
+	ToDevice *ToDeviceRequest `json:"to_device,omitempty"`
 	// set via query params or inferred
 	pos       int64
+	timeout   time.Duration
 	SessionID string `json:"session_id"`
 }
 
+// ClampTimeout restricts a client-specified timeout to the server configured bounds. A timeout of 0
+// is left as-is.
+func ClampTimeout(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		return 0
+	}
+	if timeout < MinTimeout {
+		return MinTimeout
+	}
+	if timeout > MaxTimeout {
+		return MaxTimeout
+	}
+	return timeout
+}
+
 func (r *Request) Same(other *Request) bool {
 	serialised, err := json.Marshal(r)
 	if err != nil {
@@ -68,13 +101,23 @@ func (r *Request) ApplyDelta(next *Request) (result *Request, subs, unsubs []str
 	if filters == nil {
 		filters = r.Filters
 	}
+	excludeThreadReplies := next.ExcludeThreadReplies
+	if excludeThreadReplies == nil {
+		excludeThreadReplies = r.ExcludeThreadReplies
+	}
+	toDevice := next.ToDevice
+	if toDevice == nil {
+		toDevice = r.ToDevice
+	}
 	result = &Request{
-		SessionID:     sessionID,
-		Rooms:         rooms,
-		Sort:          sort,
-		RequiredState: globalReqState,
-		TimelineLimit: timelineLimit,
-		Filters:       filters,
+		SessionID:            sessionID,
+		Rooms:                rooms,
+		Sort:                 sort,
+		RequiredState:        globalReqState,
+		TimelineLimit:        timelineLimit,
+		Filters:              filters,
+		ExcludeThreadReplies: excludeThreadReplies,
+		ToDevice:             toDevice,
 	}
 	// Work out subscriptions. The operations are applied as:
 	// old.subs -> apply old.unsubs (should be empty) -> apply new.subs -> apply new.unsubs
@@ -142,6 +185,34 @@ func (r *Request) GetRequiredState(roomID string) [][2]string {
 	return rs
 }
 
+// ExcludesThreadReplies returns true if thread replies should not be sent in room timelines.
+func (r *Request) ExcludesThreadReplies() bool {
+	return r.ExcludeThreadReplies != nil && *r.ExcludeThreadReplies
+}
+
+// GetThreadRoot returns the event ID of the thread root if the room subscription targets a thread.
+func (r *Request) GetThreadRoot(roomID string) string {
+	return r.RoomSubscriptions[roomID].ThreadRoot
+}
+
+// ToDeviceRequest controls how to-device messages are sent. Messages are deleted once the client makes a
+// request with the position of the response they were sent in.
+type ToDeviceRequest struct {
+	// The max number of messages to send in each response. Defaults to DefaultToDeviceLimit.
+	Limit int64 `json:"limit,omitempty"`
+	// If true, messages carrying room keys (see state.RoomKeyEventTypes) are sent before all other messages,
+	// which remain queued in order.
+	RoomKeysFirst bool `json:"room_keys_first,omitempty"`
+}
+
+// GetLimit returns the max number of to-device messages to send in each response.
+func (r *ToDeviceRequest) GetLimit() int64 {
+	if r.Limit > 0 {
+		return r.Limit
+	}
+	return DefaultToDeviceLimit
+}
+
 type RequestFilters struct {
 	Spaces []string `json:"spaces"`
 	// TODO options to control which events should be live-streamed e.g not_types, types from sync v2
@@ -150,4 +221,6 @@ type RequestFilters struct {
 type RoomSubscription struct {
 	RequiredState [][2]string `json:"required_state"`
 	TimelineLimit int64       `json:"timeline_limit"`
+	// If set, the timeline only contains this thread root and the replies in the thread.
+	ThreadRoot string `json:"thread_root,omitempty"`
 }
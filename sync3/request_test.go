@@ -3,6 +3,7 @@ package sync3
 import (
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestRequestApplyDeltas(t *testing.T) {
@@ -101,6 +102,39 @@ func TestRequestApplyDeltas(t *testing.T) {
 				},
 			},
 		},
+		{
+			input: Request{
+				SessionID:            "a",
+				ExcludeThreadReplies: boolPtr(true),
+			},
+			tests: []struct {
+				next  Request
+				check func(t *testing.T, r Request, subs, unsubs []string)
+			}{
+				// check excluding thread replies is sticky
+				{
+					next: Request{
+						Sort: []string{"by_recency"},
+					},
+					check: func(t *testing.T, r Request, subs, unsubs []string) {
+						if !r.ExcludesThreadReplies() {
+							t.Errorf("ExcludeThreadReplies was not kept, got %+v", r)
+						}
+					},
+				},
+				// check thread replies can be included again
+				{
+					next: Request{
+						ExcludeThreadReplies: boolPtr(false),
+					},
+					check: func(t *testing.T, r Request, subs, unsubs []string) {
+						if r.ExcludesThreadReplies() {
+							t.Errorf("ExcludeThreadReplies was not updated, got %+v", r)
+						}
+					},
+				},
+			},
+		},
 	}
 	for _, tc := range testCases {
 		for _, test := range tc.tests {
@@ -110,6 +144,26 @@ func TestRequestApplyDeltas(t *testing.T) {
 	}
 }
 
+func TestRequestClampTimeout(t *testing.T) {
+	testCases := []struct {
+		input time.Duration
+		want  time.Duration
+	}{
+		{input: 0, want: 0},
+		{input: MinTimeout / 2, want: MinTimeout},
+		{input: MinTimeout, want: MinTimeout},
+		{input: 20 * time.Second, want: 20 * time.Second},
+		{input: MaxTimeout, want: MaxTimeout},
+		{input: MaxTimeout * 2, want: MaxTimeout},
+	}
+	for _, tc := range testCases {
+		got := ClampTimeout(tc.input)
+		if got != tc.want {
+			t.Errorf("ClampTimeout(%v): got %v want %v", tc.input, got, tc.want)
+		}
+	}
+}
+
 func ensureEmpty(t *testing.T, others ...[]string) {
 	t.Helper()
 	for _, slice := range others {
@@ -118,3 +172,7 @@ func ensureEmpty(t *testing.T, others ...[]string) {
 		}
 	}
 }
+
+func boolPtr(b bool) *bool {
+	return &b
+}
@@ -1,5 +1,11 @@
 package sync3
 
+import (
+	"encoding/json"
+
+	"github.com/tidwall/gjson"
+)
+
 type Response struct {
 	Ops []ResponseOp `json:"ops"`
 
@@ -8,6 +14,50 @@ type Response struct {
 
 	Pos     int64  `json:"pos"`
 	Session string `json:"session_id,omitempty"`
+
+	// To-device messages for this device, if the request asked for them.
+	ToDevice []json.RawMessage `json:"to_device,omitempty"`
+
+	// Degraded is true if the upstream homeserver is down, meaning this response may be missing recent data.
+	Degraded bool `json:"degraded,omitempty"`
+}
+
+// UnmarshalJSON decodes a response, picking the right ResponseOp type for each operation. This is
+// required in order to restore responses which were persisted to the database.
+func (r *Response) UnmarshalJSON(b []byte) error {
+	var temp struct {
+		Ops               []json.RawMessage `json:"ops"`
+		RoomSubscriptions map[string]Room   `json:"room_subscriptions"`
+		Count             int64             `json:"count"`
+		Pos               int64             `json:"pos"`
+		Session           string            `json:"session_id"`
+		ToDevice          []json.RawMessage `json:"to_device"`
+		Degraded          bool              `json:"degraded"`
+	}
+	if err := json.Unmarshal(b, &temp); err != nil {
+		return err
+	}
+	r.RoomSubscriptions = temp.RoomSubscriptions
+	r.Count = temp.Count
+	r.Pos = temp.Pos
+	r.Session = temp.Session
+	r.ToDevice = temp.ToDevice
+	r.Degraded = temp.Degraded
+	r.Ops = nil
+	for _, op := range temp.Ops {
+		var rop ResponseOp
+		switch gjson.GetBytes(op, "op").Str {
+		case "SYNC", "INVALIDATE":
+			rop = &ResponseOpRange{}
+		default: // DELETE, INSERT, UPDATE
+			rop = &ResponseOpSingle{}
+		}
+		if err := json.Unmarshal(op, rop); err != nil {
+			return err
+		}
+		r.Ops = append(r.Ops, rop)
+	}
+	return nil
 }
 
 type ResponseOp interface {
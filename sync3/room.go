@@ -11,6 +11,12 @@ type Room struct {
 	Timeline          []json.RawMessage `json:"timeline,omitempty"`
 	NotificationCount int64             `json:"notification_count"`
 	HighlightCount    int64             `json:"highlight_count"`
+	// UnreadCount is the number of unread messages (MSC2654), if the upstream server provides it.
+	UnreadCount int64 `json:"unread_count"`
+	// Limited is true if there is a gap between the events the client has and this timeline, which can
+	// be filled by paginating backwards from PrevBatch.
+	Limited   bool   `json:"limited,omitempty"`
+	PrevBatch string `json:"prev_batch,omitempty"`
 }
 
 // SortableRoom is a room with all globally sortable fields included
@@ -20,6 +26,9 @@ type SortableRoom struct {
 	Name                 string // by_name
 	LastMessageTimestamp int64  // by_recency
 	LastEventJSON        json.RawMessage
+	// The latest position of the last event in this room. The NID of the last event is guaranteed to
+	// be <= this value. Used to work out if a room has changed since it was last sent to a client.
+	LastEventNID int64
 }
 
 type SortableRooms []SortableRoom
@@ -34,4 +43,5 @@ func (s SortableRooms) Subslice(i, j int64) Subslicer {
 type userRoomData struct {
 	notificationCount int
 	highlightCount    int
+	unreadCount       int
 }
@@ -0,0 +1,90 @@
+package sync3
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+)
+
+// ConnStorage persists connection state so connections can survive the server restarting.
+type ConnStorage struct {
+	db *sqlx.DB
+}
+
+func NewConnStorage(postgresURI string) *ConnStorage {
+	db, err := sqlx.Open("postgres", postgresURI)
+	if err != nil {
+		logger.Panic().Err(err).Str("uri", postgresURI).Msg("failed to open SQL DB")
+	}
+	db.MustExec(`
+	CREATE TABLE IF NOT EXISTS syncv3_sync3_conns (
+		conn_id TEXT PRIMARY KEY, -- ConnID.String()
+		user_id TEXT NOT NULL,
+		device_id TEXT NOT NULL,
+		data TEXT NOT NULL, -- JSON encoded connSnapshot
+		updated_at BIGINT NOT NULL -- unix millis
+	);
+	CREATE INDEX IF NOT EXISTS syncv3_sync3_conns_device_idx ON syncv3_sync3_conns(device_id, updated_at);`)
+	return &ConnStorage{
+		db: db,
+	}
+}
+
+// UpsertConn stores the snapshot of this connection, replacing any previous snapshot.
+func (s *ConnStorage) UpsertConn(cid ConnID, userID string, data []byte) error {
+	_, err := s.db.Exec(`
+		INSERT INTO syncv3_sync3_conns(conn_id, user_id, device_id, data, updated_at) VALUES($1,$2,$3,$4,$5)
+		ON CONFLICT (conn_id) DO UPDATE SET data = $4, updated_at = $5`,
+		cid.String(), userID, cid.DeviceID, string(data), time.Now().UnixNano()/int64(time.Millisecond),
+	)
+	return err
+}
+
+// SelectConn returns the snapshot for this connection. Returns no data and no error if the connection
+// doesn't exist or hasn't been updated since `notBefore`.
+func (s *ConnStorage) SelectConn(cid ConnID, notBefore time.Time) (userID string, data []byte, err error) {
+	var dataStr string
+	err = s.db.QueryRow(
+		`SELECT user_id, data FROM syncv3_sync3_conns WHERE conn_id = $1 AND updated_at >= $2`,
+		cid.String(), notBefore.UnixNano()/int64(time.Millisecond),
+	).Scan(&userID, &dataStr)
+	if err == sql.ErrNoRows {
+		return "", nil, nil
+	}
+	return userID, []byte(dataStr), err
+}
+
+// SelectDeviceIDs returns the device IDs of all stored connections.
+func (s *ConnStorage) SelectDeviceIDs() ([]string, error) {
+	var deviceIDs []string
+	err := s.db.Select(&deviceIDs, `SELECT DISTINCT device_id FROM syncv3_sync3_conns`)
+	return deviceIDs, err
+}
+
+// HasConnsForDevice returns true if this device has a connection on any instance which has been updated
+// since `notBefore`.
+func (s *ConnStorage) HasConnsForDevice(deviceID string, notBefore time.Time) (bool, error) {
+	var exists bool
+	err := s.db.QueryRow(
+		`SELECT EXISTS(SELECT 1 FROM syncv3_sync3_conns WHERE device_id = $1 AND updated_at >= $2)`,
+		deviceID, notBefore.UnixNano()/int64(time.Millisecond),
+	).Scan(&exists)
+	return exists, err
+}
+
+func (s *ConnStorage) DeleteConn(cid ConnID) error {
+	_, err := s.db.Exec(`DELETE FROM syncv3_sync3_conns WHERE conn_id = $1`, cid.String())
+	return err
+}
+
+// DeleteConnsBefore removes all connections which haven't been updated since `before`. Returns the
+// number of connections deleted.
+func (s *ConnStorage) DeleteConnsBefore(before time.Time) (int64, error) {
+	res, err := s.db.Exec(`DELETE FROM syncv3_sync3_conns WHERE updated_at < $1`, before.UnixNano()/int64(time.Millisecond))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
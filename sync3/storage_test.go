@@ -0,0 +1,77 @@
+package sync3
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConnStorage(t *testing.T) {
+	store := NewConnStorage(postgresConnectionString)
+	cid := ConnID{
+		SessionID: "TestConnStorage",
+		DeviceID:  "TEST_DEVICE_ID",
+	}
+	alice := "@alice:localhost"
+	if err := store.UpsertConn(cid, alice, []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("UpsertConn returned error: %s", err)
+	}
+	if err := store.UpsertConn(cid, alice, []byte(`{"a":2}`)); err != nil {
+		t.Fatalf("UpsertConn returned error: %s", err)
+	}
+	userID, data, err := store.SelectConn(cid, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("SelectConn returned error: %s", err)
+	}
+	if userID != alice || string(data) != `{"a":2}` {
+		t.Fatalf("SelectConn: got %s %s want %s %s", userID, string(data), alice, `{"a":2}`)
+	}
+	// the device has a recent connection, but not one updated in the future
+	for notBefore, want := range map[time.Duration]bool{-time.Minute: true, time.Minute: false} {
+		hasConns, err := store.HasConnsForDevice(cid.DeviceID, time.Now().Add(notBefore))
+		if err != nil {
+			t.Fatalf("HasConnsForDevice returned error: %s", err)
+		}
+		if hasConns != want {
+			t.Errorf("HasConnsForDevice(%v): got %v want %v", notBefore, hasConns, want)
+		}
+	}
+	// connections which are too old aren't returned
+	_, data, err = store.SelectConn(cid, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("SelectConn returned error: %s", err)
+	}
+	if data != nil {
+		t.Fatalf("SelectConn returned data for an old connection: %s", string(data))
+	}
+
+	// expired connections are deleted
+	numDeleted, err := store.DeleteConnsBefore(time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("DeleteConnsBefore returned error: %s", err)
+	}
+	if numDeleted == 0 {
+		t.Fatalf("DeleteConnsBefore deleted no connections")
+	}
+	_, data, err = store.SelectConn(cid, time.Unix(0, 0))
+	if err != nil {
+		t.Fatalf("SelectConn returned error: %s", err)
+	}
+	if data != nil {
+		t.Fatalf("SelectConn returned data for a deleted connection: %s", string(data))
+	}
+
+	// unknown connections return nothing, and can be deleted
+	if err = store.UpsertConn(cid, alice, []byte(`{}`)); err != nil {
+		t.Fatalf("UpsertConn returned error: %s", err)
+	}
+	if err = store.DeleteConn(cid); err != nil {
+		t.Fatalf("DeleteConn returned error: %s", err)
+	}
+	_, data, err = store.SelectConn(cid, time.Unix(0, 0))
+	if err != nil {
+		t.Fatalf("SelectConn returned error: %s", err)
+	}
+	if data != nil {
+		t.Fatalf("SelectConn returned data for a deleted connection: %s", string(data))
+	}
+}
@@ -19,39 +19,39 @@ func NewJoinedRoomsTracker() *JoinedRoomsTracker {
 	}
 }
 
+// UserJoinedRoom marks the user as joined to the room. Joining a room the user is already joined to,
+// e.g because they changed their display name, does nothing.
 func (t *JoinedRoomsTracker) UserJoinedRoom(userID, roomID string) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	joinedRooms := t.userIDToJoinedRooms[userID]
-	joinedUsers := t.roomIDToJoinedUsers[roomID]
-	joinedRooms = append(joinedRooms, roomID)
-	joinedUsers = append(joinedUsers, userID)
-	t.userIDToJoinedRooms[userID] = joinedRooms
-	t.roomIDToJoinedUsers[roomID] = joinedUsers
+	for _, joinedRoomID := range t.userIDToJoinedRooms[userID] {
+		if joinedRoomID == roomID {
+			return
+		}
+	}
+	t.userIDToJoinedRooms[userID] = append(t.userIDToJoinedRooms[userID], roomID)
+	t.roomIDToJoinedUsers[roomID] = append(t.roomIDToJoinedUsers[roomID], userID)
 }
 
 func (t *JoinedRoomsTracker) UserLeftRoom(userID, roomID string) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	joinedRooms := t.userIDToJoinedRooms[userID]
-	for i := 0; i < len(joinedRooms); i++ {
-		if roomID == joinedRooms[i] {
-			// remove without preserving order
-			joinedRooms[i] = joinedRooms[len(joinedRooms)-1]
-			joinedRooms = joinedRooms[:len(joinedRooms)-1]
-		}
-	}
-	joinedUsers := t.roomIDToJoinedUsers[roomID]
-	for i := 0; i < len(joinedUsers); i++ {
-		if userID == joinedUsers[i] {
-			// remove without preserving order
-			joinedUsers[i] = joinedUsers[len(joinedUsers)-1]
-			joinedUsers = joinedUsers[:len(joinedUsers)-1]
+	t.userIDToJoinedRooms[userID] = removeString(t.userIDToJoinedRooms[userID], roomID)
+	t.roomIDToJoinedUsers[roomID] = removeString(t.roomIDToJoinedUsers[roomID], userID)
+}
+
+// removeString removes all occurrences of val from the slice without preserving order.
+func removeString(slice []string, val string) []string {
+	for i := 0; i < len(slice); i++ {
+		if slice[i] == val {
+			slice[i] = slice[len(slice)-1]
+			slice = slice[:len(slice)-1]
+			i-- // check the value which was swapped in
 		}
 	}
-	t.userIDToJoinedRooms[userID] = joinedRooms
-	t.roomIDToJoinedUsers[roomID] = joinedUsers
+	return slice
 }
+
 func (t *JoinedRoomsTracker) JoinedRoomsForUser(userID string) []string {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
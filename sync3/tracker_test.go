@@ -26,6 +26,14 @@ func TestTracker(t *testing.T) {
 	jrt.UserLeftRoom("alice", "unknown")
 	jrt.UserLeftRoom("unknown", "unknown2")
 	assertEqualSlices(t, jrt.JoinedRoomsForUser("alice"), []string{"room2"})
+
+	// joining a room twice (e.g a display name change) doesn't need 2 leaves
+	jrt.UserJoinedRoom("alice", "room3")
+	jrt.UserJoinedRoom("alice", "room3")
+	assertEqualSlices(t, jrt.JoinedUsersForRoom("room3"), []string{"alice", "bob"})
+	jrt.UserLeftRoom("alice", "room3")
+	assertEqualSlices(t, jrt.JoinedRoomsForUser("alice"), []string{"room2"})
+	assertEqualSlices(t, jrt.JoinedUsersForRoom("room3"), []string{"bob"})
 }
 
 func assertEqualSlices(t *testing.T, got, want []string) {
@@ -0,0 +1,228 @@
+package sync3
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/matrix-org/sync-v3/internal"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+)
+
+var (
+	// How long to wait for updates before starting a new iteration of the sync loop on a WebSocket.
+	// Responses with nothing in them are still sent as keepalives, so clients always have the latest
+	// position to resume from.
+	WebSocketSyncTimeout = 30 * time.Second
+	// How often to ping the client, and how long to wait for the client to respond.
+	WebSocketPingInterval = 30 * time.Second
+	WebSocketPongTimeout  = 60 * time.Second
+)
+
+var upgrader = websocket.Upgrader{
+	// Clients authenticate with an access token rather than cookies, so cross-origin requests are fine.
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// WebSocketHandler returns a net.http Handler for sync v3 over a WebSocket. Clients send request deltas
+// as text messages and receive responses as text messages as soon as there is something to send.
+// This uses the same Conn and ConnState as the long-polling endpoint, so positions are shared:
+// clients can resume an existing connection by specifying ?pos= when connecting.
+//
+// As browsers cannot set headers on WebSockets, the access token can be given via ?access_token=
+func (h *SyncLiveHandler) WebSocketHandler() http.Handler {
+	return http.HandlerFunc(h.serveWebSocket)
+}
+
+func (h *SyncLiveHandler) serveWebSocket(w http.ResponseWriter, req *http.Request) {
+	accessTokenFromQuery(req)
+	ws, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		// the upgrader has already sent an HTTP error
+		hlog.FromRequest(req).Warn().Err(err).Msg("failed to upgrade to websocket")
+		return
+	}
+	defer ws.Close()
+	if err = h.serveWebSocketConn(ws, req); err != nil {
+		herr, ok := err.(*internal.HandlerError)
+		if !ok {
+			herr = &internal.HandlerError{
+				StatusCode: 500,
+				Err:        err,
+			}
+		}
+		ws.WriteMessage(websocket.TextMessage, herr.JSON())
+		closeCode := websocket.CloseInternalServerErr
+		if herr.StatusCode < 500 {
+			closeCode = websocket.ClosePolicyViolation
+		}
+		ws.WriteControl(
+			websocket.CloseMessage, websocket.FormatCloseMessage(closeCode, herr.Err.Error()),
+			time.Now().Add(time.Second),
+		)
+	}
+}
+
+func (h *SyncLiveHandler) serveWebSocketConn(ws *websocket.Conn, req *http.Request) error {
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+
+	// keep the connection alive and detect dead clients
+	ws.SetReadDeadline(time.Now().Add(WebSocketPongTimeout))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(WebSocketPongTimeout))
+	})
+	go func() {
+		ticker := time.NewTicker(WebSocketPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(WebSocketPongTimeout))
+				if err != nil {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	// read request deltas from the client
+	incoming := make(chan *Request)
+	readErrs := make(chan error, 1)
+	go func() {
+		defer cancel()
+		for {
+			_, msg, err := ws.ReadMessage()
+			if err != nil {
+				if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					readErrs <- err
+				}
+				return
+			}
+			var delta Request
+			if err = json.Unmarshal(msg, &delta); err != nil {
+				readErrs <- &internal.HandlerError{
+					StatusCode: 400,
+					ErrCode:    internal.ErrCodeBadJSON,
+					Err:        fmt.Errorf("failed to decode request: %s", err),
+				}
+				return
+			}
+			select {
+			case incoming <- &delta:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// the first message sets up the connection
+	var syncReq *Request
+	select {
+	case syncReq = <-incoming:
+	case err := <-readErrs:
+		return err
+	case <-ctx.Done():
+		return nil
+	}
+	if syncReq.SessionID == "" {
+		syncReq.SessionID = DefaultSessionID
+	}
+	pos, err := positionFromRequest(req)
+	if err != nil {
+		return err
+	}
+	syncReq.pos = pos
+	conn, err := h.setupConnection(req, syncReq, req.URL.Query().Get("pos") != "")
+	if err != nil {
+		hlog.FromRequest(req).Err(err).Msg("failed to get or create Conn")
+		return err
+	}
+	log := hlog.FromRequest(req).With().Str("conn_id", conn.ConnID.String()).Logger()
+	log.Info().Msg("websocket connected")
+
+	for {
+		if !h.ConnMap.KeepAlive(conn) {
+			return &internal.HandlerError{
+				StatusCode: 400,
+				ErrCode:    internal.ErrCodeUnknownPos,
+				Err:        fmt.Errorf("session expired"),
+			}
+		}
+		syncReq.timeout = WebSocketSyncTimeout
+		resp, err := h.webSocketSync(ctx, conn, syncReq, incoming, &log)
+		if err != nil {
+			return err
+		}
+		// every response advances the position, so empty responses are sent too, else clients would
+		// resume from a position the connection no longer knows about
+		if err := ws.WriteJSON(resp.resp); err != nil {
+			log.Warn().Err(err).Msg("failed to write to websocket")
+			return nil
+		}
+		select {
+		case err := <-readErrs:
+			return err
+		case <-ctx.Done():
+			log.Info().Msg("websocket disconnected")
+			return nil
+		default:
+		}
+		// the next request is either a new delta from the client, or an empty delta to keep syncing
+		syncReq = resp.nextReq
+		if syncReq == nil {
+			syncReq = &Request{}
+		}
+		syncReq.pos = resp.resp.Pos
+	}
+}
+
+type webSocketSyncResult struct {
+	resp *Response
+	// a request delta which arrived whilst waiting for the response, to be processed next
+	nextReq *Request
+}
+
+// webSocketSync processes a single request, interrupting it if the client sends a new request delta
+// so the new delta can be processed promptly.
+func (h *SyncLiveHandler) webSocketSync(
+	ctx context.Context, conn *Conn, syncReq *Request, incoming chan *Request, log *zerolog.Logger,
+) (*webSocketSyncResult, error) {
+	reqCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		resp *Response
+		herr *internal.HandlerError
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		resp, herr := conn.OnIncomingRequest(reqCtx, syncReq)
+		resultCh <- result{resp, herr}
+	}()
+	var res result
+	var nextReq *Request
+	select {
+	case res = <-resultCh:
+	case nextReq = <-incoming:
+		// stop waiting for updates and return whatever we have so far
+		cancel()
+		res = <-resultCh
+	}
+	if res.herr != nil {
+		log.Err(res.herr).Msg("failed to OnIncomingRequest")
+		return nil, res.herr
+	}
+	return &webSocketSyncResult{
+		resp:    res.resp,
+		nextReq: nextReq,
+	}, nil
+}
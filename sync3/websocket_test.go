@@ -0,0 +1,64 @@
+package sync3
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Test that a request on a WebSocket is interrupted when the client sends a new request delta, so the
+// delta can be processed promptly, and that the response so far is still returned.
+func TestWebSocketSyncInterrupted(t *testing.T) {
+	connID := ConnID{
+		DeviceID:  "d",
+		SessionID: "s",
+	}
+	c := NewConn(connID, nil, func(ctx context.Context, cid ConnID, req *Request) (*Response, error) {
+		if req.pos == 0 {
+			return &Response{Count: 1}, nil
+		}
+		// block until interrupted
+		<-ctx.Done()
+		return &Response{Count: 2}, nil
+	})
+	h := &SyncLiveHandler{}
+	log := zerolog.Nop()
+	incoming := make(chan *Request)
+
+	// the initial request isn't interrupted
+	res, err := h.webSocketSync(context.Background(), c, &Request{}, incoming, &log)
+	if err != nil {
+		t.Fatalf("webSocketSync returned error: %s", err)
+	}
+	if res.nextReq != nil {
+		t.Fatalf("webSocketSync returned next request when none was sent")
+	}
+	assertInt(t, res.resp.Pos, 1)
+	assertInt(t, res.resp.Count, 1)
+
+	// the next request blocks until the client sends a delta
+	delta := &Request{
+		Sort: []string{SortByName},
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		incoming <- delta
+	}()
+	res, err = h.webSocketSync(context.Background(), c, &Request{pos: 1}, incoming, &log)
+	if err != nil {
+		t.Fatalf("webSocketSync returned error: %s", err)
+	}
+	if res.nextReq != delta {
+		t.Fatalf("webSocketSync did not return the delta sent by the client")
+	}
+	assertInt(t, res.resp.Pos, 2)
+	assertInt(t, res.resp.Count, 2)
+
+	// errors are returned
+	_, err = h.webSocketSync(context.Background(), c, &Request{pos: 31415}, incoming, &log)
+	if err == nil {
+		t.Fatalf("webSocketSync did not return an error for an unknown position")
+	}
+}
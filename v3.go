@@ -1,8 +1,6 @@
 package syncv3
 
 import (
-	"encoding/json"
-	"fmt"
 	"net/http"
 	"os"
 	"time"
@@ -44,10 +42,11 @@ func allowCORS(next http.Handler) http.HandlerFunc {
 }
 
 // RunSyncV3Server is the main entry point to the server
-func RunSyncV3Server(h http.Handler, bindAddr string) {
+func RunSyncV3Server(h, wsHandler http.Handler, bindAddr string) {
 	// HTTP path routing
 	r := mux.NewRouter()
 	r.Handle("/_matrix/client/v3/sync", h)
+	r.Handle("/_matrix/client/v3/sync/ws", wsHandler)
 	r.PathPrefix("/client/").HandlerFunc(
 		allowCORS(
 			http.StripPrefix("/client/", http.FileServer(http.Dir("./client"))),
@@ -77,22 +76,3 @@ func RunSyncV3Server(h http.Handler, bindAddr string) {
 		logger.Fatal().Err(err).Msg("failed to listen and serve")
 	}
 }
-
-type HandlerError struct {
-	StatusCode int
-	Err        error
-}
-
-func (e *HandlerError) Error() string {
-	return fmt.Sprintf("HTTP %d : %s", e.StatusCode, e.Err.Error())
-}
-
-type jsonError struct {
-	Err string `json:"error"`
-}
-
-func (e HandlerError) JSON() []byte {
-	je := jsonError{e.Error()}
-	b, _ := json.Marshal(je)
-	return b
-}